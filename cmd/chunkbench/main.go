@@ -0,0 +1,114 @@
+// Command chunkbench measures chunking, hashing and reassembly throughput
+// and optionally compares the results against a saved baseline, failing if
+// any benchmark regressed beyond a tolerance.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/maneesh/labdropbox/internal/chunker/bench"
+)
+
+// Result is one benchmark's measurements, as stored in a baseline file
+type Result struct {
+	Name        string  `json:"name"`
+	NsPerOp     int64   `json:"ns_per_op"`
+	MBPerSec    float64 `json:"mb_per_sec"`
+	AllocsPerOp int64   `json:"allocs_per_op"`
+	BytesPerOp  int64   `json:"bytes_per_op"`
+}
+
+func main() {
+	baseline := flag.String("baseline", "", "compare against this baseline file")
+	save := flag.String("save", "", "write results to this baseline file")
+	tolerance := flag.Float64("tolerance", 0.2, "allowed slowdown vs the baseline (0.2 = 20%)")
+	allocsOnly := flag.Bool("allocs-only", false, "compare allocs/op only, for baselines recorded on other hardware")
+	flag.Parse()
+
+	var results []Result
+	for _, bm := range bench.Cases() {
+		r := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(bm.Bytes)
+			bm.Run(b)
+		})
+		result := Result{
+			Name:        bm.Name,
+			NsPerOp:     r.NsPerOp(),
+			AllocsPerOp: r.AllocsPerOp(),
+			BytesPerOp:  r.AllocedBytesPerOp(),
+		}
+		if r.T > 0 {
+			result.MBPerSec = float64(r.Bytes) * float64(r.N) / r.T.Seconds() / 1e6
+		}
+		results = append(results, result)
+		fmt.Printf("%-36s %12d ns/op %10.1f MB/s %8d allocs/op %12d B/op\n",
+			result.Name, result.NsPerOp, result.MBPerSec, result.AllocsPerOp, result.BytesPerOp)
+	}
+
+	if *save != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode results: %v", err)
+		}
+		if err := os.WriteFile(*save, append(data, '\n'), 0o644); err != nil {
+			log.Fatalf("Failed to write baseline: %v", err)
+		}
+		log.Printf("Baseline written to %s", *save)
+	}
+
+	if *baseline != "" {
+		if regressions := compare(*baseline, results, *tolerance, *allocsOnly); regressions > 0 {
+			log.Fatalf("%d benchmark(s) regressed more than %.0f%%", regressions, *tolerance*100)
+		}
+		log.Printf("No regressions against %s", *baseline)
+	}
+}
+
+// compare reports each result slower than its baseline by more than
+// tolerance, or with allocsOnly each making more than tolerance more
+// allocations, and returns how many there were
+func compare(path string, results []Result, tolerance float64, allocsOnly bool) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read baseline: %v", err)
+	}
+	var previous []Result
+	if err := json.Unmarshal(data, &previous); err != nil {
+		log.Fatalf("Failed to parse baseline: %v", err)
+	}
+
+	byName := make(map[string]Result, len(previous))
+	for _, r := range previous {
+		byName[r.Name] = r
+	}
+
+	regressions := 0
+	for _, r := range results {
+		old, ok := byName[r.Name]
+		if !ok {
+			continue
+		}
+		if allocsOnly {
+			if float64(r.AllocsPerOp) > float64(old.AllocsPerOp)*(1+tolerance) {
+				regressions++
+				fmt.Printf("REGRESSION %s: %d -> %d allocs/op\n", r.Name, old.AllocsPerOp, r.AllocsPerOp)
+			}
+			continue
+		}
+		if old.NsPerOp == 0 {
+			continue
+		}
+		change := float64(r.NsPerOp-old.NsPerOp) / float64(old.NsPerOp)
+		if change > tolerance {
+			regressions++
+			fmt.Printf("REGRESSION %s: %d -> %d ns/op (+%.0f%%)\n", r.Name, old.NsPerOp, r.NsPerOp, change*100)
+		}
+	}
+	return regressions
+}
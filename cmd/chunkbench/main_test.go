@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	baseline := []Result{
+		{Name: "steady", NsPerOp: 1000},
+		{Name: "slower", NsPerOp: 1000},
+		{Name: "regressed", NsPerOp: 1000},
+		{Name: "faster", NsPerOp: 1000},
+		{Name: "unmeasured", NsPerOp: 0},
+	}
+	data, err := json.Marshal(baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	results := []Result{
+		{Name: "steady", NsPerOp: 1000},
+		{Name: "slower", NsPerOp: 1200},    // exactly at the tolerance
+		{Name: "regressed", NsPerOp: 1201}, // just past it
+		{Name: "faster", NsPerOp: 500},
+		{Name: "unmeasured", NsPerOp: 5000},
+		{Name: "new", NsPerOp: 5000}, // not in the baseline
+	}
+	if got := compare(path, results, 0.2, false); got != 1 {
+		t.Errorf("compare found %d regressions, want 1", got)
+	}
+	if got := compare(path, results, 0, false); got != 2 {
+		t.Errorf("compare with no tolerance found %d regressions, want 2", got)
+	}
+}
+
+func TestCompareAllocsOnly(t *testing.T) {
+	baseline := []Result{
+		{Name: "steady", NsPerOp: 1000, AllocsPerOp: 10},
+		{Name: "slower", NsPerOp: 1000, AllocsPerOp: 10},
+		{Name: "allocating", NsPerOp: 1000, AllocsPerOp: 10},
+		{Name: "zero", NsPerOp: 1000, AllocsPerOp: 0},
+	}
+	data, err := json.Marshal(baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	results := []Result{
+		{Name: "steady", NsPerOp: 1000, AllocsPerOp: 12}, // exactly at the tolerance
+		{Name: "slower", NsPerOp: 9000, AllocsPerOp: 10}, // time is ignored
+		{Name: "allocating", NsPerOp: 1000, AllocsPerOp: 13},
+		{Name: "zero", NsPerOp: 1000, AllocsPerOp: 1},
+	}
+	if got := compare(path, results, 0.2, true); got != 2 {
+		t.Errorf("compare found %d allocation regressions, want 2", got)
+	}
+}
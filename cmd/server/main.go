@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -10,11 +12,18 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/maneesh/labdropbox/internal/chunker"
+	"github.com/maneesh/labdropbox/internal/capacity"
 	"github.com/maneesh/labdropbox/internal/config"
 	"github.com/maneesh/labdropbox/internal/handlers"
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/maintenance"
+	"github.com/maneesh/labdropbox/internal/metrics"
+	"github.com/maneesh/labdropbox/internal/middleware"
+	"github.com/maneesh/labdropbox/internal/progress"
 	"github.com/maneesh/labdropbox/internal/storage"
 	"github.com/maneesh/labdropbox/internal/tracing"
+	"github.com/maneesh/labdropbox/internal/transform"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
@@ -27,10 +36,18 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	// Route all logging, including the log package, through slog
+	logger, err := logging.NewLogger(os.Stderr, cfg.LogFormat)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	slog.SetDefault(logger)
+
 	log.Printf("Service: %s, Port: %s", cfg.ServiceName, cfg.ServicePort)
 
 	// Initialize OpenTelemetry tracing
-	shutdownTracer, err := tracing.InitTracer(cfg.ServiceName, cfg.JaegerEndpoint)
+	shutdownTracer, err := tracing.InitTracer(cfg.ServiceName, cfg.JaegerEndpoint, cfg.TracePropagators,
+		cfg.TraceSampler, cfg.TraceSampleRatio)
 	if err != nil {
 		log.Fatalf("Failed to initialize tracer: %v", err)
 	}
@@ -42,23 +59,109 @@ func main() {
 		}
 	}()
 
+	// Initialize OpenTelemetry metrics, pushed over OTLP to the tracing
+	// endpoint or scraped from /metrics in Prometheus format
+	var shutdownMeter func(context.Context) error
+	otlpMetrics := cfg.MetricsExporter == "otlp" || cfg.MetricsExporter == "both"
+	promMetrics := cfg.MetricsExporter == "prometheus" || cfg.MetricsExporter == "both"
+	if otlpMetrics || promMetrics {
+		shutdownMeter, err = tracing.InitMeter(cfg.ServiceName, cfg.JaegerEndpoint, otlpMetrics, promMetrics)
+	}
+	if err != nil {
+		log.Fatalf("Failed to initialize metrics: %v", err)
+	}
+	if shutdownMeter != nil {
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownMeter(ctx); err != nil {
+				log.Printf("Error shutting down metrics: %v", err)
+			}
+		}()
+	}
+
 	// Initialize MinIO client
 	log.Println("Connecting to MinIO...")
-	minioClient, err := storage.NewMinioClient(
-		cfg.MinIOEndpoint,
-		cfg.MinIOAccessKey,
-		cfg.MinIOSecretKey,
-		cfg.MinIOBucketName,
-		cfg.MinIOUseSSL,
-	)
+	startupTimeout := time.Duration(cfg.StartupTimeoutSec) * time.Second
+	minioClient, err := connectWithRetry("MinIO", startupTimeout, func() (*storage.MinioClient, error) {
+		return storage.NewMinioClient(
+			cfg.MinIOEndpoint,
+			cfg.MinIOAccessKey,
+			cfg.MinIOSecretKey,
+			cfg.MinIOBucketName,
+			storage.MinioOptions{
+				UseSSL:             cfg.MinIOUseSSL,
+				ObjectLocking:      cfg.MinIOObjectLocking,
+				KeySecret:          cfg.MinIOKeySecret,
+				WriteCheck:         cfg.StartupWriteCheck,
+				BreakerFailures:    uint32(cfg.MinIOBreakerFailures),
+				BreakerOpenTimeout: time.Duration(cfg.MinIOBreakerOpenSec) * time.Second,
+				MaxRetries:         cfg.MinIOMaxRetries,
+				RetryBaseDelay:     time.Duration(cfg.MinIORetryBaseMS) * time.Millisecond,
+				OpTimeout:          time.Duration(cfg.MinIOOpTimeoutMS) * time.Millisecond,
+			},
+		)
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize MinIO client: %v", err)
 	}
 	log.Println("MinIO client initialized")
+	metrics.ObserveBreaker(minioClient.BreakerState)
+
+	// Abort multipart chunk uploads abandoned by failed or crashed writes,
+	// at startup and then hourly
+	if cfg.MinIOStaleUploadAge > 0 {
+		go func() {
+			for {
+				aborted, err := minioClient.AbortStaleUploads(context.Background(), cfg.MinIOStaleUploadAge)
+				if err != nil {
+					log.Printf("Warning: stale upload cleanup failed: %v", err)
+				} else if aborted > 0 {
+					log.Printf("Aborted %d stale multipart uploads", aborted)
+				}
+				time.Sleep(time.Hour)
+			}
+		}()
+	}
+
+	// Initialize the optional secondary store for shadow reads
+	var shadowReader *storage.ShadowReader
+	if cfg.ShadowReadEnabled {
+		log.Println("Connecting to shadow MinIO...")
+		shadowClient, err := connectWithRetry("shadow MinIO", startupTimeout, func() (*storage.MinioClient, error) {
+			return storage.NewMinioClient(
+				cfg.ShadowMinIOEndpoint,
+				cfg.ShadowMinIOAccessKey,
+				cfg.ShadowMinIOSecretKey,
+				cfg.ShadowMinIOBucketName,
+				storage.MinioOptions{
+					UseSSL:             cfg.ShadowMinIOUseSSL,
+					BreakerFailures:    uint32(cfg.MinIOBreakerFailures),
+					BreakerOpenTimeout: time.Duration(cfg.MinIOBreakerOpenSec) * time.Second,
+					MaxRetries:         cfg.MinIOMaxRetries,
+					RetryBaseDelay:     time.Duration(cfg.MinIORetryBaseMS) * time.Millisecond,
+					OpTimeout:          time.Duration(cfg.MinIOOpTimeoutMS) * time.Millisecond,
+				},
+			)
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize shadow MinIO client: %v", err)
+		}
+		shadowReader = storage.NewShadowReader(shadowClient, cfg.ShadowReadMaxInFlight)
+		log.Println("Shadow reads enabled")
+	}
 
 	// Initialize TiDB client
 	log.Println("Connecting to TiDB...")
-	tidbClient, err := storage.NewTiDBClient(cfg.GetDSN())
+	tidbClient, err := connectWithRetry("TiDB", startupTimeout, func() (*storage.TiDBClient, error) {
+		return storage.NewTiDBClient(cfg.GetDSN(), storage.TiDBOptions{
+			BinaryHashes:    cfg.TiDBBinaryHashes,
+			MaxOpenConns:    cfg.TiDBMaxOpenConns,
+			MaxIdleConns:    cfg.TiDBMaxIdleConns,
+			ConnMaxLifetime: time.Duration(cfg.TiDBConnMaxLifetimeSec) * time.Second,
+			OpTimeout:       time.Duration(cfg.TiDBOpTimeoutMS) * time.Millisecond,
+		})
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize TiDB client: %v", err)
 	}
@@ -67,7 +170,10 @@ func main() {
 
 	// Initialize Redis client
 	log.Println("Connecting to Redis...")
-	redisClient, err := storage.NewRedisClient(cfg.GetRedisAddr(), cfg.RedisPassword, cfg.RedisDB)
+	redisClient, err := connectWithRetry("Redis", startupTimeout, func() (*storage.RedisClient, error) {
+		return storage.NewRedisClient(cfg.GetRedisAddr(), cfg.RedisPassword, cfg.RedisDB,
+			time.Duration(cfg.CacheTTLSec)*time.Second, time.Duration(cfg.RedisOpTimeoutMS)*time.Millisecond)
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize Redis client: %v", err)
 	}
@@ -75,32 +181,204 @@ func main() {
 	log.Println("Redis client initialized")
 
 	// Initialize chunker
-	chunkerInstance := chunker.NewChunker(cfg.GetChunkSizeBytes())
+	chunkerInstance, err := cfg.NewChunker()
+	if err != nil {
+		log.Fatalf("Failed to initialize chunker: %v", err)
+	}
+
+	// Initialize chunk encryption, if a key is configured
+	chunkCipher, err := cfg.NewCipher()
+	if err != nil {
+		log.Fatalf("Failed to initialize chunk encryption: %v", err)
+	}
+	if chunkCipher != nil {
+		log.Println("Chunk encryption enabled (AES-256-GCM)")
+	}
+
+	// Initialize upload progress tracking
+	progressRegistry := progress.NewRegistry()
+
+	// Initialize the read-only maintenance switch
+	maintenanceMode := maintenance.NewMode(cfg.ReadOnly)
 
 	// Initialize handlers
-	writeHandler := handlers.NewWriteHandler(minioClient, tidbClient, redisClient, chunkerInstance)
-	readHandler := handlers.NewReadHandler(minioClient, tidbClient, redisClient)
+	writeHandler := handlers.NewWriteHandler(minioClient, tidbClient, redisClient, chunkerInstance, progressRegistry, handlers.WriteOptions{
+		UploadConcurrency:  cfg.WriteConcurrency,
+		ChunkUploadTimeout: cfg.MinIOChunkUploadTimeout,
+		RetentionMode:      cfg.MinIORetentionMode,
+		RetentionDays:      cfg.MinIORetentionDays,
+		CacheChunks:        cfg.ChunkMetadataCache,
+		ContentAddressed:   cfg.ContentAddressedChunks,
+		Compression:        cfg.Compression,
+		Cipher:             chunkCipher,
+		MaxFileSize:        int64(cfg.MaxFileSizeMB) * 1024 * 1024,
+
+		ChunkInsertBatchSize:   cfg.ChunkInsertBatchSize,
+		ChunkInsertParallelism: cfg.ChunkInsertParallelism,
+	})
+	readHandler := handlers.NewReadHandler(minioClient, tidbClient, redisClient, handlers.ReadOptions{
+		Cipher:                chunkCipher,
+		ReadAfterWriteWindow:  time.Duration(cfg.ReadAfterWriteWindowSec) * time.Second,
+		ReadAfterWriteRetries: cfg.ReadAfterWriteRetries,
+		ReadAfterWriteBackoff: time.Duration(cfg.ReadAfterWriteBackoffMS) * time.Millisecond,
+		MaxDownloadMemory:     cfg.MaxDownloadMemory,
+		ReadConcurrency:       cfg.ReadConcurrency,
+		CoalesceMaxBytes:      cfg.ReadCoalesceMaxBytes,
+		IncompleteStatus:      cfg.ReadIncompleteStatus,
+		SniffContentType:      cfg.ReadSniffContentType,
+		DegradedMetadata:      cfg.ReadDegradedMetadata,
+		CachedChunks:          cfg.ChunkMetadataCache,
+		ReadAheadChunks:       cfg.ReadAheadChunks,
+		RetryFailedRead:       cfg.ReadRetryEnabled,
+		RetryDelay:            time.Duration(cfg.ReadRetryDelayMS) * time.Millisecond,
+		Transforms:            transform.DefaultRegistry(),
+		Shadow:                shadowReader,
+
+		CachedChunkData:        cfg.ChunkDataCache,
+		ChunkDataCacheMaxBytes: cfg.ChunkDataCacheMaxBytes,
+		ChunkDataCacheTTL:      cfg.ChunkDataCacheTTL,
+
+		GzipResponses: cfg.ReadGzip,
+		GzipMinSize:   cfg.ReadGzipMinSize,
+	})
+	progressHandler := handlers.NewProgressHandler(progressRegistry)
+	exportHandler := handlers.NewExportHandler(tidbClient)
+	appendHandler := handlers.NewAppendHandler(writeHandler)
+	copyHandler := handlers.NewCopyHandler(minioClient, tidbClient, cfg.WriteConcurrency, cfg.ContentAddressedChunks)
+	deleteHandler := handlers.NewDeleteHandler(minioClient, tidbClient, redisClient, cfg.WriteConcurrency)
+	manifestHandler := handlers.NewManifestHandler(readHandler)
+	aliasHandler := handlers.NewAliasHandler(readHandler)
+	verifyHandler := handlers.NewVerifyHandler(readHandler)
+	statHandler := handlers.NewStatHandler(tidbClient, redisClient)
+	recentHandler := handlers.NewRecentHandler(tidbClient, redisClient, time.Duration(cfg.RecentFilesCacheTTLSec)*time.Second)
+	listHandler := handlers.NewListHandler(tidbClient)
+	sessionHandler := handlers.NewSessionHandler(writeHandler, handlers.SessionOptions{
+		IdleTimeout:  cfg.UploadSessionIdleTimeout,
+		MaxChunks:    cfg.UploadSessionMaxChunks,
+		MaxPerClient: cfg.UploadSessionMaxPerClient,
+	})
+	healthHandler := handlers.NewHealthHandler(map[string]handlers.Pinger{
+		"tidb":  tidbClient,
+		"redis": redisClient,
+		"minio": minioClient,
+	}, maintenanceMode)
+	maintenanceHandler := handlers.NewMaintenanceHandler(maintenanceMode)
+
+	// Purge upload sessions abandoned before completion, with their chunks
+	if cfg.UploadSessionCleanupInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(cfg.UploadSessionCleanupInterval)
+				purged, err := sessionHandler.CleanIdle(context.Background())
+				if err != nil {
+					log.Printf("Warning: upload session cleanup failed: %v", err)
+				} else if purged > 0 {
+					log.Printf("Purged %d idle upload sessions", purged)
+				}
+			}
+		}()
+	}
+
+	// Compute checksums for files that have none, at startup and then
+	// every interval
+	if cfg.ChecksumBackfillInterval > 0 {
+		backfill := handlers.NewChecksumBackfill(readHandler, cfg.ChecksumBackfillConcurrency)
+		go func() {
+			for {
+				filled, err := backfill.Run(context.Background())
+				if err != nil {
+					log.Printf("Warning: checksum backfill failed: %v", err)
+				} else if filled > 0 {
+					log.Printf("Backfilled checksums of %d files", filled)
+				}
+				time.Sleep(cfg.ChecksumBackfillInterval)
+			}
+		}()
+	}
+
+	// Sample stored bytes against the soft limit in the background
+	var capacityGuard *capacity.Guard
+	if cfg.StorageSoftLimitBytes > 0 {
+		capacityGuard = capacity.NewGuard(cfg.StorageSoftLimitBytes)
+		go capacityGuard.Run(context.Background(), tidbClient.TotalFileBytes, cfg.StorageUsageSamplePeriod)
+	}
 
 	// Setup HTTP router
 	router := mux.NewRouter()
 
-	// Health check endpoint (no tracing needed)
-	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	}).Methods("GET")
+	// Outermost, so panics anywhere in the stack get a 500. Traced routes
+	// recover again inside their span to record the panic on it.
+	router.Use(middleware.Recover)
+	router.Use(middleware.DebugLog(cfg.DebugRequestLogging, cfg.AdminToken))
+	router.Use(middleware.ValidateRequest(middleware.ValidationOptions{
+		MaxNameLength:  cfg.MaxNameLength,
+		MaxParamLength: cfg.MaxQueryParamLength,
+	}))
+
+	// traced wraps a route with an OTel server span, and inside it a
+	// request logger tagged with the trace ID and panic recovery, so
+	// recovered panics are recorded on the request span
+	traced := func(h http.Handler, operation string) http.Handler {
+		return otelhttp.NewHandler(middleware.RequestLogger(middleware.Recover(h)), operation)
+	}
+
+	// writable rejects requests that modify files while in read-only mode
+	writable := middleware.RejectWhenReadOnly(maintenanceMode)
+	admin := middleware.RequireAdminToken(cfg.AdminToken)
+
+	// storing additionally rejects requests that add data while storage is
+	// over its soft limit
+	full := middleware.RejectWhenFull(capacityGuard)
+	storing := func(h http.Handler) http.Handler { return writable(full(h)) }
+
+	// minRate aborts downloads the client drains too slowly
+	minRate := middleware.MinDownloadRate(cfg.MinDownloadRateBytesPerSec,
+		time.Duration(cfg.MinDownloadRateWindowSec)*time.Second)
+
+	// Health check endpoints (no tracing needed)
+	router.Handle("/health", healthHandler).Methods("GET")
+	router.Handle("/livez", http.HandlerFunc(healthHandler.Live)).Methods("GET")
+	if promMetrics {
+		router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	}
 
 	// File operations with tracing
-	router.Handle("/write", otelhttp.NewHandler(writeHandler, "PUT /write")).Methods("PUT")
-	router.Handle("/read/{file_id}", otelhttp.NewHandler(readHandler, "GET /read/{file_id}")).Methods("GET")
+	router.Handle("/write", traced(storing(writeHandler), "PUT /write")).Methods("PUT")
+	router.Handle("/read/{file_id}", minRate(traced(readHandler, "GET /read/{file_id}"))).Methods("GET")
+	router.Handle("/read/{file_id}", traced(readHandler, "HEAD /read/{file_id}")).Methods("HEAD")
+	router.Handle("/files/export", traced(exportHandler, "GET /files/export")).Methods("GET")
+	router.Handle("/files", traced(listHandler, "GET /files")).Methods("GET")
+	router.Handle("/files/recent", traced(recentHandler, "GET /files/recent")).Methods("GET")
+	router.Handle("/files/stat", traced(statHandler, "POST /files/stat")).Methods("POST")
+	router.Handle("/files/{file_id}/full", traced(manifestHandler, "GET /files/{file_id}/full")).Methods("GET")
+	router.Handle("/files/{file_id}/metadata", traced(manifestHandler, "GET /files/{file_id}/metadata")).Methods("GET")
+	router.Handle("/files/{file_id}/append", traced(storing(appendHandler), "PUT /files/{file_id}/append")).Methods("PUT")
+	router.Handle("/files/{file_id}/alias", traced(writable(http.HandlerFunc(aliasHandler.Create)), "POST /files/{file_id}/alias")).Methods("POST")
+	router.Handle("/a/{alias}", minRate(traced(http.HandlerFunc(aliasHandler.Resolve), "GET /a/{alias}"))).Methods("GET")
+	router.Handle("/delete-batch", traced(writable(deleteHandler), "POST /delete-batch")).Methods("POST")
+	router.Handle("/files/{file_id}/copy", traced(storing(copyHandler), "POST /files/{file_id}/copy")).Methods("POST")
+
+	// Resumable upload sessions
+	router.Handle("/uploads", traced(storing(http.HandlerFunc(sessionHandler.Create)), "POST /uploads")).Methods("POST")
+	router.Handle("/uploads/{upload_id}", traced(http.HandlerFunc(sessionHandler.Status), "GET /uploads/{upload_id}")).Methods("GET")
+	router.Handle("/uploads/{upload_id}/chunks/{index}", traced(storing(http.HandlerFunc(sessionHandler.PutChunk)), "PUT /uploads/{upload_id}/chunks/{index}")).Methods("PUT")
+	router.Handle("/uploads/{upload_id}/complete", traced(writable(http.HandlerFunc(sessionHandler.Complete)), "POST /uploads/{upload_id}/complete")).Methods("POST")
+
+	// Admin controls
+	router.Handle("/admin/read-only", admin(maintenanceHandler)).Methods("GET", "PUT")
+	router.Handle("/files/{file_id}/verify", traced(admin(verifyHandler), "POST /files/{file_id}/verify")).Methods("POST")
+
+	// Upload progress stream (long-lived, so not traced)
+	router.Handle("/uploads/{upload_id}/progress", progressHandler).Methods("GET")
 
 	// Create HTTP server
 	srv := &http.Server{
-		Addr:         ":" + cfg.ServicePort,
-		Handler:      router,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:           ":" + cfg.ServicePort,
+		Handler:        router,
+		ReadTimeout:    30 * time.Second,
+		WriteTimeout:   30 * time.Second,
+		IdleTimeout:    60 * time.Second,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
 	}
 
 	// Start server in a goroutine
@@ -128,3 +406,28 @@ func main() {
 
 	log.Println("Server exited")
 }
+
+// connectWithRetry calls connect until it succeeds, backing off between
+// attempts, so dependencies that start alongside the service get time to
+// come up. The last error is returned once timeout has passed.
+func connectWithRetry[T any](name string, timeout time.Duration, connect func() (T, error)) (T, error) {
+	const maxBackoff = 10 * time.Second
+
+	deadline := time.Now().Add(timeout)
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		client, err := connect()
+		if err == nil {
+			return client, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return client, fmt.Errorf("gave up after %d attempts in %s: %w", attempt, timeout, err)
+		}
+		wait := min(backoff, remaining)
+		log.Printf("%s not ready (attempt %d): %v; retrying in %s", name, attempt, err, wait)
+		time.Sleep(wait)
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
@@ -0,0 +1,64 @@
+package capacity
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// UsageFunc reports how many bytes are currently stored
+type UsageFunc func(ctx context.Context) (int64, error)
+
+// Guard compares stored bytes against a soft limit. Usage is sampled in the
+// background, so checking it on a request is only a memory read.
+type Guard struct {
+	limit   int64
+	usage   atomic.Int64
+	sampled atomic.Bool
+}
+
+// NewGuard creates a guard for the given soft limit in bytes
+func NewGuard(limit int64) *Guard {
+	return &Guard{limit: limit}
+}
+
+// Run samples usage immediately and then every interval until ctx is done.
+// A failed sample keeps the previous value.
+func (g *Guard) Run(ctx context.Context, usage UsageFunc, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if used, err := usage(ctx); err != nil {
+			log.Printf("Warning: failed to sample storage usage: %v", err)
+		} else {
+			wasFull := g.Full()
+			g.usage.Store(used)
+			g.sampled.Store(true)
+			if full := g.Full(); full != wasFull {
+				log.Printf("Storage usage %d of %d bytes: rejecting writes = %t", used, g.limit, full)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Full reports whether the last sampled usage reached the limit. It is false
+// before the first sample and for a nil guard.
+func (g *Guard) Full() bool {
+	if g == nil || !g.sampled.Load() {
+		return false
+	}
+	return g.usage.Load() >= g.limit
+}
+
+// Usage returns the last sampled usage and the limit, in bytes
+func (g *Guard) Usage() (used, limit int64) {
+	return g.usage.Load(), g.limit
+}
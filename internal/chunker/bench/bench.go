@@ -0,0 +1,123 @@
+// Package bench defines the chunker benchmarks shared by the chunker's Go
+// benchmarks and the chunkbench regression guard, so both measure the same
+// cases under the same names.
+package bench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/maneesh/labdropbox/internal/chunker"
+)
+
+// Case is a named benchmark over a fixed input size
+type Case struct {
+	Name  string
+	Bytes int64
+	Run   func(b *testing.B)
+}
+
+const (
+	kb = 1024
+	mb = 1024 * kb
+)
+
+// Cases returns benchmarks of chunking, hashing and reassembly across file
+// and chunk sizes representative of small files and the default 1MB chunk.
+// Names start with ChunkStream/, Reassemble/, ReassembleTo/ or
+// ComputeHash/. The input data is generated once and shared.
+var Cases = sync.OnceValue(func() []Case {
+	var cases []Case
+
+	for _, size := range []struct {
+		label string
+		file  int64
+		chunk int64
+	}{
+		{"1MB/64KB", 1 * mb, 64 * kb},
+		{"16MB/1MB", 16 * mb, 1 * mb},
+		{"64MB/4MB", 64 * mb, 4 * mb},
+	} {
+		data := randomData(size.file)
+		c, err := chunker.NewChunker(size.chunk)
+		if err != nil {
+			panic(err)
+		}
+
+		cases = append(cases, Case{
+			Name:  "ChunkStream/" + size.label,
+			Bytes: size.file,
+			Run: func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, _, err := c.ChunkStream(context.Background(), bytes.NewReader(data)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			},
+		})
+
+		chunks := split(data, size.chunk)
+		cases = append(cases, Case{
+			Name:  "Reassemble/" + size.label,
+			Bytes: size.file,
+			Run: func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					chunker.ReassembleChunks(chunks)
+				}
+			},
+		})
+		cases = append(cases, Case{
+			Name:  "ReassembleTo/" + size.label,
+			Bytes: size.file,
+			Run: func(b *testing.B) {
+				// Writing into a reused buffer measures the copy without
+				// per-iteration allocation; io.Discard would measure nothing
+				var buf bytes.Buffer
+				buf.Grow(len(data))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					buf.Reset()
+					if _, err := chunker.ReassembleTo(&buf, chunks); err != nil {
+						b.Fatal(err)
+					}
+				}
+			},
+		})
+	}
+
+	for _, size := range []int64{64 * kb, 1 * mb, 4 * mb} {
+		data := randomData(size)
+		cases = append(cases, Case{
+			Name:  fmt.Sprintf("ComputeHash/%dKB", size/kb),
+			Bytes: size,
+			Run: func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					chunker.ComputeHash(data)
+				}
+			},
+		})
+	}
+
+	return cases
+})
+
+// randomData returns deterministic pseudo-random bytes
+func randomData(size int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+// split cuts data into chunks of chunkSize bytes
+func split(data []byte, chunkSize int64) [][]byte {
+	var chunks [][]byte
+	for start := int64(0); start < int64(len(data)); start += chunkSize {
+		end := min(start+chunkSize, int64(len(data)))
+		chunks = append(chunks, data[start:end])
+	}
+	return chunks
+}
@@ -0,0 +1,29 @@
+package chunker_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maneesh/labdropbox/internal/chunker/bench"
+)
+
+func BenchmarkChunkStream(b *testing.B)  { runCases(b, "ChunkStream/") }
+func BenchmarkReassemble(b *testing.B)   { runCases(b, "Reassemble/") }
+func BenchmarkReassembleTo(b *testing.B) { runCases(b, "ReassembleTo/") }
+func BenchmarkComputeHash(b *testing.B)  { runCases(b, "ComputeHash/") }
+
+// runCases runs the shared benchmark cases whose names start with prefix as
+// sub-benchmarks, named by the rest of the case name
+func runCases(b *testing.B, prefix string) {
+	for _, c := range bench.Cases() {
+		name, ok := strings.CutPrefix(c.Name, prefix)
+		if !ok {
+			continue
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(c.Bytes)
+			c.Run(b)
+		})
+	}
+}
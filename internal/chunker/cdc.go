@@ -0,0 +1,170 @@
+package chunker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/maneesh/labdropbox/internal/models"
+)
+
+// StrategyContentDefined picks chunk boundaries from the data itself with a
+// rolling hash, so an insertion only changes the chunks around it
+const StrategyContentDefined = "content-defined"
+
+// Splitter is the chunking contract shared by Chunker (fixed-size) and
+// ContentDefinedChunker
+type Splitter interface {
+	// Strategy returns the name of the chunking strategy, recorded on each file
+	Strategy() string
+	// ChunkSize returns the target chunk size in bytes
+	ChunkSize() int64
+	// ChunkStream reads the whole stream into hashed chunks
+	ChunkStream(ctx context.Context, reader io.Reader) ([]*models.ChunkData, int64, error)
+	// ReadChunks sends unhashed chunks to out in order and closes it
+	ReadChunks(ctx context.Context, reader io.Reader, out chan<- *models.ChunkData) (int64, error)
+}
+
+// gearTable maps each byte to a pseudo-random 64-bit value for the gear
+// rolling hash. It is generated with splitmix64 from a fixed seed: changing
+// it would move every boundary and defeat deduplication against stored files.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6c616264726f7062) // "labdropb"
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// ContentDefinedChunker splits streams at content-defined boundaries using a
+// gear rolling hash. Chunks are at least min and at most max bytes, and
+// average close to avg.
+type ContentDefinedChunker struct {
+	min, avg, max int64
+	// maskBits is how many top hash bits must be zero at a boundary
+	maskBits int
+}
+
+// NewContentDefinedChunker creates a content-defined chunker. Sizes must
+// satisfy MinChunkSize <= min < avg < max <= MaxChunkSize.
+func NewContentDefinedChunker(min, avg, max int64) (*ContentDefinedChunker, error) {
+	if min < MinChunkSize || max > MaxChunkSize || min >= avg || avg >= max {
+		return nil, fmt.Errorf("invalid content-defined chunk sizes min=%d avg=%d max=%d: need %d <= min < avg < max <= %d",
+			min, avg, max, MinChunkSize, MaxChunkSize)
+	}
+
+	// A boundary is expected every 2^maskBits bytes after the minimum
+	return &ContentDefinedChunker{
+		min:      min,
+		avg:      avg,
+		max:      max,
+		maskBits: bits.Len64(uint64(avg-min)) - 1,
+	}, nil
+}
+
+// Strategy implements Splitter
+func (c *ContentDefinedChunker) Strategy() string {
+	return StrategyContentDefined
+}
+
+// ChunkSize implements Splitter, returning the average chunk size
+func (c *ContentDefinedChunker) ChunkSize() int64 {
+	return c.avg
+}
+
+// ChunkStream implements Splitter
+func (c *ContentDefinedChunker) ChunkStream(ctx context.Context, reader io.Reader) ([]*models.ChunkData, int64, error) {
+	var chunks []*models.ChunkData
+	totalSize, err := c.split(ctx, reader, func(chunk *models.ChunkData) error {
+		chunk.Hash = ComputeHash(chunk.Data)
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return chunks, totalSize, nil
+}
+
+// ReadChunks implements Splitter
+func (c *ContentDefinedChunker) ReadChunks(ctx context.Context, reader io.Reader, out chan<- *models.ChunkData) (int64, error) {
+	defer close(out)
+
+	return c.split(ctx, reader, func(chunk *models.ChunkData) error {
+		// Block until the next stage has room, so memory stays bounded
+		select {
+		case out <- chunk:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// split reads the stream through a max-sized window, cutting a chunk off the
+// front at each boundary and passing it to emit
+func (c *ContentDefinedChunker) split(ctx context.Context, reader io.Reader, emit func(*models.ChunkData) error) (int64, error) {
+	window := make([]byte, c.max)
+	filled := 0
+	eof := false
+	var totalSize int64
+	orderIndex := 0
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return totalSize, fmt.Errorf("chunking aborted after %d bytes: %w", totalSize, err)
+		}
+
+		if !eof {
+			n, err := io.ReadFull(reader, window[filled:])
+			filled += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return totalSize, fmt.Errorf("error reading chunk: %w", err)
+			}
+		}
+		if filled == 0 {
+			return totalSize, nil
+		}
+
+		// Until EOF the window is full, so a boundary or max is always found
+		cut := c.boundary(window[:filled])
+		data := make([]byte, cut)
+		copy(data, window[:cut])
+		filled = copy(window, window[cut:filled])
+
+		if err := emit(&models.ChunkData{Data: data, OrderIndex: orderIndex, Size: int64(cut)}); err != nil {
+			return totalSize, fmt.Errorf("chunking aborted after %d bytes: %w", totalSize, err)
+		}
+		totalSize += int64(cut)
+		orderIndex++
+	}
+}
+
+// boundary returns the length of the next chunk at the start of data. The
+// gear hash only depends on the last 64 bytes, so boundaries resynchronize
+// shortly after an edit.
+func (c *ContentDefinedChunker) boundary(data []byte) int {
+	n := int64(len(data))
+	if n <= c.min {
+		return int(n)
+	}
+
+	limit := min(n, c.max)
+	shift := 64 - c.maskBits
+	var hash uint64
+	for i := c.min; i < limit; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash>>shift == 0 {
+			return int(i + 1)
+		}
+	}
+	return int(limit)
+}
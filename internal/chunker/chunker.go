@@ -1,6 +1,8 @@
 package chunker
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -9,25 +11,61 @@ import (
 	"github.com/maneesh/labdropbox/internal/models"
 )
 
-// Chunker handles file chunking and reassembly
+// StrategyFixed splits files into chunks of exactly the chunk size, except
+// for a shorter final chunk
+const StrategyFixed = "fixed"
+
+// StrategyClient marks files assembled from chunks the client split itself,
+// through an upload session
+const StrategyClient = "client"
+
+const (
+	// MinChunkSize is the smallest chunk size accepted by NewChunker (4KB)
+	MinChunkSize int64 = 4 * 1024
+	// MaxChunkSize is the largest chunk size accepted by NewChunker (64MB)
+	MaxChunkSize int64 = 64 * 1024 * 1024
+)
+
+// Chunker handles fixed-size file chunking and reassembly
 type Chunker struct {
 	chunkSize int64
 }
 
 // NewChunker creates a new chunker with the specified chunk size
-func NewChunker(chunkSize int64) *Chunker {
+func NewChunker(chunkSize int64) (*Chunker, error) {
+	if chunkSize < MinChunkSize || chunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d: must be between %d and %d bytes",
+			chunkSize, MinChunkSize, MaxChunkSize)
+	}
+
 	return &Chunker{
 		chunkSize: chunkSize,
-	}
+	}, nil
 }
 
-// ChunkStream reads from a reader and yields chunks of specified size
-func (c *Chunker) ChunkStream(reader io.Reader) ([]*models.ChunkData, int64, error) {
+// Strategy returns the name of the chunking strategy, recorded on each file
+func (c *Chunker) Strategy() string {
+	return StrategyFixed
+}
+
+// ChunkSize returns the target chunk size in bytes
+func (c *Chunker) ChunkSize() int64 {
+	return c.chunkSize
+}
+
+// ChunkStream reads from a reader and yields chunks of specified size.
+// It stops early with an error if ctx is cancelled (e.g. the client went away).
+func (c *Chunker) ChunkStream(ctx context.Context, reader io.Reader) ([]*models.ChunkData, int64, error) {
 	var chunks []*models.ChunkData
 	var totalSize int64
 	orderIndex := 0
 
 	for {
+		if err := ctx.Err(); err != nil {
+			// Drop what we've read so far so the buffers can be freed
+			return nil, 0, fmt.Errorf("chunking aborted after %d bytes: %w", totalSize, err)
+		}
+
 		buffer := make([]byte, c.chunkSize)
 		n, err := io.ReadFull(reader, buffer)
 
@@ -58,10 +96,60 @@ func (c *Chunker) ChunkStream(reader io.Reader) ([]*models.ChunkData, int64, err
 	return chunks, totalSize, nil
 }
 
+// ReadChunks reads from a reader and sends chunks to out in order as they are
+// read, closing out when the stream ends. Chunks are not hashed so the caller
+// can hash them in a separate pipeline stage. It returns the total bytes read.
+func (c *Chunker) ReadChunks(ctx context.Context, reader io.Reader, out chan<- *models.ChunkData) (int64, error) {
+	defer close(out)
+
+	var totalSize int64
+	orderIndex := 0
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return totalSize, fmt.Errorf("chunking aborted after %d bytes: %w", totalSize, err)
+		}
+
+		buffer := make([]byte, c.chunkSize)
+		n, err := io.ReadFull(reader, buffer)
+
+		if n > 0 {
+			chunk := &models.ChunkData{
+				Data:       buffer[:n],
+				OrderIndex: orderIndex,
+				Size:       int64(n),
+			}
+
+			// Block until the next stage has room, so memory stays bounded
+			select {
+			case out <- chunk:
+			case <-ctx.Done():
+				return totalSize, fmt.Errorf("chunking aborted after %d bytes: %w", totalSize, ctx.Err())
+			}
+
+			totalSize += int64(n)
+			orderIndex++
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return totalSize, fmt.Errorf("error reading chunk: %w", err)
+		}
+	}
+
+	return totalSize, nil
+}
+
 // ComputeHash computes SHA256 hash of data
 func ComputeHash(data []byte) string {
+	return hex.EncodeToString(ComputeHashBytes(data))
+}
+
+// ComputeHashBytes computes the raw 32-byte SHA256 hash of data
+func ComputeHashBytes(data []byte) []byte {
 	hash := sha256.Sum256(data)
-	return hex.EncodeToString(hash[:])
+	return hash[:]
 }
 
 // ReassembleChunks combines chunks in order
@@ -83,8 +171,26 @@ func ReassembleChunks(chunks [][]byte) []byte {
 	return result
 }
 
-// VerifyChunkHash verifies that chunk data matches the expected hash
+// ReassembleTo writes chunks to w in order without combining them into one
+// buffer first, returning the number of bytes written
+func ReassembleTo(w io.Writer, chunks [][]byte) (int64, error) {
+	var written int64
+	for i, chunk := range chunks {
+		n, err := w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("failed to write chunk %d: %w", i, err)
+		}
+	}
+	return written, nil
+}
+
+// VerifyChunkHash verifies that chunk data matches the expected hex hash,
+// comparing the raw bytes
 func VerifyChunkHash(data []byte, expectedHash string) bool {
-	actualHash := ComputeHash(data)
-	return actualHash == expectedHash
+	expected, err := hex.DecodeString(expectedHash)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ComputeHashBytes(data), expected)
 }
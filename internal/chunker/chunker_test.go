@@ -0,0 +1,37 @@
+package chunker
+
+import "testing"
+
+func TestNewChunkerBounds(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunkSize int64
+		wantErr   bool
+	}{
+		{"zero", 0, true},
+		{"negative", -1, true},
+		{"below minimum", MinChunkSize - 1, true},
+		{"minimum", MinChunkSize, false},
+		{"default", 1024 * 1024, false},
+		{"maximum", MaxChunkSize, false},
+		{"above maximum", MaxChunkSize + 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewChunker(tt.chunkSize)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NewChunker(%d) succeeded, want error", tt.chunkSize)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewChunker(%d): %v", tt.chunkSize, err)
+			}
+			if got := c.ChunkSize(); got != tt.chunkSize {
+				t.Errorf("ChunkSize() = %d, want %d", got, tt.chunkSize)
+			}
+		})
+	}
+}
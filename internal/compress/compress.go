@@ -0,0 +1,119 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/maneesh/labdropbox/internal/chunker"
+)
+
+// Chunk compression algorithms. None marks a chunk that compression was
+// tried on but didn't help; chunks written before compression existed have
+// an empty algorithm, which also means uncompressed.
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// MaxRatio is the compressed/original size ratio above which a chunk is
+// stored uncompressed, so compression never inflates stored data
+const MaxRatio = 0.95
+
+// zstd encoders and decoders are safe for concurrent EncodeAll/DecodeAll
+// and expensive to create, so one of each is shared
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil)
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(chunker.MaxChunkSize)))
+	})
+)
+
+// Validate checks that algorithm is a supported setting ("" means disabled)
+func Validate(algorithm string) error {
+	switch algorithm {
+	case "", None, Gzip, Zstd:
+		return nil
+	}
+	return fmt.Errorf("unsupported compression %q: must be %q, %q or %q", algorithm, None, Gzip, Zstd)
+}
+
+// Compress compresses data with algorithm and returns the bytes to store and
+// the algorithm they are stored with: None (and data itself) when the
+// compressed form would be larger than MaxRatio of the original, or "" when
+// compression is disabled
+func Compress(algorithm string, data []byte) ([]byte, string, error) {
+	var compressed []byte
+	switch algorithm {
+	case Gzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, "", fmt.Errorf("failed to gzip chunk: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, "", fmt.Errorf("failed to gzip chunk: %w", err)
+		}
+		compressed = buf.Bytes()
+	case Zstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		compressed = enc.EncodeAll(data, make([]byte, 0, len(data)))
+	case "", None:
+		// Not tried, so not marked None
+		return data, "", nil
+	default:
+		return nil, "", fmt.Errorf("unsupported compression %q", algorithm)
+	}
+
+	if float64(len(compressed)) > MaxRatio*float64(len(data)) {
+		return data, None, nil
+	}
+	return compressed, algorithm, nil
+}
+
+// Decompress reverses Compress for a chunk of size original bytes. Output
+// beyond size is an error, which also bounds what a corrupt chunk can inflate
+// to.
+func Decompress(algorithm string, data []byte, size int64) ([]byte, error) {
+	var out []byte
+	switch algorithm {
+	case "", None:
+		return data, nil
+	case Gzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip chunk: %w", err)
+		}
+		defer zr.Close()
+
+		buf := bytes.NewBuffer(make([]byte, 0, size))
+		if _, err := io.Copy(buf, io.LimitReader(zr, size+1)); err != nil {
+			return nil, fmt.Errorf("failed to decompress gzip chunk: %w", err)
+		}
+		out = buf.Bytes()
+	case Zstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		if out, err = dec.DecodeAll(data, make([]byte, 0, size)); err != nil {
+			return nil, fmt.Errorf("failed to decompress zstd chunk: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+
+	if int64(len(out)) != size {
+		return nil, fmt.Errorf("decompressed chunk is %d bytes, want %d", len(out), size)
+	}
+	return out, nil
+}
@@ -2,16 +2,149 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maneesh/labdropbox/internal/chunker"
+	"github.com/maneesh/labdropbox/internal/compress"
+	"github.com/maneesh/labdropbox/internal/crypto"
 )
 
 // Config holds all application configuration
 type Config struct {
 	// Service configuration
-	ServicePort  string
-	ChunkSizeMB  int
-	ServiceName  string
+	ServicePort string
+	ChunkSizeMB int
+	ServiceName string
+
+	// Exact chunk size in bytes; overrides ChunkSizeMB when non-zero
+	ChunkSizeBytes int64
+
+	// How long to keep retrying dependency connections at startup (0 tries
+	// once)
+	StartupTimeoutSec int
+
+	// Admin controls
+	AdminToken          string
+	DebugRequestLogging bool
+	ReadOnly            bool
+
+	// Log line format: "json" or "text"
+	LogFormat string
+
+	// Request validation limits
+	MaxHeaderBytes      int
+	MaxNameLength       int
+	MaxQueryParamLength int
+
+	// Soft limit on stored bytes above which writes get 507 (0 disables),
+	// and how often usage is sampled
+	StorageSoftLimitBytes    int64
+	StorageUsageSamplePeriod time.Duration
+
+	// Chunking strategy ("fixed" or "content-defined") and, for
+	// content-defined chunking, the min/average/max chunk sizes
+	ChunkingMode string
+	CDCMinBytes  int64
+	CDCAvgBytes  int64
+	CDCMaxBytes  int64
+
+	// Bounds applied to the chunk size at startup
+	ChunkSizeMinBytes int64
+	ChunkSizeMaxBytes int64
+
+	// Largest file an upload may create, in MB (0 is unlimited)
+	MaxFileSizeMB int
+
+	// Number of concurrent chunk uploads per write
+	WriteConcurrency int
+
+	// Store chunks under hash-derived keys so identical chunks are stored once
+	ContentAddressedChunks bool
+
+	// Per-chunk compression: "none", "gzip" or "zstd"
+	Compression string
+
+	// AES-256 key (hex or base64) encrypting new chunks at rest; empty disables
+	EncryptionKey string
+
+	// Chunk rows per insert transaction (0 uses a single transaction) and how many
+	// such transactions run at once
+	ChunkInsertBatchSize   int
+	ChunkInsertParallelism int
+
+	// Timeout for each chunk upload attempt to MinIO (0 disables)
+	MinIOChunkUploadTimeout time.Duration
+
+	// Age after which incomplete multipart chunk uploads are aborted (0 disables)
+	MinIOStaleUploadAge time.Duration
+
+	// Resumable upload sessions: idle time after which a session and its
+	// chunks are purged, how often purging runs (0 disables), the most
+	// chunks per session and open sessions per client (0 is unlimited)
+	UploadSessionIdleTimeout     time.Duration
+	UploadSessionCleanupInterval time.Duration
+	UploadSessionMaxChunks       int
+	UploadSessionMaxPerClient    int
+
+	// How often files without a whole-file checksum get one computed (0
+	// disables), and how many are hashed at a time
+	ChecksumBackfillInterval    time.Duration
+	ChecksumBackfillConcurrency int
+
+	// Retries for chunks missing shortly after their file was written
+	ReadAfterWriteWindowSec int
+	ReadAfterWriteRetries   int
+	ReadAfterWriteBackoffMS int
+
+	// Cache the bytes of chunks up to ChunkDataCacheMaxBytes in Redis, by
+	// hash, for ChunkDataCacheTTL
+	ChunkDataCache         bool
+	ChunkDataCacheMaxBytes int64
+	ChunkDataCacheTTL      time.Duration
+
+	// Memory budget in bytes for chunk data in flight per read
+	MaxDownloadMemory int64
+
+	// Most parallel chunk downloads per read (0 leaves it to the memory budget)
+	ReadConcurrency int
+
+	// Slowest a client may drain a download before it is aborted
+	MinDownloadRateBytesPerSec int64
+	MinDownloadRateWindowSec   int
+
+	// Retry a failed read once before anything is sent to the client
+	ReadRetryEnabled bool
+	ReadRetryDelayMS int
+
+	// Chunks prefetched ahead of the one being written on streamed reads
+	ReadAheadChunks int
+
+	// HTTP status for reads of files still being uploaded (425 or 409)
+	ReadIncompleteStatus int
+
+	// Cache new files' chunk lists in Redis on write and check them on read
+	ChunkMetadataCache bool
+
+	// Return file metadata in a 503 when a read can't load the chunk list
+	ReadDegradedMetadata bool
+
+	// Serve generically typed files as the content type sniffed from their data
+	ReadSniffContentType bool
+
+	// Gzip uncompressed downloads of at least ReadGzipMinSize bytes for
+	// clients that accept gzip
+	ReadGzip        bool
+	ReadGzipMinSize int64
+
+	// Largest file in bytes whose concurrent reads share one chunk fetch
+	ReadCoalesceMaxBytes int64
+
+	// How long the "recent files" feed is cached in Redis
+	RecentFilesCacheTTLSec int
 
 	// MinIO configuration
 	MinIOEndpoint   string
@@ -20,6 +153,41 @@ type Config struct {
 	MinIOBucketName string
 	MinIOUseSSL     bool
 
+	// Write and delete a canary object at startup
+	StartupWriteCheck bool
+
+	// Secret for HMAC-obfuscated chunk object keys (empty keeps plain keys)
+	MinIOKeySecret string
+
+	// MinIO object lock (WORM) configuration
+	MinIOObjectLocking bool
+	MinIORetentionMode string
+	MinIORetentionDays int
+
+	// MinIO circuit breaker configuration
+	MinIOBreakerFailures int
+	MinIOBreakerOpenSec  int
+
+	// Retries for transient chunk upload/download failures, with
+	// exponential backoff from MinIORetryBaseMS
+	MinIOMaxRetries  int
+	MinIORetryBaseMS int
+
+	// Per-operation timeouts in milliseconds for MinIO calls (per attempt),
+	// TiDB client methods and Redis commands (0 disables)
+	MinIOOpTimeoutMS int
+	TiDBOpTimeoutMS  int
+	RedisOpTimeoutMS int
+
+	// Shadow reads against a secondary store, for validating a migration
+	ShadowReadEnabled     bool
+	ShadowReadMaxInFlight int
+	ShadowMinIOEndpoint   string
+	ShadowMinIOAccessKey  string
+	ShadowMinIOSecretKey  string
+	ShadowMinIOBucketName string
+	ShadowMinIOUseSSL     bool
+
 	// TiDB configuration
 	TiDBHost     string
 	TiDBPort     string
@@ -27,23 +195,130 @@ type Config struct {
 	TiDBPassword string
 	TiDBDatabase string
 
+	// Store chunk hashes as BINARY(32) instead of hex
+	TiDBBinaryHashes bool
+
+	// Connection pool: open connections (0 is unlimited), idle connections
+	// kept, and connection lifetime in seconds (0 is forever)
+	TiDBMaxOpenConns       int
+	TiDBMaxIdleConns       int
+	TiDBConnMaxLifetimeSec int
+
+	// Optional connection parameters appended to the DSN (zero values are
+	// left to the driver's defaults)
+	TiDBCompress     bool
+	TiDBCollation    string
+	TiDBTimeout      time.Duration
+	TiDBReadTimeout  time.Duration
+	TiDBWriteTimeout time.Duration
+	TiDBTLS          string
+
 	// Redis configuration
 	RedisHost     string
 	RedisPort     string
 	RedisPassword string
 	RedisDB       int
 
+	// Lifetime of cached file metadata and chunk lists (0 never expires)
+	CacheTTLSec int
+
 	// Jaeger configuration
 	JaegerEndpoint string
+
+	// Comma-separated trace context formats accepted and sent
+	TracePropagators string
+
+	// Trace sampler: "always_on", "always_off" or "traceidratio" (sampling
+	// TraceSampleRatio of traces), honoring the parent span's decision
+	TraceSampler     string
+	TraceSampleRatio float64
+
+	// Metrics exporter: "none", "otlp" (to JaegerEndpoint's OTLP collector),
+	// "prometheus" (scraped from /metrics) or "both"
+	MetricsExporter string
 }
 
 // LoadConfig loads configuration from environment variables with sensible defaults
 func LoadConfig() (*Config, error) {
 	config := &Config{
 		// Service defaults
-		ServicePort:  getEnv("SERVICE_PORT", "8080"),
-		ChunkSizeMB:  getEnvAsInt("CHUNK_SIZE_MB", 1),
-		ServiceName:  getEnv("SERVICE_NAME", "labdropbox-service"),
+		ServicePort: getEnv("SERVICE_PORT", "8080"),
+		ChunkSizeMB: getEnvAsInt("CHUNK_SIZE_MB", 1),
+		ServiceName: getEnv("SERVICE_NAME", "labdropbox-service"),
+
+		StartupTimeoutSec: getEnvAsInt("STARTUP_TIMEOUT_SEC", 60),
+
+		AdminToken:          getEnv("ADMIN_TOKEN", ""),
+		DebugRequestLogging: getEnvAsBool("DEBUG_REQUEST_LOGGING", false),
+		ReadOnly:            getEnvAsBool("READ_ONLY", false),
+
+		LogFormat: getEnv("LOG_FORMAT", "json"),
+
+		MaxHeaderBytes:      getEnvAsInt("MAX_HEADER_BYTES", 1<<20),
+		MaxNameLength:       getEnvAsInt("MAX_NAME_LENGTH", 255),
+		MaxQueryParamLength: getEnvAsInt("MAX_QUERY_PARAM_LENGTH", 1024),
+
+		StorageUsageSamplePeriod: getEnvAsDuration("STORAGE_USAGE_SAMPLE_INTERVAL", time.Minute),
+
+		ChunkingMode: getEnv("CHUNKING_MODE", chunker.StrategyFixed),
+
+		ChunkSizeMinBytes: getEnvAsInt64("CHUNK_SIZE_MIN_BYTES", chunker.MinChunkSize),
+		ChunkSizeMaxBytes: getEnvAsInt64("CHUNK_SIZE_MAX_BYTES", chunker.MaxChunkSize),
+
+		MaxFileSizeMB: getEnvAsInt("MAX_FILE_SIZE_MB", 0),
+
+		WriteConcurrency: getEnvAsInt("WRITE_CONCURRENCY", 4),
+
+		ContentAddressedChunks: getEnvAsBool("CONTENT_ADDRESSED_CHUNKS", false),
+
+		Compression:   getEnv("COMPRESSION", compress.None),
+		EncryptionKey: getEnv("ENCRYPTION_KEY", ""),
+
+		ChunkInsertBatchSize:   getEnvAsInt("TIDB_CHUNK_INSERT_BATCH_SIZE", 0),
+		ChunkInsertParallelism: getEnvAsInt("TIDB_CHUNK_INSERT_PARALLELISM", 4),
+
+		MinIOChunkUploadTimeout: getEnvAsDuration("MINIO_CHUNK_UPLOAD_TIMEOUT", 0),
+		MinIOStaleUploadAge:     getEnvAsDuration("MINIO_STALE_UPLOAD_AGE", 24*time.Hour),
+
+		UploadSessionIdleTimeout:     getEnvAsDuration("UPLOAD_SESSION_IDLE_TIMEOUT", 24*time.Hour),
+		UploadSessionCleanupInterval: getEnvAsDuration("UPLOAD_SESSION_CLEANUP_INTERVAL", 10*time.Minute),
+		UploadSessionMaxChunks:       getEnvAsInt("UPLOAD_SESSION_MAX_CHUNKS", 10000),
+		UploadSessionMaxPerClient:    getEnvAsInt("UPLOAD_SESSION_MAX_PER_CLIENT", 10),
+
+		ChecksumBackfillInterval:    getEnvAsDuration("CHECKSUM_BACKFILL_INTERVAL", 0),
+		ChecksumBackfillConcurrency: getEnvAsInt("CHECKSUM_BACKFILL_CONCURRENCY", 2),
+
+		ReadAfterWriteWindowSec: getEnvAsInt("READ_AFTER_WRITE_WINDOW_SEC", 10),
+		ReadAfterWriteRetries:   getEnvAsInt("READ_AFTER_WRITE_RETRIES", 3),
+		ReadAfterWriteBackoffMS: getEnvAsInt("READ_AFTER_WRITE_BACKOFF_MS", 100),
+
+		MaxDownloadMemory: getEnvAsInt64("MAX_DOWNLOAD_MEMORY", 64*1024*1024),
+		ReadConcurrency:   getEnvAsInt("READ_CONCURRENCY", 16),
+
+		ChunkDataCache:         getEnvAsBool("CHUNK_DATA_CACHE", false),
+		ChunkDataCacheMaxBytes: getEnvAsInt64("CHUNK_DATA_CACHE_MAX_BYTES", 1024*1024),
+		ChunkDataCacheTTL:      getEnvAsDuration("CHUNK_DATA_CACHE_TTL", 10*time.Minute),
+
+		MinDownloadRateBytesPerSec: getEnvAsInt64("MIN_DOWNLOAD_RATE_BYTES_PER_SEC", 0),
+		MinDownloadRateWindowSec:   getEnvAsInt("MIN_DOWNLOAD_RATE_WINDOW_SEC", 10),
+
+		ReadRetryEnabled: getEnvAsBool("READ_RETRY_ENABLED", false),
+		ReadRetryDelayMS: getEnvAsInt("READ_RETRY_DELAY_MS", 200),
+
+		ReadAheadChunks: getEnvAsInt("READ_AHEAD_CHUNKS", 4),
+
+		ReadIncompleteStatus: getEnvAsInt("READ_INCOMPLETE_STATUS", 425),
+
+		ReadSniffContentType: getEnvAsBool("READ_SNIFF_CONTENT_TYPE", false),
+		ReadDegradedMetadata: getEnvAsBool("READ_DEGRADED_METADATA", false),
+		ChunkMetadataCache:   getEnvAsBool("CHUNK_METADATA_CACHE", false),
+
+		ReadCoalesceMaxBytes: getEnvAsInt64("READ_COALESCE_MAX_BYTES", 0),
+
+		ReadGzip:        getEnvAsBool("READ_GZIP", false),
+		ReadGzipMinSize: getEnvAsInt64("READ_GZIP_MIN_SIZE", 1024),
+
+		RecentFilesCacheTTLSec: getEnvAsInt("RECENT_FILES_CACHE_TTL_SEC", 10),
 
 		// MinIO defaults
 		MinIOEndpoint:   getEnv("MINIO_ENDPOINT", "localhost:9000"),
@@ -51,6 +326,31 @@ func LoadConfig() (*Config, error) {
 		MinIOSecretKey:  getEnv("MINIO_SECRET_KEY", "minioadmin"),
 		MinIOBucketName: getEnv("MINIO_BUCKET_NAME", "labdropbox"),
 		MinIOUseSSL:     getEnvAsBool("MINIO_USE_SSL", false),
+		MinIOKeySecret:  getEnv("MINIO_KEY_SECRET", ""),
+
+		StartupWriteCheck: getEnvAsBool("STARTUP_WRITE_CHECK", false),
+
+		MinIOObjectLocking: getEnvAsBool("MINIO_OBJECT_LOCKING", false),
+		MinIORetentionMode: getEnv("MINIO_RETENTION_MODE", ""),
+		MinIORetentionDays: getEnvAsInt("MINIO_RETENTION_DAYS", 0),
+
+		MinIOBreakerFailures: getEnvAsInt("MINIO_BREAKER_FAILURES", 5),
+		MinIOBreakerOpenSec:  getEnvAsInt("MINIO_BREAKER_OPEN_SEC", 30),
+
+		MinIOMaxRetries:  getEnvAsInt("MINIO_MAX_RETRIES", 3),
+		MinIORetryBaseMS: getEnvAsInt("MINIO_RETRY_BASE_MS", 100),
+
+		MinIOOpTimeoutMS: getEnvAsInt("MINIO_OP_TIMEOUT_MS", 0),
+		TiDBOpTimeoutMS:  getEnvAsInt("TIDB_OP_TIMEOUT_MS", 0),
+		RedisOpTimeoutMS: getEnvAsInt("REDIS_OP_TIMEOUT_MS", 0),
+
+		ShadowReadEnabled:     getEnvAsBool("SHADOW_READ_ENABLED", false),
+		ShadowReadMaxInFlight: getEnvAsInt("SHADOW_READ_MAX_IN_FLIGHT", 16),
+		ShadowMinIOEndpoint:   getEnv("SHADOW_MINIO_ENDPOINT", ""),
+		ShadowMinIOAccessKey:  getEnv("SHADOW_MINIO_ACCESS_KEY", ""),
+		ShadowMinIOSecretKey:  getEnv("SHADOW_MINIO_SECRET_KEY", ""),
+		ShadowMinIOBucketName: getEnv("SHADOW_MINIO_BUCKET_NAME", ""),
+		ShadowMinIOUseSSL:     getEnvAsBool("SHADOW_MINIO_USE_SSL", false),
 
 		// TiDB defaults
 		TiDBHost:     getEnv("TIDB_HOST", "localhost"),
@@ -59,27 +359,249 @@ func LoadConfig() (*Config, error) {
 		TiDBPassword: getEnv("TIDB_PASSWORD", ""),
 		TiDBDatabase: getEnv("TIDB_DATABASE", "labdropbox"),
 
+		TiDBBinaryHashes: getEnvAsBool("TIDB_BINARY_HASHES", false),
+
+		TiDBMaxOpenConns:       getEnvAsInt("TIDB_MAX_OPEN_CONNS", 25),
+		TiDBMaxIdleConns:       getEnvAsInt("TIDB_MAX_IDLE_CONNS", 5),
+		TiDBConnMaxLifetimeSec: getEnvAsInt("TIDB_CONN_MAX_LIFETIME_SEC", 0),
+
+		TiDBCompress:     getEnvAsBool("TIDB_COMPRESS", false),
+		TiDBCollation:    getEnv("TIDB_COLLATION", ""),
+		TiDBTimeout:      getEnvAsDuration("TIDB_TIMEOUT", 0),
+		TiDBReadTimeout:  getEnvAsDuration("TIDB_READ_TIMEOUT", 0),
+		TiDBWriteTimeout: getEnvAsDuration("TIDB_WRITE_TIMEOUT", 0),
+		TiDBTLS:          getEnv("TIDB_TLS", ""),
+
 		// Redis defaults
 		RedisHost:     getEnv("REDIS_HOST", "localhost"),
 		RedisPort:     getEnv("REDIS_PORT", "6379"),
 		RedisPassword: getEnv("REDIS_PASSWORD", ""),
 		RedisDB:       getEnvAsInt("REDIS_DB", 0),
+		CacheTTLSec:   getEnvAsInt("CACHE_TTL_SEC", 300),
 
 		// Jaeger defaults
 		JaegerEndpoint: getEnv("JAEGER_ENDPOINT", "http://localhost:4318"),
+
+		TracePropagators: getEnv("TRACE_PROPAGATORS", "tracecontext,baggage"),
+		TraceSampler:     getEnv("TRACE_SAMPLER", "always_on"),
+		TraceSampleRatio: getEnvAsFloat("TRACE_SAMPLE_RATIO", 1),
+
+		MetricsExporter: getEnv("METRICS_EXPORTER", "none"),
+	}
+
+	if raw := getEnv("CHUNK_SIZE_BYTES", ""); raw != "" {
+		size, err := parseByteSize(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CHUNK_SIZE_BYTES: %w", err)
+		}
+		config.ChunkSizeBytes = size
+	}
+
+	for _, size := range []struct {
+		env  string
+		dest *int64
+	}{
+		{"CDC_MIN_SIZE", &config.CDCMinBytes},
+		{"CDC_AVG_SIZE", &config.CDCAvgBytes},
+		{"CDC_MAX_SIZE", &config.CDCMaxBytes},
+	} {
+		if raw := getEnv(size.env, ""); raw != "" {
+			n, err := parseByteSize(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", size.env, err)
+			}
+			*size.dest = n
+		}
+	}
+
+	if raw := getEnv("STORAGE_SOFT_LIMIT", ""); raw != "" {
+		size, err := parseByteSize(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid STORAGE_SOFT_LIMIT: %w", err)
+		}
+		config.StorageSoftLimitBytes = size
+	}
+	if config.StorageUsageSamplePeriod <= 0 {
+		return nil, fmt.Errorf("STORAGE_USAGE_SAMPLE_INTERVAL must be positive")
+	}
+
+	if err := config.validateChunkSize(); err != nil {
+		return nil, err
+	}
+	if _, err := config.NewChunker(); err != nil {
+		return nil, err
+	}
+	if _, err := config.NewCipher(); err != nil {
+		return nil, err
+	}
+	if err := compress.Validate(config.Compression); err != nil {
+		return nil, fmt.Errorf("invalid COMPRESSION: %w", err)
+	}
+
+	if config.MinIOMaxRetries < 0 || config.MinIORetryBaseMS < 0 {
+		return nil, fmt.Errorf("MINIO_MAX_RETRIES and MINIO_RETRY_BASE_MS must not be negative")
+	}
+
+	if config.MinIOOpTimeoutMS < 0 || config.TiDBOpTimeoutMS < 0 || config.RedisOpTimeoutMS < 0 {
+		return nil, fmt.Errorf("MINIO_OP_TIMEOUT_MS, TIDB_OP_TIMEOUT_MS and REDIS_OP_TIMEOUT_MS must not be negative")
+	}
+
+	if config.CacheTTLSec < 0 {
+		return nil, fmt.Errorf("CACHE_TTL_SEC must not be negative")
+	}
+
+	if config.StartupTimeoutSec < 0 {
+		return nil, fmt.Errorf("STARTUP_TIMEOUT_SEC must not be negative")
+	}
+
+	if config.ReadConcurrency < 0 {
+		return nil, fmt.Errorf("READ_CONCURRENCY must not be negative")
+	}
+
+	if config.MaxFileSizeMB < 0 {
+		return nil, fmt.Errorf("MAX_FILE_SIZE_MB must not be negative")
+	}
+
+	if config.ChunkDataCache && config.ChunkDataCacheTTL <= 0 {
+		return nil, fmt.Errorf("CHUNK_DATA_CACHE_TTL must be positive when CHUNK_DATA_CACHE is enabled")
+	}
+
+	if config.UploadSessionIdleTimeout <= 0 {
+		return nil, fmt.Errorf("UPLOAD_SESSION_IDLE_TIMEOUT must be positive")
+	}
+	if config.UploadSessionMaxChunks < 1 || config.UploadSessionMaxPerClient < 0 {
+		return nil, fmt.Errorf("UPLOAD_SESSION_MAX_CHUNKS must be positive and UPLOAD_SESSION_MAX_PER_CLIENT must not be negative")
+	}
+
+	if config.ChecksumBackfillInterval < 0 || config.ChecksumBackfillConcurrency < 1 {
+		return nil, fmt.Errorf("CHECKSUM_BACKFILL_INTERVAL must not be negative and CHECKSUM_BACKFILL_CONCURRENCY must be positive")
+	}
+
+	if config.TiDBMaxOpenConns < 0 || config.TiDBMaxIdleConns < 0 || config.TiDBConnMaxLifetimeSec < 0 {
+		return nil, fmt.Errorf("TIDB_MAX_OPEN_CONNS, TIDB_MAX_IDLE_CONNS and TIDB_CONN_MAX_LIFETIME_SEC must not be negative")
+	}
+
+	if config.LogFormat != "json" && config.LogFormat != "text" {
+		return nil, fmt.Errorf("LOG_FORMAT must be json or text, got %q", config.LogFormat)
+	}
+
+	if config.ReadIncompleteStatus != 425 && config.ReadIncompleteStatus != 409 {
+		return nil, fmt.Errorf("READ_INCOMPLETE_STATUS must be 425 or 409, got %d", config.ReadIncompleteStatus)
+	}
+
+	switch config.TraceSampler {
+	case "always_on", "always_off", "traceidratio":
+	default:
+		return nil, fmt.Errorf("TRACE_SAMPLER must be \"always_on\", \"always_off\" or \"traceidratio\", got %q", config.TraceSampler)
+	}
+	if config.TraceSampleRatio < 0 || config.TraceSampleRatio > 1 {
+		return nil, fmt.Errorf("TRACE_SAMPLE_RATIO must be between 0 and 1, got %g", config.TraceSampleRatio)
+	}
+
+	switch config.MetricsExporter {
+	case "none", "otlp", "prometheus", "both":
+	default:
+		return nil, fmt.Errorf("METRICS_EXPORTER must be \"none\", \"otlp\", \"prometheus\" or \"both\", got %q", config.MetricsExporter)
+	}
+
+	if config.ShadowReadEnabled && (config.ShadowMinIOEndpoint == "" || config.ShadowMinIOBucketName == "") {
+		return nil, fmt.Errorf("SHADOW_READ_ENABLED requires SHADOW_MINIO_ENDPOINT and SHADOW_MINIO_BUCKET_NAME")
 	}
 
 	return config, nil
 }
 
+// validateChunkSize rejects chunk sizes outside the configured bounds so a
+// misconfiguration fails at startup instead of on the first upload
+func (c *Config) validateChunkSize() error {
+	size := c.GetChunkSizeBytes()
+	if size <= 0 {
+		return fmt.Errorf("chunk size must be positive, got %d bytes", size)
+	}
+	if size < c.ChunkSizeMinBytes || size > c.ChunkSizeMaxBytes {
+		return fmt.Errorf("chunk size %d bytes is outside the allowed range [%d, %d]",
+			size, c.ChunkSizeMinBytes, c.ChunkSizeMaxBytes)
+	}
+	return nil
+}
+
+// NewChunker constructs the chunker selected by CHUNKING_MODE. Unset
+// content-defined sizes default to a quarter, one and four times the chunk
+// size (capped at chunker.MaxChunkSize).
+func (c *Config) NewChunker() (chunker.Splitter, error) {
+	switch c.ChunkingMode {
+	case chunker.StrategyFixed:
+		fixed, err := chunker.NewChunker(c.GetChunkSizeBytes())
+		if err != nil {
+			return nil, err
+		}
+		return fixed, nil
+	case chunker.StrategyContentDefined:
+		avg := c.CDCAvgBytes
+		if avg == 0 {
+			avg = c.GetChunkSizeBytes()
+		}
+		minSize := c.CDCMinBytes
+		if minSize == 0 {
+			minSize = max(avg/4, chunker.MinChunkSize)
+		}
+		maxSize := c.CDCMaxBytes
+		if maxSize == 0 {
+			maxSize = min(avg*4, chunker.MaxChunkSize)
+		}
+		cdc, err := chunker.NewContentDefinedChunker(minSize, avg, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		return cdc, nil
+	default:
+		return nil, fmt.Errorf("CHUNKING_MODE must be %q or %q, got %q",
+			chunker.StrategyFixed, chunker.StrategyContentDefined, c.ChunkingMode)
+	}
+}
+
+// NewCipher returns the chunk cipher for ENCRYPTION_KEY, or nil if it is unset
+func (c *Config) NewCipher() (*crypto.Cipher, error) {
+	if c.EncryptionKey == "" {
+		return nil, nil
+	}
+
+	key, err := crypto.ParseKey(c.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ENCRYPTION_KEY: %w", err)
+	}
+	return crypto.NewCipher(key)
+}
+
 // GetDSN returns the TiDB connection string
 func (c *Config) GetDSN() string {
-	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+	params := []string{"charset=utf8mb4", "parseTime=True", "loc=Local"}
+	if c.TiDBCompress {
+		params = append(params, "compress=true")
+	}
+	if c.TiDBCollation != "" {
+		params = append(params, "collation="+url.QueryEscape(c.TiDBCollation))
+	}
+	if c.TiDBTimeout > 0 {
+		params = append(params, "timeout="+c.TiDBTimeout.String())
+	}
+	if c.TiDBReadTimeout > 0 {
+		params = append(params, "readTimeout="+c.TiDBReadTimeout.String())
+	}
+	if c.TiDBWriteTimeout > 0 {
+		params = append(params, "writeTimeout="+c.TiDBWriteTimeout.String())
+	}
+	if c.TiDBTLS != "" {
+		params = append(params, "tls="+url.QueryEscape(c.TiDBTLS))
+	}
+
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?%s",
 		c.TiDBUser,
 		c.TiDBPassword,
 		c.TiDBHost,
 		c.TiDBPort,
 		c.TiDBDatabase,
+		strings.Join(params, "&"),
 	)
 }
 
@@ -90,9 +612,44 @@ func (c *Config) GetRedisAddr() string {
 
 // GetChunkSizeBytes returns chunk size in bytes
 func (c *Config) GetChunkSizeBytes() int64 {
+	if c.ChunkSizeBytes > 0 {
+		return c.ChunkSizeBytes
+	}
 	return int64(c.ChunkSizeMB) * 1024 * 1024
 }
 
+// byteUnits are the suffixes accepted by parseByteSize, longest first so
+// "KB" is tried before "B"
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"GB", 1024 * 1024 * 1024},
+	{"MB", 1024 * 1024},
+	{"KB", 1024},
+	{"B", 1},
+}
+
+// parseByteSize parses a size such as "524288", "512KB" or "1536kb" into
+// bytes. Units are binary (1KB = 1024 bytes) and case-insensitive.
+func parseByteSize(raw string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("%q is not a positive size", raw)
+	}
+	return value * multiplier, nil
+}
+
 // Helper functions
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -109,6 +666,30 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvAsInt64(key string, defaultValue int64) int64 {
+	valueStr := getEnv(key, "")
+	if value, err := strconv.ParseInt(valueStr, 10, 64); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	valueStr := getEnv(key, "")
+	if value, err := strconv.ParseFloat(valueStr, 64); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := getEnv(key, "")
+	if value, err := time.ParseDuration(valueStr); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
 func getEnvAsBool(key string, defaultValue bool) bool {
 	valueStr := getEnv(key, "")
 	if value, err := strconv.ParseBool(valueStr); err == nil {
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/maneesh/labdropbox/internal/chunker"
+)
+
+func TestLoadConfigChunkSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"default", nil, false},
+		{"below 4KB", map[string]string{"CHUNK_SIZE_BYTES": strconv.FormatInt(chunker.MinChunkSize-1, 10)}, true},
+		{"4KB", map[string]string{"CHUNK_SIZE_BYTES": "4KB"}, false},
+		{"64MB", map[string]string{"CHUNK_SIZE_MB": "64"}, false},
+		{"above 64MB", map[string]string{"CHUNK_SIZE_BYTES": strconv.FormatInt(chunker.MaxChunkSize+1, 10)}, true},
+		{"zero", map[string]string{"CHUNK_SIZE_MB": "0"}, true},
+
+		// CHUNK_SIZE_MIN_BYTES and CHUNK_SIZE_MAX_BYTES narrow the range
+		{"below tightened minimum", map[string]string{"CHUNK_SIZE_BYTES": "64KB", "CHUNK_SIZE_MIN_BYTES": "131072"}, true},
+		{"tightened minimum", map[string]string{"CHUNK_SIZE_BYTES": "128KB", "CHUNK_SIZE_MIN_BYTES": "131072"}, false},
+		{"tightened maximum", map[string]string{"CHUNK_SIZE_MB": "8", "CHUNK_SIZE_MAX_BYTES": "8388608"}, false},
+		{"above tightened maximum", map[string]string{"CHUNK_SIZE_MB": "16", "CHUNK_SIZE_MAX_BYTES": "8388608"}, true},
+
+		// They can't widen it past what the chunker supports
+		{"below widened minimum", map[string]string{"CHUNK_SIZE_BYTES": "2KB", "CHUNK_SIZE_MIN_BYTES": "1024"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := LoadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("LoadConfig succeeded with chunk size %d, want error", cfg.GetChunkSizeBytes())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+		})
+	}
+}
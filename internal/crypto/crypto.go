@@ -0,0 +1,87 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// KeySize is the length of an AES-256 key in bytes
+const KeySize = 32
+
+// Algorithm names the scheme, recorded on files whose chunks are encrypted
+const Algorithm = "aes-256-gcm"
+
+// ErrCiphertextTooShort is returned when decrypting data shorter than a
+// nonce plus authentication tag
+var ErrCiphertextTooShort = errors.New("ciphertext too short")
+
+// Cipher encrypts and decrypts chunks with a single AES-256-GCM key. It is
+// safe for concurrent use.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher creates a cipher from a 32-byte key
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// ParseKey decodes a key given as 64 hex characters or standard base64
+func ParseKey(encoded string) ([]byte, error) {
+	if len(encoded) == hex.EncodedLen(KeySize) {
+		if key, err := hex.DecodeString(encoded); err == nil {
+			return key, nil
+		}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key must be %d bytes as hex or base64", KeySize)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// Encrypt seals plaintext under a fresh random nonce, which is prepended to
+// the returned ciphertext
+func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens data produced by Encrypt, failing if it was modified or
+// sealed under a different key
+func (c *Cipher) Decrypt(data []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(data) < nonceSize+c.aead.Overhead() {
+		return nil, ErrCiphertextTooShort
+	}
+
+	plaintext, err := c.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
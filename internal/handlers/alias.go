@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/models"
+	"github.com/maneesh/labdropbox/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	// generatedAliasLength gives 62^8 (~2e14) possible random aliases
+	generatedAliasLength = 8
+	// aliasAttempts is how many random aliases are tried before giving up
+	aliasAttempts = 3
+)
+
+// validAlias is the format accepted for user-chosen aliases
+var validAlias = regexp.MustCompile(`^[A-Za-z0-9_-]{3,64}$`)
+
+// AliasResponse is the body returned when an alias is created
+type AliasResponse struct {
+	*models.Alias
+	URL string `json:"url"`
+}
+
+// AliasHandler creates short aliases for files and serves files by alias
+type AliasHandler struct {
+	readHandler *ReadHandler
+}
+
+// NewAliasHandler creates a new alias handler that serves resolved aliases
+// through the read handler
+func NewAliasHandler(readHandler *ReadHandler) *AliasHandler {
+	return &AliasHandler{
+		readHandler: readHandler,
+	}
+}
+
+// Create handles POST /files/{file_id}/alias[?alias=name][&expires_in=24h]
+func (ah *AliasHandler) Create(w http.ResponseWriter, r *http.Request) {
+	tidb := ah.readHandler.tidbClient
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "create_alias",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	fileID := mux.Vars(r)["file_id"]
+	span.SetAttributes(attribute.String("file_id", fileID))
+
+	requested := r.URL.Query().Get("alias")
+	if requested != "" && !validAlias.MatchString(requested) {
+		http.Error(w, "'alias' must be 3-64 letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
+
+	alias := &models.Alias{
+		FileID:    fileID,
+		CreatedAt: time.Now(),
+	}
+	if raw := r.URL.Query().Get("expires_in"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "'expires_in' must be a positive duration such as 24h", http.StatusBadRequest)
+			return
+		}
+		expiresAt := alias.CreatedAt.Add(ttl)
+		alias.ExpiresAt = &expiresAt
+	}
+
+	if _, err := tidb.GetFile(ctx, fileID); err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to get file metadata: %v", err), errorStatus(err))
+		return
+	}
+
+	var err error
+	if requested != "" {
+		alias.Alias = requested
+		err = tidb.CreateAlias(ctx, alias)
+	} else {
+		// Retry the rare collision with a fresh random alias
+		for attempt := 0; attempt < aliasAttempts; attempt++ {
+			if alias.Alias, err = randomAlias(); err != nil {
+				break
+			}
+			if err = tidb.CreateAlias(ctx, alias); !errors.Is(err, storage.ErrAliasExists) {
+				break
+			}
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to create alias: %v", err), errorStatus(err))
+		return
+	}
+
+	span.SetAttributes(attribute.String("alias", alias.Alias))
+	logging.FromContext(ctx).Info("created alias", "alias", alias.Alias)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(AliasResponse{Alias: alias, URL: "/a/" + alias.Alias})
+}
+
+// Resolve handles GET /a/{alias} by serving the aliased file like a read
+func (ah *AliasHandler) Resolve(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "resolve_alias",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	name := mux.Vars(r)["alias"]
+	span.SetAttributes(attribute.String("alias", name))
+
+	alias, err := ah.readHandler.tidbClient.GetAlias(ctx, name)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to resolve alias: %v", err), errorStatus(err))
+		return
+	}
+	span.SetAttributes(attribute.String("file_id", alias.FileID))
+
+	r = mux.SetURLVars(r.WithContext(ctx), map[string]string{"file_id": alias.FileID})
+	ah.readHandler.ServeHTTP(w, r)
+}
+
+// randomAlias returns a random base62 alias
+func randomAlias() (string, error) {
+	alias := make([]byte, generatedAliasLength)
+	alphabetSize := big.NewInt(int64(len(base62Alphabet)))
+	for i := range alias {
+		n, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate alias: %w", err)
+		}
+		alias[i] = base62Alphabet[n.Int64()]
+	}
+	return string(alias), nil
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/metrics"
+	"github.com/maneesh/labdropbox/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AppendHandler appends data to an existing file without rewriting its chunks
+type AppendHandler struct {
+	writeHandler *WriteHandler
+}
+
+// NewAppendHandler creates a new append handler that reuses the write
+// handler's upload pipeline
+func NewAppendHandler(writeHandler *WriteHandler) *AppendHandler {
+	return &AppendHandler{
+		writeHandler: writeHandler,
+	}
+}
+
+// ServeHTTP handles PUT /files/{file_id}/append
+func (ah *AppendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer metrics.StartWrite()()
+
+	wh := ah.writeHandler
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "append_file",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	fileID := mux.Vars(r)["file_id"]
+	span.SetAttributes(attribute.String("file_id", fileID))
+
+	// Read the current state straight from TiDB; the cache may be stale
+	file, err := wh.tidbClient.GetFile(ctx, fileID)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to get file metadata: %v", err), errorStatus(err))
+		return
+	}
+
+	// Concatenated gzip members form a valid gzip stream, but mixing
+	// encodings within one file would corrupt it
+	encoding, err := requestEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if encoding != file.ContentEncoding() {
+		http.Error(w, fmt.Sprintf("appended data must have the file's Content-Encoding %q, got %q",
+			file.ContentEncoding(), encoding), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("previous_size", file.Size),
+		attribute.Int("previous_chunk_count", file.ChunkCount),
+	)
+
+	// Only the appended bytes are chunked, numbered after the existing chunks
+	logging.FromContext(ctx).Info("appending to file", "file_name", file.Name, "after_chunk", file.ChunkCount)
+	// New chunks inherit the file's retention so the whole file stays locked
+	var retention *storage.Retention
+	if file.RetentionMode != "" && file.RetainUntil != nil {
+		retention = &storage.Retention{Mode: file.RetentionMode, RetainUntil: *file.RetainUntil}
+	}
+
+	// Appended chunks are stored the same way as the file's existing ones
+	encrypt := file.Encryption() != ""
+	if encrypt && wh.opts.Cipher == nil {
+		span.RecordError(errNoEncryptionKey)
+		http.Error(w, errNoEncryptionKey.Error(), errorStatus(errNoEncryptionKey))
+		return
+	}
+
+	target := uploadTarget{
+		fileID:     fileID,
+		startIndex: file.ChunkCount,
+		retention:  retention,
+		encrypt:    encrypt,
+		uniqueKeys: true,
+	}
+	chunkModels, appendedSize, err := wh.uploadPipeline(ctx, target, wh.limitBody(w, r.Body, file.Size))
+	if err != nil {
+		span.RecordError(err)
+		recordSizeLimit(span, err)
+		http.Error(w, fmt.Sprintf("failed to upload appended data: %v", err), errorStatus(err))
+		return
+	}
+
+	if len(chunkModels) == 0 {
+		http.Error(w, "nothing to append: request body is empty", http.StatusBadRequest)
+		return
+	}
+
+	updated, err := wh.tidbClient.AppendChunks(ctx, fileID, file.ChunkCount, chunkModels)
+	if err != nil {
+		span.RecordError(err)
+		wh.deleteChunks(ctx, target, chunkModels)
+		http.Error(w, fmt.Sprintf("failed to append: %v", err), errorStatus(err))
+		return
+	}
+	wh.releaseChunks(ctx, target, chunkModels)
+
+	if err := wh.invalidateCache(ctx, fileID); err != nil {
+		logging.FromContext(ctx).Warn("failed to invalidate cache", "error", err)
+	}
+
+	span.SetAttributes(
+		attribute.Int64("appended_size", appendedSize),
+		attribute.Int64("file_size", updated.Size),
+		attribute.Int("chunk_count", updated.ChunkCount),
+	)
+
+	response := WriteResponse{
+		FileID:     updated.ID,
+		FileName:   updated.Name,
+		FileSize:   updated.Size,
+		ChunkCount: updated.ChunkCount,
+		Message:    "File appended successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+
+	metrics.RecordFileAppend(ctx, appendedSize)
+	logging.FromContext(ctx).Info("file append completed", "file_name", updated.Name, "appended_bytes", appendedSize)
+}
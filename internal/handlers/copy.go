@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/models"
+	"github.com/maneesh/labdropbox/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+)
+
+// CopyHandler duplicates an existing file under a new ID. With content
+// addressing, copies share the source's objects instead of copying them.
+type CopyHandler struct {
+	minioClient      *storage.MinioClient
+	tidbClient       *storage.TiDBClient
+	copyConcurrency  int
+	contentAddressed bool
+}
+
+// NewCopyHandler creates a new copy handler
+func NewCopyHandler(
+	minioClient *storage.MinioClient,
+	tidbClient *storage.TiDBClient,
+	copyConcurrency int,
+	contentAddressed bool,
+) *CopyHandler {
+	if copyConcurrency < 1 {
+		copyConcurrency = 1
+	}
+
+	return &CopyHandler{
+		minioClient:      minioClient,
+		tidbClient:       tidbClient,
+		copyConcurrency:  copyConcurrency,
+		contentAddressed: contentAddressed,
+	}
+}
+
+// ServeHTTP handles POST /files/{file_id}/copy[?name=newname]
+func (ch *CopyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "copy_file",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	srcID := mux.Vars(r)["file_id"]
+	span.SetAttributes(attribute.String("src_file_id", srcID))
+
+	srcFile, err := ch.tidbClient.GetFile(ctx, srcID)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to get file metadata: %v", err), errorStatus(err))
+		return
+	}
+	if srcFile.Status == models.FileStatusPending {
+		http.Error(w, storage.ErrFileIncomplete.Error(), http.StatusConflict)
+		return
+	}
+
+	srcChunks, err := ch.tidbClient.GetChunks(ctx, srcID)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to get chunks: %v", err), errorStatus(err))
+		return
+	}
+
+	name := srcFile.Name
+	if requested := r.URL.Query().Get("name"); requested != "" {
+		if name, err = fileName(requested); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+
+	dstFile := &models.File{
+		ID:         uuid.New().String(),
+		Name:       name,
+		Size:       srcFile.Size,
+		ChunkCount: srcFile.ChunkCount,
+		CreatedAt:  time.Now(),
+
+		// The copy shares the source's chunk layout
+		ChunkingStrategy: srcFile.ChunkingStrategy,
+		TargetChunkSize:  srcFile.TargetChunkSize,
+
+		Metadata:    srcFile.Metadata,
+		Checksum:    srcFile.Checksum,
+		ContentType: srcFile.ContentType,
+	}
+	span.SetAttributes(attribute.String("file_id", dstFile.ID))
+	logging.FromContext(ctx).Info("copying file", "copy_id", dstFile.ID, "chunk_count", len(srcChunks))
+
+	// Objects under retention stay per file, like the uploads that wrote them
+	shared := ch.contentAddressed && srcFile.RetentionMode == ""
+	span.SetAttributes(attribute.Bool("shared_objects", shared))
+
+	var dstChunks []*models.Chunk
+	if shared {
+		dstChunks, err = ch.shareChunks(ctx, srcID, dstFile.ID, srcChunks)
+	} else {
+		dstChunks, err = ch.copyChunks(ctx, dstFile.ID, srcChunks)
+	}
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to copy chunks: %v", err), errorStatus(err))
+		return
+	}
+
+	err = ch.saveMetadata(ctx, dstFile, dstChunks)
+	if shared {
+		// The chunk rows hold their own references once saved
+		ch.releaseObjects(ctx, dstChunks)
+	} else if err != nil {
+		ch.deleteChunks(ctx, dstChunks)
+	}
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to save metadata: %v", err), errorStatus(err))
+		return
+	}
+
+	response := WriteResponse{
+		FileID:     dstFile.ID,
+		FileName:   dstFile.Name,
+		FileSize:   dstFile.Size,
+		ChunkCount: dstFile.ChunkCount,
+		Message:    "File copied successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+
+	logging.FromContext(ctx).Info("file copy completed", "copy_id", dstFile.ID)
+}
+
+// shareChunks builds chunk rows for the copy that reference the source's
+// objects. Each object is claimed first, and the source is then looked up
+// again: while it still exists its rows keep the objects alive, so deleting
+// it can no longer remove them before the copy's rows are saved.
+func (ch *CopyHandler) shareChunks(ctx context.Context, srcID, fileID string, srcChunks []*models.Chunk) ([]*models.Chunk, error) {
+	ctx, span := tracer.Start(ctx, "share_chunks",
+		trace.WithAttributes(
+			attribute.Int("chunk_count", len(srcChunks)),
+		),
+	)
+	defer span.End()
+
+	dstChunks := make([]*models.Chunk, 0, len(srcChunks))
+	for _, src := range srcChunks {
+		if err := ch.tidbClient.ClaimChunkObject(ctx, src.MinioObjectKey); err != nil {
+			span.RecordError(err)
+			ch.releaseObjects(ctx, dstChunks)
+			return nil, fmt.Errorf("failed to claim chunk %d: %w", src.OrderIndex, err)
+		}
+		dstChunks = append(dstChunks, &models.Chunk{
+			ID:             uuid.New().String(),
+			FileID:         fileID,
+			OrderIndex:     src.OrderIndex,
+			Hash:           src.Hash,
+			MinioObjectKey: src.MinioObjectKey,
+			Size:           src.Size,
+			Compression:    src.Compression,
+			StoredSize:     src.StoredSize,
+		})
+	}
+
+	if _, err := ch.tidbClient.GetFile(ctx, srcID); err != nil {
+		span.RecordError(err)
+		ch.releaseObjects(ctx, dstChunks)
+		return nil, fmt.Errorf("failed to get file metadata: %w", err)
+	}
+
+	return dstChunks, nil
+}
+
+// copyChunks copies every chunk object under the new file's key prefix in
+// parallel. On failure, already-copied objects are removed.
+func (ch *CopyHandler) copyChunks(ctx context.Context, fileID string, srcChunks []*models.Chunk) ([]*models.Chunk, error) {
+	ctx, span := tracer.Start(ctx, "copy_chunks",
+		trace.WithAttributes(
+			attribute.Int("chunk_count", len(srcChunks)),
+		),
+	)
+	defer span.End()
+
+	dstChunks := make([]*models.Chunk, len(srcChunks))
+	for i, src := range srcChunks {
+		dstChunks[i] = &models.Chunk{
+			ID:             uuid.New().String(),
+			FileID:         fileID,
+			OrderIndex:     src.OrderIndex,
+			Hash:           src.Hash,
+			MinioObjectKey: ch.minioClient.ChunkKey(fileID, src.OrderIndex, ""),
+			Size:           src.Size,
+			Compression:    src.Compression,
+			StoredSize:     src.StoredSize,
+		}
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(ch.copyConcurrency)
+	for i, src := range srcChunks {
+		g.Go(func() error {
+			if err := ch.minioClient.CopyChunk(gctx, src.MinioObjectKey, dstChunks[i].MinioObjectKey); err != nil {
+				return fmt.Errorf("failed to copy chunk %d: %w", src.OrderIndex, err)
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		span.RecordError(err)
+		ch.deleteChunks(ctx, dstChunks)
+		return nil, err
+	}
+
+	return dstChunks, nil
+}
+
+// saveMetadata saves the copy's file and chunk rows in one transaction
+func (ch *CopyHandler) saveMetadata(ctx context.Context, file *models.File, chunks []*models.Chunk) error {
+	ctx, span := tracer.Start(ctx, "save_metadata")
+	defer span.End()
+
+	tx, err := ch.tidbClient.BeginTx(ctx)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	file.Status = models.FileStatusComplete
+	if err := ch.tidbClient.CreateFileTx(ctx, tx, file); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to create file record: %w", err)
+	}
+	if err := ch.tidbClient.CreateChunksTx(ctx, tx, chunks); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to create chunk records: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to commit metadata: %w", err)
+	}
+	return nil
+}
+
+// deleteChunks removes copied objects on a best-effort basis
+func (ch *CopyHandler) deleteChunks(ctx context.Context, chunks []*models.Chunk) {
+	for _, chunk := range chunks {
+		if err := ch.minioClient.DeleteChunk(ctx, chunk.MinioObjectKey); err != nil {
+			logging.FromContext(ctx).Warn("failed to clean up copied chunk", "object_key", chunk.MinioObjectKey, "error", err)
+		}
+	}
+}
+
+// releaseObjects gives back the references shareChunks claimed
+func (ch *CopyHandler) releaseObjects(ctx context.Context, chunks []*models.Chunk) {
+	if len(chunks) == 0 {
+		return
+	}
+
+	keys := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		keys[i] = chunk.MinioObjectKey
+	}
+	releaseObjects(ctx, ch.tidbClient, ch.minioClient, keys)
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/models"
+	"github.com/maneesh/labdropbox/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxDeleteBatch caps the number of file IDs per batch delete request
+const maxDeleteBatch = 1000
+
+// DeleteResult is the outcome of deleting one file: "deleted", "not_found"
+// or "error"
+type DeleteResult struct {
+	FileID string `json:"file_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// DeleteBatchResponse is the body of POST /delete-batch, with results in
+// request order
+type DeleteBatchResponse struct {
+	Results []DeleteResult `json:"results"`
+	Deleted int            `json:"deleted"`
+	Failed  int            `json:"failed"`
+}
+
+// DeleteHandler deletes files along with chunk objects no other file uses
+type DeleteHandler struct {
+	minioClient *storage.MinioClient
+	tidbClient  *storage.TiDBClient
+	redisClient *storage.RedisClient
+	concurrency int
+}
+
+// NewDeleteHandler creates a new delete handler that deletes up to
+// concurrency files at a time
+func NewDeleteHandler(
+	minioClient *storage.MinioClient,
+	tidbClient *storage.TiDBClient,
+	redisClient *storage.RedisClient,
+	concurrency int,
+) *DeleteHandler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &DeleteHandler{
+		minioClient: minioClient,
+		tidbClient:  tidbClient,
+		redisClient: redisClient,
+		concurrency: concurrency,
+	}
+}
+
+// ServeHTTP handles POST /delete-batch with a JSON array of file IDs. A file
+// that fails to delete doesn't stop the others.
+func (dh *DeleteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "delete_batch",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	var fileIDs []string
+	if err := json.NewDecoder(r.Body).Decode(&fileIDs); err != nil {
+		http.Error(w, fmt.Sprintf("request body must be a JSON array of file IDs: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(fileIDs) > maxDeleteBatch {
+		http.Error(w, fmt.Sprintf("at most %d file IDs per request", maxDeleteBatch), http.StatusBadRequest)
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("file_count", len(fileIDs)),
+		attribute.Int("delete_concurrency", dh.concurrency),
+	)
+
+	response := DeleteBatchResponse{Results: make([]DeleteResult, len(fileIDs))}
+	var g errgroup.Group
+	g.SetLimit(dh.concurrency)
+	for i, fileID := range fileIDs {
+		g.Go(func() error {
+			result := DeleteResult{FileID: fileID, Status: "deleted"}
+			if err := dh.deleteFile(ctx, fileID); errors.Is(err, storage.ErrFileNotFound) {
+				result.Status = "not_found"
+			} else if err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+			}
+			response.Results[i] = result
+			return nil
+		})
+	}
+	g.Wait()
+
+	for _, result := range response.Results {
+		if result.Status == "deleted" {
+			response.Deleted++
+		} else {
+			response.Failed++
+		}
+	}
+	span.SetAttributes(
+		attribute.Int("deleted", response.Deleted),
+		attribute.Int("failed", response.Failed),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// deleteFile deletes one file in its own span. Metadata goes first, so a
+// failure partway leaves unreferenced objects behind rather than a file
+// whose chunks are missing.
+func (dh *DeleteHandler) deleteFile(ctx context.Context, fileID string) error {
+	ctx, span := tracer.Start(ctx, "delete_file",
+		trace.WithAttributes(
+			attribute.String("file_id", fileID),
+		),
+	)
+	defer span.End()
+	ctx = logging.With(ctx, "file_id", fileID)
+
+	file, err := dh.tidbClient.GetFile(ctx, fileID)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	if err := checkDeletable(file); err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	objectKeys, err := dh.tidbClient.DeleteFile(ctx, fileID)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	if err := dh.redisClient.InvalidateFileMetadata(ctx, fileID); err != nil {
+		logging.FromContext(ctx).Warn("failed to invalidate cache", "error", err)
+	}
+	if err := dh.redisClient.InvalidateChunks(ctx, fileID); err != nil {
+		logging.FromContext(ctx).Warn("failed to invalidate cached chunk list", "error", err)
+	}
+
+	// Another write may have started reusing a shared object since the
+	// file's rows were deleted, so each is only removed if still unreferenced
+	deleted := 0
+	for _, key := range objectKeys {
+		ok, err := dh.tidbClient.DeleteChunkObject(ctx, key, func(ctx context.Context) error {
+			return dh.minioClient.DeleteChunk(ctx, key)
+		})
+		if err != nil {
+			logging.FromContext(ctx).Warn("failed to delete chunk of deleted file", "object_key", key, "error", err)
+		} else if ok {
+			deleted++
+		}
+	}
+
+	span.SetAttributes(
+		attribute.Int("unreferenced_objects", len(objectKeys)),
+		attribute.Int("objects_deleted", deleted),
+	)
+	logging.FromContext(ctx).Info("file deleted", "file_name", file.Name)
+	return nil
+}
+
+// checkDeletable rejects deleting a file that is still being uploaded or
+// whose chunks are under retention
+func checkDeletable(file *models.File) error {
+	if file.Status == models.FileStatusPending {
+		return fmt.Errorf("%w: %s", storage.ErrFileIncomplete, file.ID)
+	}
+	if file.RetainUntil != nil && time.Now().Before(*file.RetainUntil) {
+		return fmt.Errorf("%w: file %s is retained until %s", storage.ErrObjectLocked, file.ID, file.RetainUntil.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/maneesh/labdropbox/internal/storage"
+)
+
+// errInvalidRequest classifies errors caused by bad client input; create
+// them with invalidRequest
+var errInvalidRequest = errors.New("invalid request")
+
+// errUnsupportedEncoding is returned for a request body encoding that can't
+// be stored
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// errNoEncryptionKey is returned for an encrypted file when the server has
+// no ENCRYPTION_KEY configured
+var errNoEncryptionKey = errors.New("file is encrypted but no ENCRYPTION_KEY is configured")
+
+// requestError is a client input error whose message is shown as-is
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string { return e.msg }
+
+// Is makes every requestError match errInvalidRequest
+func (e *requestError) Is(target error) bool { return target == errInvalidRequest }
+
+// invalidRequest returns an error that errorStatus maps to 400
+func invalidRequest(format string, args ...interface{}) error {
+	return &requestError{msg: fmt.Sprintf(format, args...)}
+}
+
+// errorStatus maps an error to an HTTP status:
+//   - 400 for invalid client input
+//   - 404 for a missing file, alias or upload session
+//   - 409 for a lost append race, a file ID or alias that is already taken,
+//     a file still being uploaded, a chunk under retention, an incomplete
+//     upload session, or a session chunk re-uploaded with different content
+//   - 413 for a body over a size limit
+//   - 415 for an unsupported body encoding
+//   - 429 for a client over its upload session limit
+//   - 502 for a chunk object missing from storage, which the file's metadata
+//     says should be there
+//   - 503 when object storage is fast-failing behind an open circuit breaker
+//   - 504 when a storage call ran out of time
+//   - 500 otherwise
+func errorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrFileNotFound), errors.Is(err, storage.ErrAliasNotFound),
+		errors.Is(err, storage.ErrSessionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrChunkNotFound):
+		return http.StatusBadGateway
+	case errors.Is(err, storage.ErrAppendConflict), errors.Is(err, storage.ErrFileExists),
+		errors.Is(err, storage.ErrAliasExists), errors.Is(err, storage.ErrFileIncomplete),
+		errors.Is(err, storage.ErrObjectLocked), errors.Is(err, errSessionIncomplete),
+		errors.Is(err, errChunkConflict):
+		return http.StatusConflict
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUnsupportedEncoding):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, storage.ErrTooManySessions):
+		return http.StatusTooManyRequests
+	case errors.Is(err, storage.ErrStorageUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
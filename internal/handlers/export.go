@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// exportBatchSize is the number of file rows fetched from TiDB per query
+const exportBatchSize = 500
+
+// ExportHandler streams file metadata for reporting
+type ExportHandler struct {
+	tidbClient *storage.TiDBClient
+}
+
+// NewExportHandler creates a new export handler
+func NewExportHandler(tidbClient *storage.TiDBClient) *ExportHandler {
+	return &ExportHandler{
+		tidbClient: tidbClient,
+	}
+}
+
+// ServeHTTP handles GET /files/export?format=csv[&from=date][&to=date]
+func (eh *ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "export_files",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" {
+		http.Error(w, fmt.Sprintf("unsupported export format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	var filter storage.FileFilter
+	var err error
+	if filter.CreatedFrom, err = parseDateParam(query.Get("from")); err != nil {
+		http.Error(w, fmt.Sprintf("invalid 'from' parameter: %v", err), http.StatusBadRequest)
+		return
+	}
+	if filter.CreatedTo, err = parseDateParam(query.Get("to")); err != nil {
+		http.Error(w, fmt.Sprintf("invalid 'to' parameter: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Fetch the first batch before committing to a 200 so a DB failure can
+	// still be reported as a proper error
+	batch, err := eh.tidbClient.ListFilesAfter(ctx, filter, nil, exportBatchSize)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to list files: %v", err), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="files.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "name", "size", "chunk_count", "created_at"})
+
+	rowCount := 0
+	for len(batch) > 0 {
+		for _, file := range batch {
+			writer.Write([]string{
+				file.ID,
+				csvCell(file.Name),
+				strconv.FormatInt(file.Size, 10),
+				strconv.Itoa(file.ChunkCount),
+				file.CreatedAt.UTC().Format(time.RFC3339),
+			})
+		}
+		rowCount += len(batch)
+
+		// Push each batch to the client as soon as it's written
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			span.RecordError(err)
+			logging.FromContext(ctx).Warn("export aborted", "rows", rowCount, "error", err)
+			return
+		}
+
+		if len(batch) < exportBatchSize {
+			break
+		}
+
+		batch, err = eh.tidbClient.ListFilesAfter(ctx, filter, batch[len(batch)-1], exportBatchSize)
+		if err != nil {
+			// Headers are already sent; all we can do is stop and log
+			span.RecordError(err)
+			logging.FromContext(ctx).Warn("export aborted", "rows", rowCount, "error", err)
+			return
+		}
+	}
+
+	span.SetAttributes(attribute.Int("row_count", rowCount))
+}
+
+// parseDateParam parses an RFC 3339 timestamp or a YYYY-MM-DD date.
+// An empty value yields the zero time.
+func parseDateParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// csvCell keeps a spreadsheet from evaluating a client-chosen value as a
+// formula by prefixing values that start like one with a quote
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
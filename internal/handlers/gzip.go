@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"net/http"
+)
+
+// gzipResponseWriter gzips a successful response body on the fly. Other
+// statuses, such as errors, are written uncompressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+	aborted     bool
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w}
+}
+
+// WriteHeader switches to gzip for a 200. The compressed size isn't known
+// up front, so Content-Length is dropped.
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+
+	if code == http.StatusOK {
+		gw.Header().Del("Content-Length")
+		gw.Header().Set("Content-Encoding", "gzip")
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(code)
+}
+
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz == nil {
+		return gw.ResponseWriter.Write(p)
+	}
+	return gw.gz.Write(p)
+}
+
+// Close flushes the rest of the gzip stream, if one was started and the
+// response wasn't aborted
+func (gw *gzipResponseWriter) Close() error {
+	if gw.gz == nil || gw.aborted {
+		return nil
+	}
+	return gw.gz.Close()
+}
+
+// Abort makes Close leave the gzip stream unfinished, so a failed response
+// doesn't end with a valid gzip trailer
+func (gw *gzipResponseWriter) Abort() {
+	gw.aborted = true
+}
+
+// gzipETag derives the ETag of a gzipped representation from the ETag of
+// the uncompressed one, since their bytes differ
+func gzipETag(etag string) string {
+	if etag == "" {
+		return ""
+	}
+	return etag[:len(etag)-1] + `-gzip"`
+}
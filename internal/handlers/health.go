@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/maneesh/labdropbox/internal/maintenance"
+	"github.com/maneesh/labdropbox/internal/metrics"
+)
+
+// healthCheckTimeout bounds each dependency ping so the health check never hangs
+const healthCheckTimeout = 2 * time.Second
+
+// Pinger is a dependency that can report whether it is reachable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// breakerReporter is implemented by dependencies guarded by a circuit breaker
+type breakerReporter interface {
+	BreakerState() string
+}
+
+// DependencyHealth is the result of pinging one dependency
+type DependencyHealth struct {
+	Status       string  `json:"status"`
+	LatencyMS    float64 `json:"latency_ms"`
+	BreakerState string  `json:"breaker_state,omitempty"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// ActiveStreams is the number of reads and writes currently in progress
+type ActiveStreams struct {
+	Reads  int64 `json:"reads"`
+	Writes int64 `json:"writes"`
+}
+
+// HealthResponse is the verbose health report
+type HealthResponse struct {
+	Status        string                      `json:"status"`
+	UptimeSeconds int64                       `json:"uptime_seconds"`
+	Maintenance   maintenance.Status          `json:"maintenance"`
+	ActiveStreams ActiveStreams               `json:"active_streams"`
+	ShadowReads   *metrics.ShadowCounts       `json:"shadow_reads,omitempty"`
+	Dependencies  map[string]DependencyHealth `json:"dependencies"`
+}
+
+// HealthHandler reports service health
+type HealthHandler struct {
+	dependencies map[string]Pinger
+	mode         *maintenance.Mode
+	startTime    time.Time
+}
+
+// NewHealthHandler creates a new health handler for the named dependencies
+func NewHealthHandler(dependencies map[string]Pinger, mode *maintenance.Mode) *HealthHandler {
+	return &HealthHandler{
+		dependencies: dependencies,
+		mode:         mode,
+		startTime:    time.Now(),
+	}
+}
+
+// ServeHTTP handles GET /health[?verbose=true]. Every dependency is pinged,
+// so it doubles as a readiness check: healthy plain requests get "OK", and
+// any failing dependency turns the response into a 503 with the full report.
+func (hh *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	response := HealthResponse{
+		Status:        "ok",
+		UptimeSeconds: int64(time.Since(hh.startTime).Seconds()),
+		Maintenance:   hh.mode.Status(),
+		ActiveStreams: ActiveStreams{
+			Reads:  metrics.ActiveReads(),
+			Writes: metrics.ActiveWrites(),
+		},
+		Dependencies: hh.checkDependencies(r.Context()),
+	}
+	if shadow := metrics.Shadow(); shadow != (metrics.ShadowCounts{}) {
+		response.ShadowReads = &shadow
+	}
+
+	statusCode := http.StatusOK
+	for _, dep := range response.Dependencies {
+		if dep.Status != "ok" {
+			response.Status = "degraded"
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+
+	if statusCode == http.StatusOK && r.URL.Query().Get("verbose") != "true" {
+		w.Write([]byte("OK"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Live handles GET /livez, a liveness probe that checks nothing but that
+// the server is serving requests
+func (hh *HealthHandler) Live(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// checkDependencies pings every dependency in parallel and times each ping
+func (hh *HealthHandler) checkDependencies(ctx context.Context) map[string]DependencyHealth {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]DependencyHealth, len(hh.dependencies))
+
+	for name, dep := range hh.dependencies {
+		wg.Add(1)
+		go func(name string, dep Pinger) {
+			defer wg.Done()
+
+			pingCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := dep.Ping(pingCtx)
+			result := DependencyHealth{
+				Status:    "ok",
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+			}
+			if br, ok := dep.(breakerReporter); ok {
+				result.BreakerState = br.BreakerState()
+			}
+
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}(name, dep)
+	}
+
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/maneesh/labdropbox/internal/models"
+	"github.com/maneesh/labdropbox/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// ListResponse is the body of GET /files
+type ListResponse struct {
+	Files      []*models.File `json:"files"`
+	Pagination Pagination     `json:"pagination"`
+}
+
+// Pagination describes where a page sits in the full listing
+type Pagination struct {
+	Limit   int  `json:"limit"`
+	Offset  int  `json:"offset"`
+	Total   int  `json:"total"`
+	HasMore bool `json:"has_more"`
+}
+
+// ListHandler serves a paginated listing of all files
+type ListHandler struct {
+	tidbClient *storage.TiDBClient
+}
+
+// NewListHandler creates a new file listing handler
+func NewListHandler(tidbClient *storage.TiDBClient) *ListHandler {
+	return &ListHandler{tidbClient: tidbClient}
+}
+
+// ServeHTTP handles GET /files?limit=N&offset=M
+func (lh *ListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "list_files",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	query := r.URL.Query()
+	limit := defaultListLimit
+	if raw := query.Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			http.Error(w, "'limit' must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, maxListLimit)
+	}
+
+	offset := 0
+	if raw := query.Get("offset"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			http.Error(w, "'offset' must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = parsed
+	}
+	span.SetAttributes(
+		attribute.Int("limit", limit),
+		attribute.Int("offset", offset),
+	)
+
+	files, total, err := lh.tidbClient.ListFiles(ctx, limit, offset)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to list files: %v", err), errorStatus(err))
+		return
+	}
+	if files == nil {
+		files = []*models.File{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ListResponse{
+		Files: files,
+		Pagination: Pagination{
+			Limit:   limit,
+			Offset:  offset,
+			Total:   total,
+			HasMore: offset+len(files) < total,
+		},
+	})
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/maintenance"
+)
+
+// ReadOnlyRequest is the body of PUT /admin/read-only
+type ReadOnlyRequest struct {
+	ReadOnly bool   `json:"read_only"`
+	Reason   string `json:"reason"`
+}
+
+// MaintenanceHandler reports and toggles read-only mode
+type MaintenanceHandler struct {
+	mode *maintenance.Mode
+}
+
+// NewMaintenanceHandler creates a new maintenance handler
+func NewMaintenanceHandler(mode *maintenance.Mode) *MaintenanceHandler {
+	return &MaintenanceHandler{mode: mode}
+}
+
+// ServeHTTP handles GET and PUT /admin/read-only
+func (mh *MaintenanceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := mh.mode.Status()
+
+	if r.Method == http.MethodPut {
+		var req ReadOnlyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		status = mh.mode.Set(req.ReadOnly, req.Reason)
+		logging.FromContext(r.Context()).Info("read-only mode set", "read_only", req.ReadOnly, "reason", req.Reason)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
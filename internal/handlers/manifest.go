@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/maneesh/labdropbox/internal/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ManifestResponse is the body of GET /files/{file_id}/full and
+// GET /files/{file_id}/metadata. ChunkCount and TotalChunkSize are computed
+// from Chunks, so they can be checked against the file's recorded values.
+type ManifestResponse struct {
+	File           *models.File    `json:"file"`
+	Chunks         []*models.Chunk `json:"chunks"`
+	ChunkCount     int             `json:"chunk_count"`
+	TotalChunkSize int64           `json:"total_chunk_size"`
+}
+
+// ManifestHandler returns a file's metadata together with its ordered chunks
+type ManifestHandler struct {
+	readHandler *ReadHandler
+}
+
+// NewManifestHandler creates a new manifest handler that reuses the read
+// handler's cached metadata lookups
+func NewManifestHandler(readHandler *ReadHandler) *ManifestHandler {
+	return &ManifestHandler{
+		readHandler: readHandler,
+	}
+}
+
+// ServeHTTP handles GET /files/{file_id}/full and GET /files/{file_id}/metadata
+func (mh *ManifestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh := mh.readHandler
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "file_manifest",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	fileID := mux.Vars(r)["file_id"]
+	span.SetAttributes(attribute.String("file_id", fileID))
+
+	fresh := wantsFresh(r)
+	file, err := rh.getFileMetadata(ctx, fileID, fresh)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to get file metadata: %v", err), errorStatus(err))
+		return
+	}
+
+	chunks, err := rh.getChunkMetadata(ctx, file, fresh)
+	if err != nil {
+		span.RecordError(err)
+		rh.chunkMetadataError(w, file, err)
+		return
+	}
+	if chunks == nil {
+		chunks = []*models.Chunk{}
+	}
+	var totalSize int64
+	for _, chunk := range chunks {
+		totalSize += chunk.Size
+	}
+	span.SetAttributes(
+		attribute.Int("chunk_count", len(chunks)),
+		attribute.Int64("total_chunk_size", totalSize),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ManifestResponse{
+		File:           file,
+		Chunks:         chunks,
+		ChunkCount:     len(chunks),
+		TotalChunkSize: totalSize,
+	})
+}
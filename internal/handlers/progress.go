@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/maneesh/labdropbox/internal/progress"
+)
+
+// ProgressHandler streams upload progress as Server-Sent Events
+type ProgressHandler struct {
+	registry *progress.Registry
+}
+
+// NewProgressHandler creates a new progress handler
+func NewProgressHandler(registry *progress.Registry) *ProgressHandler {
+	return &ProgressHandler{
+		registry: registry,
+	}
+}
+
+// ServeHTTP handles GET /uploads/{upload_id}/progress
+func (ph *ProgressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	uploadID := mux.Vars(r)["upload_id"]
+
+	current, changed, ok := ph.registry.Watch(uploadID)
+	if !ok {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Progress streams outlive the server's write timeout on large uploads
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		data, err := json.Marshal(current)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+		flusher.Flush()
+
+		if current.Done {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+
+		current, changed, ok = ph.registry.Watch(uploadID)
+		if !ok {
+			return
+		}
+	}
+}
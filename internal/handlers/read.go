@@ -2,24 +2,118 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"hash"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/maneesh/labdropbox/internal/chunker"
+	"github.com/maneesh/labdropbox/internal/compress"
+	"github.com/maneesh/labdropbox/internal/crypto"
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/metrics"
 	"github.com/maneesh/labdropbox/internal/models"
 	"github.com/maneesh/labdropbox/internal/storage"
+	"github.com/maneesh/labdropbox/internal/transform"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
+// ReadOptions tunes the behavior of the read path
+type ReadOptions struct {
+	// ReadAfterWriteWindow is how long after a file's creation a missing
+	// chunk is assumed to still be propagating and is retried (0 disables)
+	ReadAfterWriteWindow time.Duration
+	// ReadAfterWriteRetries is the maximum number of retries for such chunks
+	ReadAfterWriteRetries int
+	// ReadAfterWriteBackoff is the delay before the first retry, doubled on each attempt
+	ReadAfterWriteBackoff time.Duration
+
+	// Cipher decrypts the chunks of encrypted files
+	Cipher *crypto.Cipher
+
+	// Shadow, if set, re-reads every served chunk from a secondary store in
+	// the background and compares hashes
+	Shadow *storage.ShadowReader
+
+	// RetryFailedRead retries a failed chunk fetch once from scratch after
+	// RetryDelay, as long as nothing has been written to the client yet
+	RetryFailedRead bool
+	RetryDelay      time.Duration
+
+	// ReadAheadChunks streams plain full-file reads in order, prefetching up
+	// to this many chunks past the one being written (0 buffers the whole
+	// file before responding). The memory budget still caps the window.
+	ReadAheadChunks int
+
+	// CoalesceMaxBytes is the largest file whose concurrent reads share a
+	// single chunk fetch (0 disables coalescing)
+	CoalesceMaxBytes int64
+
+	// SniffContentType serves files stored with a generic content type as
+	// the type http.DetectContentType finds in their first chunk. Stored
+	// metadata is left unchanged.
+	SniffContentType bool
+
+	// CachedChunks looks up chunk lists in Redis (populated by writes with
+	// WriteOptions.CacheChunks) before querying TiDB
+	CachedChunks bool
+
+	// CachedChunkData caches the bytes of chunks up to ChunkDataCacheMaxBytes
+	// in Redis by hash for ChunkDataCacheTTL, and serves cached chunks
+	// without a MinIO download. Chunks of encrypted files are never cached,
+	// since Redis would hold their plaintext.
+	CachedChunkData        bool
+	ChunkDataCacheMaxBytes int64
+	ChunkDataCacheTTL      time.Duration
+
+	// DegradedMetadata answers reads whose chunk list can't be loaded with a
+	// 503 carrying the file's metadata instead of a plain error
+	DegradedMetadata bool
+
+	// Transforms holds the transformers selectable with ?transform=
+	Transforms *transform.Registry
+
+	// IncompleteStatus is the HTTP status returned for files whose upload
+	// hasn't finished: 425 Too Early (default) or 409 Conflict
+	IncompleteStatus int
+
+	// MaxDownloadMemory bounds the bytes of chunk data in flight per read.
+	// Parallelism is derived from it as MaxDownloadMemory / chunk size.
+	MaxDownloadMemory int64
+
+	// ReadConcurrency caps the parallel chunk downloads per read regardless
+	// of the memory budget, bounding connections to MinIO (0 uses only the
+	// budget)
+	ReadConcurrency int
+
+	// GzipResponses gzips the body of files not stored compressed, and at
+	// least GzipMinSize bytes, for clients that accept gzip
+	GzipResponses bool
+	GzipMinSize   int64
+}
+
 // ReadHandler handles file download requests
 type ReadHandler struct {
 	minioClient *storage.MinioClient
 	tidbClient  *storage.TiDBClient
 	redisClient *storage.RedisClient
+	opts        ReadOptions
+
+	// downloads coalesces concurrent fetches of the same file
+	downloads singleflight.Group
 }
 
 // NewReadHandler creates a new read handler
@@ -27,16 +121,21 @@ func NewReadHandler(
 	minioClient *storage.MinioClient,
 	tidbClient *storage.TiDBClient,
 	redisClient *storage.RedisClient,
+	opts ReadOptions,
 ) *ReadHandler {
 	return &ReadHandler{
 		minioClient: minioClient,
 		tidbClient:  tidbClient,
 		redisClient: redisClient,
+		opts:        opts,
 	}
 }
 
-// ServeHTTP handles GET /read/{file_id}
+// ServeHTTP handles GET and HEAD /read/{file_id}. HEAD returns the same
+// headers as GET from the file metadata alone, without touching chunks.
 func (rh *ReadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer metrics.StartRead()()
+
 	ctx := r.Context()
 	ctx, span := tracer.Start(ctx, "read_file",
 		trace.WithSpanKind(trace.SpanKindServer),
@@ -52,18 +151,29 @@ func (rh *ReadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	span.SetAttributes(attribute.String("file_id", fileID))
-	log.Printf("Reading file: %s", fileID)
+	logging.FromContext(ctx).Info("reading file")
 
-	// Step 1: Try to get file metadata from cache
-	file, err := rh.getFileMetadata(ctx, fileID)
+	// Downloads of large files outlive the server's write timeout; stalled
+	// clients are cut off by MIN_DOWNLOAD_RATE_BYTES_PER_SEC instead
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	// Step 1: Try to get file metadata from cache, unless the client asked
+	// for the freshest metadata
+	fresh := wantsFresh(r)
+	span.SetAttributes(attribute.Bool("fresh", fresh))
+	file, err := rh.getFileMetadata(ctx, fileID, fresh)
 	if err != nil {
 		span.RecordError(err)
-		http.Error(w, fmt.Sprintf("failed to get file metadata: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("failed to get file metadata: %v", err), errorStatus(err))
 		return
 	}
 
-	if file == nil {
-		http.Error(w, "file not found", http.StatusNotFound)
+	if file.Status == models.FileStatusPending {
+		status := rh.opts.IncompleteStatus
+		if status == 0 {
+			status = http.StatusTooEarly
+		}
+		http.Error(w, storage.ErrFileIncomplete.Error(), status)
 		return
 	}
 
@@ -73,80 +183,497 @@ func (rh *ReadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		attribute.Int("chunk_count", file.ChunkCount),
 	)
 
+	// Resolve the optional transform before doing any chunk I/O
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	var transformer transform.Transformer
+	if name := r.URL.Query().Get("transform"); name != "" && rh.opts.Transforms != nil {
+		transformer, err = rh.opts.Transforms.Lookup(name, contentType)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		span.SetAttributes(attribute.String("transform", name))
+	} else if name != "" {
+		http.Error(w, "transforms are not enabled", http.StatusBadRequest)
+		return
+	}
+
+	// Files stored gzip-compressed pass through to clients that accept gzip
+	// and are decompressed on the fly for everyone else (and before any
+	// requested transform)
+	encoding := file.ContentEncoding()
+	passthrough := false
+	if encoding == "gzip" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if transformer == nil && acceptsGzip(r) {
+			passthrough = true
+		} else {
+			if transformer == nil {
+				transformer = transform.Identity{}
+			}
+			transformer = transform.Gunzipped(transformer)
+		}
+		span.SetAttributes(
+			attribute.String("content_encoding", encoding),
+			attribute.Bool("decompressed", !passthrough),
+		)
+	}
+
+	// Content-Encoding is only sent when the stored bytes pass through as-is
+	sentEncoding := ""
+	if passthrough {
+		sentEncoding = encoding
+	}
+
+	// Content not stored compressed can be gzipped on the wire instead
+	etag := fileETag(file, transformer)
+	if rh.gzipsResponse(file, encoding) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			gw := newGzipResponseWriter(w)
+			defer gw.Close()
+			w = gw
+			etag = gzipETag(etag)
+			span.SetAttributes(attribute.Bool("gzipped", true))
+		}
+	}
+
+	// Clients revalidating an unchanged file need no chunks at all
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			span.SetAttributes(attribute.Bool("not_modified", true))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if r.Method == http.MethodHead {
+		// Without the first chunk there is nothing to sniff
+		setContentHeaders(w, file, contentType, transformer, sentEncoding)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	// Step 2: Get chunk metadata from TiDB
-	chunks, err := rh.getChunkMetadata(ctx, fileID)
+	chunks, err := rh.getChunkMetadata(ctx, file, fresh)
 	if err != nil {
 		span.RecordError(err)
-		http.Error(w, fmt.Sprintf("failed to get chunks: %v", err), http.StatusInternalServerError)
+		rh.chunkMetadataError(w, file, err)
+		return
+	}
+
+	if err := validateChunks(file, chunks); err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("file metadata is inconsistent: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Plain reads can be streamed chunk by chunk with read-ahead; transformed
+	// and coalesced reads need the whole file first
+	if transformer == nil && rh.opts.ReadAheadChunks > 0 && !rh.coalesces(file) {
+		writeHeaders := func(first []byte) {
+			if !passthrough {
+				contentType = rh.responseContentType(span, contentType, first)
+			}
+			setContentHeaders(w, file, contentType, nil, sentEncoding)
+			w.WriteHeader(http.StatusOK)
+		}
+
+		started, err := rh.streamChunks(ctx, w, file, chunks, writeHeaders)
+		if err != nil && !started && rh.waitToRetryRead(ctx, span, err) {
+			started, err = rh.streamChunks(ctx, w, file, chunks, writeHeaders)
+		}
+		if err != nil {
+			span.RecordError(err)
+			if !started {
+				http.Error(w, fmt.Sprintf("failed to fetch chunks: %v", err), errorStatus(err))
+				return
+			}
+			logging.FromContext(ctx).Warn("streamed read aborted", "file_name", file.Name, "error", err)
+			abortResponse(w)
+		}
+		metrics.RecordFileDownload(ctx, file.Size)
+		logging.FromContext(ctx).Info("file read completed", "file_name", file.Name)
 		return
 	}
 
 	// Step 3: Fetch chunks from MinIO in parallel (THE KEY FEATURE!)
-	log.Printf("Fetching %d chunks in parallel...", len(chunks))
-	chunkData, err := rh.fetchChunksParallel(ctx, chunks)
+	logging.FromContext(ctx).Info("fetching chunks in parallel", "chunk_count", len(chunks))
+	chunkData, err := rh.fetchChunks(ctx, file, chunks)
+	if err != nil && rh.waitToRetryRead(ctx, span, err) {
+		chunkData, err = rh.fetchChunks(ctx, file, chunks)
+	}
 	if err != nil {
 		span.RecordError(err)
-		http.Error(w, fmt.Sprintf("failed to fetch chunks: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("failed to fetch chunks: %v", err), errorStatus(err))
 		return
 	}
 
-	// Step 4: Reassemble chunks
-	log.Printf("Reassembling chunks...")
-	fileData := rh.reassembleFile(ctx, chunkData)
+	// Each chunk matched its own hash; check they reassemble to the file
+	if err := verifyChunkData(file, chunkData); err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to verify file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Sniffing needs the decoded bytes, which encoded files don't start with
+	if len(chunkData) > 0 && encoding == "" {
+		contentType = rh.responseContentType(span, contentType, chunkData[0])
+	}
+
+	if transformer != nil {
+		setContentHeaders(w, file, contentType, transformer, "")
+		w.WriteHeader(http.StatusOK)
+		if err := rh.writeTransformed(ctx, w, transformer, chunkData); err != nil {
+			span.RecordError(err)
+			logging.FromContext(ctx).Warn("transformed read aborted", "file_name", file.Name, "error", err)
+			abortResponse(w)
+		}
+		metrics.RecordFileDownload(ctx, file.Size)
+		logging.FromContext(ctx).Info("file read completed", "file_name", file.Name)
+		return
+	}
 
-	// Step 5: Stream response
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", file.Name))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(fileData)))
+	// Step 4: Write the chunks in order, without copying them into one buffer
+	setContentHeaders(w, file, contentType, nil, sentEncoding)
 	w.WriteHeader(http.StatusOK)
-	w.Write(fileData)
+	if err := rh.writeChunks(ctx, w, chunkData); err != nil {
+		span.RecordError(err)
+		logging.FromContext(ctx).Warn("read aborted", "file_name", file.Name, "error", err)
+		abortResponse(w)
+	}
 
-	log.Printf("File read completed: %s (ID: %s)", file.Name, fileID)
+	metrics.RecordFileDownload(ctx, file.Size)
+	logging.FromContext(ctx).Info("file read completed", "file_name", file.Name)
 }
 
-func (rh *ReadHandler) getFileMetadata(ctx context.Context, fileID string) (*models.File, error) {
-	// Try cache first
-	ctx, cacheSpan := tracer.Start(ctx, "cache_lookup")
-	file, err := rh.redisClient.GetFileMetadata(ctx, fileID)
-	cacheSpan.End()
+// abortResponse ends a response that failed after it started by cutting the
+// connection. Returning normally would end a chunked or gzipped body
+// cleanly, and the client would take the truncated file for the whole one.
+func abortResponse(w http.ResponseWriter) {
+	if gw, ok := w.(*gzipResponseWriter); ok {
+		gw.Abort()
+	}
+	panic(http.ErrAbortHandler)
+}
 
-	if err != nil {
-		return nil, err
+// decrypter returns the function that decrypts file's chunks, or nil if
+// they are stored in plaintext
+func (rh *ReadHandler) decrypter(file *models.File) func([]byte) ([]byte, error) {
+	if file.Encryption() == "" {
+		return nil
+	}
+	if rh.opts.Cipher == nil {
+		return func([]byte) ([]byte, error) { return nil, errNoEncryptionKey }
 	}
+	return rh.opts.Cipher.Decrypt
+}
+
+// chunkDecoder returns the function that turns a chunk object back into its
+// original bytes (decrypting, then decompressing), or nil if it is stored
+// as-is
+func (rh *ReadHandler) chunkDecoder(file *models.File, chunkMeta *models.Chunk) func([]byte) ([]byte, error) {
+	decrypt := rh.decrypter(file)
+	compression := chunkMeta.Compression
+	if compression == compress.None {
+		compression = ""
+	}
+	if decrypt == nil && compression == "" {
+		return nil
+	}
+
+	return func(data []byte) ([]byte, error) {
+		var err error
+		if decrypt != nil {
+			if data, err = decrypt(data); err != nil {
+				return nil, err
+			}
+		}
+		return compress.Decompress(compression, data, chunkMeta.Size)
+	}
+}
+
+// setContentHeaders sets the headers describing a read's body, shared by
+// GET and HEAD. A transformed body's size isn't known up front, so it gets
+// no Content-Length, and no X-Content-SHA256 since that is the stored file's.
+func setContentHeaders(w http.ResponseWriter, file *models.File, contentType string, transformer transform.Transformer, encoding string) {
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	if transformer != nil {
+		w.Header().Set("Content-Type", transformer.ContentType(contentType))
+		w.Header().Set("Content-Disposition", contentDisposition(transformer.FileName(file.Name)))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDisposition(file.Name))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", file.Size))
+	if file.Checksum != "" {
+		w.Header().Set("X-Content-SHA256", file.Checksum)
+	}
+}
+
+// contentDisposition returns an attachment Content-Disposition for name. A
+// name that isn't plain ASCII also gets an RFC 5987 filename* parameter,
+// with an ASCII approximation left in filename for older clients.
+func contentDisposition(name string) string {
+	var fallback strings.Builder
+	plain := true
+	for _, r := range name {
+		switch {
+		case r == '"' || r == '\\' || r < 0x20 || r > 0x7e:
+			fallback.WriteRune('_')
+			plain = false
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	if plain {
+		return fmt.Sprintf("attachment; filename=\"%s\"", name)
+	}
+
+	var encoded strings.Builder
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf("attachment; filename=\"%s\"; filename*=UTF-8''%s", fallback.String(), encoded.String())
+}
+
+// isAttrChar reports whether b may appear unescaped in an RFC 5987 value
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// fileETag returns the strong ETag of a read's body: the file checksum,
+// which covers the stored bytes. Transformed or decompressed bodies differ
+// from those and, like files without a checksum, get no ETag.
+func fileETag(file *models.File, transformer transform.Transformer) string {
+	if file.Checksum == "" || transformer != nil {
+		return ""
+	}
+	return `"` + file.Checksum + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison RFC 9110 specifies for it
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// errChecksumMismatch is returned when a file's chunks, each matching its
+// own hash, don't reassemble to the file's checksum
+var errChecksumMismatch = errors.New("file checksum mismatch")
 
-	if file != nil {
-		log.Printf("Cache HIT for file: %s", fileID)
-		return file, nil
+// verifyChecksum compares sum, fed the file's bytes in order, with the
+// file's stored checksum
+func verifyChecksum(file *models.File, sum hash.Hash) error {
+	if got := hex.EncodeToString(sum.Sum(nil)); got != file.Checksum {
+		return fmt.Errorf("%w: %s: expected %s, got %s", errChecksumMismatch, file.ID, file.Checksum, got)
+	}
+	return nil
+}
+
+// verifyChunkData checks fetched chunks against the file's checksum. Files
+// without one (written before it was recorded, or appended to) are skipped.
+func verifyChunkData(file *models.File, chunkData [][]byte) error {
+	if file.Checksum == "" {
+		return nil
+	}
+
+	sum := sha256.New()
+	for _, data := range chunkData {
+		sum.Write(data)
+	}
+	return verifyChecksum(file, sum)
+}
+
+// ContentUnavailableResponse is the 503 body of a degraded read: the file's
+// metadata was found but its content can't be served right now
+type ContentUnavailableResponse struct {
+	Error string       `json:"error"`
+	File  *models.File `json:"file"`
+}
+
+// chunkMetadataError reports a failure to load a file's chunk list. With
+// DegradedMetadata, server-side failures still return the file metadata.
+func (rh *ReadHandler) chunkMetadataError(w http.ResponseWriter, file *models.File, err error) {
+	if !rh.opts.DegradedMetadata || errorStatus(err) < http.StatusInternalServerError {
+		http.Error(w, fmt.Sprintf("failed to get chunks: %v", err), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", "5")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(ContentUnavailableResponse{
+		Error: fmt.Sprintf("file content is temporarily unavailable: %v", err),
+		File:  file,
+	})
+}
+
+// wantsFresh reports whether the client asked to bypass cached metadata with
+// Cache-Control: no-cache or ?fresh=true
+func wantsFresh(r *http.Request) bool {
+	if fresh, err := strconv.ParseBool(r.URL.Query().Get("fresh")); err == nil && fresh {
+		return true
+	}
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+	return false
+}
+
+// getFileMetadata returns a file's metadata, cache-first. fresh skips the
+// cache lookup and reads TiDB, still refreshing the cache afterwards.
+func (rh *ReadHandler) getFileMetadata(ctx context.Context, fileID string, fresh bool) (*models.File, error) {
+	if !fresh {
+		// Try cache first
+		cacheCtx, cacheSpan := tracer.Start(ctx, "cache_lookup")
+		file, err := rh.redisClient.GetFileMetadata(cacheCtx, fileID)
+		cacheSpan.End()
+
+		if err != nil {
+			return nil, err
+		}
+		metrics.RecordCacheLookup(ctx, "file_metadata", file != nil)
+
+		if file != nil {
+			logging.FromContext(ctx).Debug("file metadata cache hit")
+			return file, nil
+		}
+
+		// Cache miss - fetch from TiDB
+		logging.FromContext(ctx).Debug("file metadata cache miss")
 	}
 
-	// Cache miss - fetch from TiDB
-	log.Printf("Cache MISS for file: %s", fileID)
 	ctx, dbSpan := tracer.Start(ctx, "db_lookup")
 	defer dbSpan.End()
 
-	file, err = rh.tidbClient.GetFile(ctx, fileID)
+	file, err := rh.tidbClient.GetFile(ctx, fileID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Update cache for next time
-	if err := rh.redisClient.SetFileMetadata(ctx, fileID, file); err != nil {
-		log.Printf("Warning: failed to update cache: %v", err)
+	// Update cache for next time, unless the file is still being uploaded
+	// and its status is about to change
+	if file.Status != models.FileStatusPending {
+		if err := rh.redisClient.SetFileMetadata(ctx, fileID, file); err != nil {
+			logging.FromContext(ctx).Warn("failed to update cache", "error", err)
+		}
 	}
 
 	return file, nil
 }
 
-func (rh *ReadHandler) getChunkMetadata(ctx context.Context, fileID string) ([]*models.Chunk, error) {
+// getChunkMetadata returns the file's ordered chunk list. With CachedChunks,
+// a cached list is used when it matches the file's current chunk count,
+// unless fresh is set.
+func (rh *ReadHandler) getChunkMetadata(ctx context.Context, file *models.File, fresh bool) ([]*models.Chunk, error) {
 	ctx, span := tracer.Start(ctx, "fetch_chunk_metadata")
 	defer span.End()
 
-	return rh.tidbClient.GetChunks(ctx, fileID)
+	if rh.opts.CachedChunks && !fresh {
+		chunks, err := rh.redisClient.GetChunks(ctx, file.ID)
+		if err != nil {
+			logging.FromContext(ctx).Warn("failed to read cached chunk list", "error", err)
+		}
+		hit := chunks != nil && len(chunks) == file.ChunkCount
+		metrics.RecordCacheLookup(ctx, "chunk_metadata", hit)
+		span.SetAttributes(attribute.Bool("cache_hit", hit))
+		if hit {
+			return chunks, nil
+		}
+	}
+
+	return rh.tidbClient.GetChunks(ctx, file.ID)
+}
+
+// fetchChunks fetches the file's chunks, sharing one fetch between
+// concurrent reads of the same file when it is small enough to coalesce.
+// The shared chunk data must not be modified.
+func (rh *ReadHandler) fetchChunks(ctx context.Context, file *models.File, chunkMetadata []*models.Chunk) ([][]byte, error) {
+	span := trace.SpanFromContext(ctx)
+	if !rh.coalesces(file) {
+		return rh.fetchChunksParallel(ctx, file, chunkMetadata)
+	}
+
+	// Appends change the chunk list, so only reads of the same version share
+	key := fmt.Sprintf("%s:%d", file.ID, file.ChunkCount)
+
+	// The fetch is detached from the first caller so its cancellation
+	// doesn't fail everyone else waiting on it
+	fetchCtx := context.WithoutCancel(ctx)
+	results := rh.downloads.DoChan(key, func() (interface{}, error) {
+		return rh.fetchChunksParallel(fetchCtx, file, chunkMetadata)
+	})
+
+	select {
+	case res := <-results:
+		span.SetAttributes(attribute.Bool("coalesced", res.Shared))
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([][]byte), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// waitToRetryRead decides whether a failed fetch is worth one more attempt
+// and, if so, waits out the retry delay. Missing chunks (already retried by
+// downloadChunk), an open circuit breaker and a cancelled request are final.
+func (rh *ReadHandler) waitToRetryRead(ctx context.Context, span trace.Span, err error) bool {
+	if !rh.opts.RetryFailedRead || ctx.Err() != nil ||
+		errors.Is(err, storage.ErrChunkNotFound) || errors.Is(err, storage.ErrStorageUnavailable) {
+		return false
+	}
+
+	span.AddEvent("read_retry", trace.WithAttributes(
+		attribute.String("error", err.Error()),
+		attribute.Int64("delay_ms", rh.opts.RetryDelay.Milliseconds()),
+	))
+	span.SetAttributes(attribute.Bool("read_retried", true))
+	logging.FromContext(ctx).Warn("retrying read after failure", "error", err)
+
+	select {
+	case <-time.After(rh.opts.RetryDelay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// coalesces reports whether concurrent reads of file share one fetch
+func (rh *ReadHandler) coalesces(file *models.File) bool {
+	return rh.opts.CoalesceMaxBytes > 0 && file.Size <= rh.opts.CoalesceMaxBytes
 }
 
 // fetchChunksParallel fetches chunks from MinIO in parallel with proper tracing
 // This is THE critical function for demonstrating parallel spans in Jaeger!
-func (rh *ReadHandler) fetchChunksParallel(ctx context.Context, chunkMetadata []*models.Chunk) ([][]byte, error) {
+func (rh *ReadHandler) fetchChunksParallel(ctx context.Context, file *models.File, chunkMetadata []*models.Chunk) ([][]byte, error) {
 	// Create parent span for parallel chunk fetching
 	ctx, fetchSpan := tracer.Start(ctx, "fetch_chunks_parallel",
 		trace.WithAttributes(
@@ -155,73 +682,415 @@ func (rh *ReadHandler) fetchChunksParallel(ctx context.Context, chunkMetadata []
 	)
 	defer fetchSpan.End()
 
+	concurrency := rh.downloadConcurrency(chunkMetadata)
+	fetchSpan.SetAttributes(attribute.Int("download_concurrency", concurrency))
+
 	// Prepare slice to hold chunk data in order
 	chunkData := make([][]byte, len(chunkMetadata))
-	var wg sync.WaitGroup
-	errChan := make(chan error, len(chunkMetadata))
 
-	// Launch parallel goroutines to fetch each chunk
+	// Fetch at most concurrency chunks at a time; the first failure stops
+	// launching the rest, so a bad chunk early in a huge file fails fast.
+	// Every chunk that failed on its own is reported, so one flaky chunk can
+	// be told apart from an outage; downloads merely cancelled are not.
+	var mu sync.Mutex
+	chunkErrs := make(map[int]error)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
 	for i, meta := range chunkMetadata {
-		wg.Add(1)
-		go func(idx int, chunkMeta *models.Chunk) {
-			defer wg.Done()
-
-			// CRITICAL: Create child span with propagated context
-			// This ensures each goroutine's work appears as a parallel span in Jaeger
-			_, chunkSpan := tracer.Start(ctx, fmt.Sprintf("download_chunk_%d", idx),
-				trace.WithAttributes(
-					attribute.Int("chunk_index", idx),
-					attribute.String("object_key", chunkMeta.MinioObjectKey),
-					attribute.Int64("chunk_size", chunkMeta.Size),
-				),
+		if gctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			data, err := rh.fetchChunk(gctx, file, i, meta)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) || ctx.Err() != nil {
+					mu.Lock()
+					chunkErrs[i] = err
+					mu.Unlock()
+				}
+				return err
+			}
+
+			// Store in ordered slice
+			chunkData[i] = data
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		err = joinChunkErrors(chunkErrs, err)
+		fetchSpan.SetAttributes(attribute.Int("failed_chunks", len(chunkErrs)))
+		fetchSpan.RecordError(err)
+		return nil, err
+	}
+
+	fetchSpan.SetAttributes(attribute.Bool("all_chunks_fetched", true))
+	return chunkData, nil
+}
+
+// joinChunkErrors joins per-chunk errors in chunk order, falling back to
+// first if none were collected
+func joinChunkErrors(chunkErrs map[int]error, first error) error {
+	if len(chunkErrs) == 0 {
+		return first
+	}
+
+	indices := make([]int, 0, len(chunkErrs))
+	for i := range chunkErrs {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+
+	errs := make([]error, 0, len(indices))
+	for _, i := range indices {
+		errs = append(errs, chunkErrs[i])
+	}
+	return errors.Join(errs...)
+}
+
+// fetchChunk downloads one chunk in its own span and verifies its hash
+func (rh *ReadHandler) fetchChunk(ctx context.Context, file *models.File, idx int, chunkMeta *models.Chunk) ([]byte, error) {
+	// CRITICAL: Create child span with propagated context
+	// This ensures each goroutine's work appears as a parallel span in Jaeger
+	_, chunkSpan := tracer.Start(ctx, fmt.Sprintf("download_chunk_%d", idx),
+		trace.WithAttributes(
+			attribute.Int("chunk_index", idx),
+			attribute.String("object_key", chunkMeta.MinioObjectKey),
+			attribute.Int64("chunk_size", chunkMeta.Size),
+		),
+	)
+	defer chunkSpan.End()
+
+	cacheable := rh.cachesChunkData(file, chunkMeta)
+	if cacheable {
+		if data := rh.cachedChunkData(ctx, chunkMeta); data != nil {
+			chunkSpan.SetAttributes(
+				attribute.Bool("chunk_cache_hit", true),
+				attribute.Bool("download_success", true),
 			)
-			defer chunkSpan.End()
+			return data, nil
+		}
+	}
 
-			// Download chunk from MinIO
-			data, err := rh.minioClient.DownloadChunk(ctx, chunkMeta.MinioObjectKey)
-			if err != nil {
-				chunkSpan.RecordError(err)
-				errChan <- fmt.Errorf("failed to download chunk %d: %w", idx, err)
+	// Download chunk from MinIO
+	data, err := rh.downloadChunk(ctx, chunkSpan, file, chunkMeta)
+	if err != nil {
+		chunkSpan.RecordError(err)
+		return nil, fmt.Errorf("failed to download chunk %d (%s): %w", idx, chunkMeta.MinioObjectKey, err)
+	}
+
+	// The stored hash is of the original bytes, so decrypt and decompress
+	// before verifying
+	decode := rh.chunkDecoder(file, chunkMeta)
+	if decode != nil {
+		if data, err = decode(data); err != nil {
+			chunkSpan.RecordError(err)
+			return nil, fmt.Errorf("failed to decode chunk %d (%s): %w", idx, chunkMeta.MinioObjectKey, err)
+		}
+	}
+
+	// Verify hash (optional but good practice)
+	if !chunker.VerifyChunkHash(data, chunkMeta.Hash) {
+		err := fmt.Errorf("hash mismatch for chunk %d (%s)", idx, chunkMeta.MinioObjectKey)
+		chunkSpan.RecordError(err)
+		return nil, err
+	}
+
+	rh.opts.Shadow.Compare(ctx, chunkMeta.MinioObjectKey, chunkMeta.Hash, decode)
+
+	if cacheable {
+		if err := rh.redisClient.SetChunkData(ctx, chunkMeta.Hash, data, rh.opts.ChunkDataCacheTTL); err != nil {
+			logging.FromContext(ctx).Warn("failed to cache chunk", "hash", chunkMeta.Hash, "error", err)
+		}
+	}
+
+	chunkSpan.SetAttributes(attribute.Bool("download_success", true))
+	metrics.RecordChunkDownload(ctx, int64(len(data)))
+	return data, nil
+}
+
+// cachesChunkData reports whether a chunk's bytes go through the Redis chunk
+// cache
+func (rh *ReadHandler) cachesChunkData(file *models.File, chunkMeta *models.Chunk) bool {
+	return rh.opts.CachedChunkData && chunkMeta.Size <= rh.opts.ChunkDataCacheMaxBytes &&
+		file.Encryption() == ""
+}
+
+// cachedChunkData returns a chunk's bytes from the Redis chunk cache, or nil
+// on a miss. Cache errors and entries that fail hash verification count as
+// misses, so the chunk is downloaded instead.
+func (rh *ReadHandler) cachedChunkData(ctx context.Context, chunkMeta *models.Chunk) []byte {
+	data, err := rh.redisClient.GetChunkData(ctx, chunkMeta.Hash)
+	if err != nil {
+		logging.FromContext(ctx).Warn("chunk cache lookup failed", "error", err)
+		data = nil
+	}
+	if data != nil && !chunker.VerifyChunkHash(data, chunkMeta.Hash) {
+		logging.FromContext(ctx).Warn("cached chunk failed hash verification", "hash", chunkMeta.Hash)
+		data = nil
+	}
+
+	metrics.RecordCacheLookup(ctx, "chunk_data", data != nil)
+	return data
+}
+
+// streamChunks writes chunks to w in order as they arrive, keeping up to
+// ReadAheadChunks downloads running ahead of the chunk being written.
+// writeHeaders is called with the first chunk just before it is written, so a
+// failure on the first chunk can still be reported with an error status;
+// started reports whether it was called.
+func (rh *ReadHandler) streamChunks(ctx context.Context, w io.Writer, file *models.File, chunkMetadata []*models.Chunk, writeHeaders func(first []byte)) (started bool, err error) {
+	window := min(rh.opts.ReadAheadChunks+1, rh.downloadConcurrency(chunkMetadata))
+
+	ctx, span := tracer.Start(ctx, "stream_chunks",
+		trace.WithAttributes(
+			attribute.Int("chunk_count", len(chunkMetadata)),
+			attribute.Int("read_ahead", window-1),
+		),
+	)
+	defer span.End()
+
+	// Cancelling stops the prefetcher if the client goes away or a chunk fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	// Results go through a ring of window slots rather than one channel per
+	// chunk, so bookkeeping stays bounded however many chunks the file has.
+	// Chunk i uses slot i % window, which is free again once chunk i-window
+	// has been written.
+	results := make([]chan result, window)
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	// A slot is held from the start of a download until its chunk is written
+	sem := make(chan struct{}, window)
+
+	var checksum hash.Hash
+	if file.Checksum != "" {
+		checksum = sha256.New()
+	}
+
+	go func() {
+		for i, meta := range chunkMetadata {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
 				return
 			}
+			go func(idx int, chunkMeta *models.Chunk) {
+				data, err := rh.fetchChunk(ctx, file, idx, chunkMeta)
+				results[idx%window] <- result{data: data, err: err}
+			}(i, meta)
+		}
+	}()
 
-			// Verify hash (optional but good practice)
-			if !chunker.VerifyChunkHash(data, chunkMeta.Hash) {
-				err := fmt.Errorf("hash mismatch for chunk %d", idx)
-				chunkSpan.RecordError(err)
-				errChan <- err
-				return
+	for i := range chunkMetadata {
+		var res result
+		select {
+		case res = <-results[i%window]:
+		case <-ctx.Done():
+			return started, ctx.Err()
+		}
+		if res.err != nil {
+			span.RecordError(res.err)
+			return started, res.err
+		}
+
+		// Verify before the last chunk goes out, so a mismatch leaves the
+		// response short rather than looking complete
+		if checksum != nil {
+			checksum.Write(res.data)
+			if i == len(chunkMetadata)-1 {
+				if err := verifyChecksum(file, checksum); err != nil {
+					span.RecordError(err)
+					return started, err
+				}
 			}
+		}
 
-			// Store in ordered slice
-			chunkData[idx] = data
-			chunkSpan.SetAttributes(attribute.Bool("download_success", true))
+		if !started {
+			writeHeaders(res.data)
+			started = true
+		}
+		if _, err := w.Write(res.data); err != nil {
+			span.RecordError(err)
+			return started, fmt.Errorf("failed to write chunk %d: %w", i, err)
+		}
+		<-sem
+	}
 
-		}(i, meta)
+	// Empty files have no chunks to trigger the headers
+	if !started {
+		writeHeaders(nil)
+		started = true
 	}
+	return started, nil
+}
 
-	// Wait for all goroutines to complete
-	wg.Wait()
-	close(errChan)
+// gzipsResponse reports whether a read of file may be gzipped for clients
+// that accept it
+func (rh *ReadHandler) gzipsResponse(file *models.File, encoding string) bool {
+	return rh.opts.GzipResponses && encoding == "" && file.Size >= rh.opts.GzipMinSize
+}
 
-	// Check for errors
-	if len(errChan) > 0 {
-		err := <-errChan
-		fetchSpan.RecordError(err)
-		return nil, err
+// acceptsGzip reports whether the client's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(coding, "gzip") && coding != "*" {
+			continue
+		}
+		// "q=0" explicitly refuses the coding
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err != nil || weight > 0
 	}
+	return false
+}
 
-	fetchSpan.SetAttributes(attribute.Bool("all_chunks_fetched", true))
-	return chunkData, nil
+// responseContentType returns the content type to serve. With
+// SniffContentType, a generic stored type is replaced by the type detected
+// from the start of the file.
+func (rh *ReadHandler) responseContentType(span trace.Span, stored string, first []byte) string {
+	if !rh.opts.SniffContentType || len(first) == 0 {
+		return stored
+	}
+	if stored != "" && stored != defaultContentType {
+		return stored
+	}
+
+	sniffed := http.DetectContentType(first)
+	span.SetAttributes(attribute.String("sniffed_content_type", sniffed))
+	return sniffed
+}
+
+// downloadConcurrency derives how many chunks may be downloaded at once from
+// the memory budget and the file's largest chunk, so files with big chunks
+// automatically use fewer parallel downloads, capped at ReadConcurrency. It
+// is never less than 1.
+func (rh *ReadHandler) downloadConcurrency(chunkMetadata []*models.Chunk) int {
+	var maxChunkSize int64
+	for _, chunk := range chunkMetadata {
+		maxChunkSize = max(maxChunkSize, chunk.Size)
+	}
+	if maxChunkSize == 0 || rh.opts.MaxDownloadMemory <= 0 {
+		return 1
+	}
+
+	concurrency := max(1, rh.opts.MaxDownloadMemory/maxChunkSize)
+	if rh.opts.ReadConcurrency > 0 {
+		concurrency = min(concurrency, int64(rh.opts.ReadConcurrency))
+	}
+	return int(concurrency)
+}
+
+// downloadChunk downloads a chunk, retrying "not found" errors with backoff
+// while the file is young enough that the object may still be propagating
+// through an eventually consistent store
+func (rh *ReadHandler) downloadChunk(ctx context.Context, span trace.Span, file *models.File, chunkMeta *models.Chunk) ([]byte, error) {
+	backoff := rh.opts.ReadAfterWriteBackoff
+	for attempt := 0; ; attempt++ {
+		data, err := rh.minioClient.DownloadChunk(ctx, chunkMeta.MinioObjectKey)
+		if err == nil || !errors.Is(err, storage.ErrChunkNotFound) {
+			return data, err
+		}
+
+		if attempt >= rh.opts.ReadAfterWriteRetries || time.Since(file.CreatedAt) > rh.opts.ReadAfterWriteWindow {
+			return nil, err
+		}
+
+		span.AddEvent("chunk_not_found_retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt+1),
+			attribute.Int64("backoff_ms", backoff.Milliseconds()),
+		))
+		span.SetAttributes(attribute.Int("not_found_retries", attempt+1))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// validateChunks checks that the chunk list matches the file row before any
+// data is fetched: the count matches chunk_count, order indices run 0..n-1
+// without gaps, and the sizes add up to the file size. An empty file (no
+// chunks, size 0) is valid and simply reads back as an empty body.
+func validateChunks(file *models.File, chunks []*models.Chunk) error {
+	if file.ChunkCount == 0 && file.Size == 0 && len(chunks) == 0 {
+		return nil
+	}
+
+	if len(chunks) != file.ChunkCount {
+		return fmt.Errorf("expected %d chunks, found %d", file.ChunkCount, len(chunks))
+	}
+
+	var totalSize int64
+	for i, chunk := range chunks {
+		if chunk.OrderIndex != i {
+			return fmt.Errorf("chunk %d is missing (found order_index %d)", i, chunk.OrderIndex)
+		}
+		totalSize += chunk.Size
+	}
+
+	if totalSize != file.Size {
+		return fmt.Errorf("chunk sizes add up to %d bytes, expected %d", totalSize, file.Size)
+	}
+	return nil
 }
 
-func (rh *ReadHandler) reassembleFile(ctx context.Context, chunkData [][]byte) []byte {
-	ctx, span := tracer.Start(ctx, "reassemble_chunks",
+// writeTransformed pipes chunks in order through the transformer into the
+// response, one chunk at a time
+func (rh *ReadHandler) writeTransformed(ctx context.Context, w io.Writer, transformer transform.Transformer, chunkData [][]byte) error {
+	_, span := tracer.Start(ctx, "transform_response",
 		trace.WithAttributes(
 			attribute.Int("chunk_count", len(chunkData)),
 		),
 	)
 	defer span.End()
 
-	return chunker.ReassembleChunks(chunkData)
+	tw, err := transformer.Wrap(w)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to start transform: %w", err)
+	}
+
+	for _, data := range chunkData {
+		if _, err := tw.Write(data); err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("failed to write transformed data: %w", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to finish transform: %w", err)
+	}
+	return nil
+}
+
+// writeChunks writes fetched chunks to w in order
+func (rh *ReadHandler) writeChunks(ctx context.Context, w io.Writer, chunkData [][]byte) error {
+	_, span := tracer.Start(ctx, "write_chunks",
+		trace.WithAttributes(
+			attribute.Int("chunk_count", len(chunkData)),
+		),
+	)
+	defer span.End()
+
+	if _, err := chunker.ReassembleTo(w, chunkData); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/maneesh/labdropbox/internal/models"
+)
+
+func TestValidateChunks(t *testing.T) {
+	chunks := func(sizes ...int64) []*models.Chunk {
+		out := make([]*models.Chunk, len(sizes))
+		for i, size := range sizes {
+			out[i] = &models.Chunk{OrderIndex: i, Size: size}
+		}
+		return out
+	}
+	reordered := chunks(10, 20)
+	reordered[0].OrderIndex, reordered[1].OrderIndex = 1, 0
+	gap := chunks(10, 20)
+	gap[1].OrderIndex = 2
+
+	tests := []struct {
+		name    string
+		file    *models.File
+		chunks  []*models.Chunk
+		wantErr bool
+	}{
+		{"empty file", &models.File{}, nil, false},
+		{"empty file with empty list", &models.File{}, []*models.Chunk{}, false},
+		{"matching chunks", &models.File{ChunkCount: 2, Size: 30}, chunks(10, 20), false},
+
+		{"empty file with a chunk", &models.File{}, chunks(10), true},
+		{"empty file with an empty chunk", &models.File{}, chunks(0), true},
+		{"missing all chunks", &models.File{ChunkCount: 2, Size: 30}, nil, true},
+		{"too few chunks", &models.File{ChunkCount: 2, Size: 30}, chunks(30), true},
+		{"too many chunks", &models.File{ChunkCount: 2, Size: 30}, chunks(10, 10, 10), true},
+		{"size mismatch", &models.File{ChunkCount: 2, Size: 31}, chunks(10, 20), true},
+		{"nonzero size without chunks", &models.File{Size: 10}, nil, true},
+		{"out of order", &models.File{ChunkCount: 2, Size: 30}, reordered, true},
+		{"gap in order", &models.File{ChunkCount: 2, Size: 30}, gap, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateChunks(tt.file, tt.chunks)
+			if tt.wantErr && err == nil {
+				t.Fatal("validateChunks succeeded, want error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("validateChunks: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/metrics"
+	"github.com/maneesh/labdropbox/internal/models"
+	"github.com/maneesh/labdropbox/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultRecentLimit = 10
+	maxRecentLimit     = 100
+)
+
+// RecentResponse is the body of GET /files/recent
+type RecentResponse struct {
+	Files []*models.File `json:"files"`
+}
+
+// RecentHandler serves the most recently uploaded files
+type RecentHandler struct {
+	tidbClient  *storage.TiDBClient
+	redisClient *storage.RedisClient
+	cacheTTL    time.Duration
+}
+
+// NewRecentHandler creates a new recent files handler
+func NewRecentHandler(
+	tidbClient *storage.TiDBClient,
+	redisClient *storage.RedisClient,
+	cacheTTL time.Duration,
+) *RecentHandler {
+	return &RecentHandler{
+		tidbClient:  tidbClient,
+		redisClient: redisClient,
+		cacheTTL:    cacheTTL,
+	}
+}
+
+// ServeHTTP handles GET /files/recent?limit=N
+func (rh *RecentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "recent_files",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	limit := defaultRecentLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			http.Error(w, "'limit' must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, maxRecentLimit)
+	}
+	span.SetAttributes(attribute.Int("limit", limit))
+
+	// The feed is read often and changes slowly, so serve it from cache
+	files, err := rh.redisClient.GetRecentFiles(ctx, limit)
+	if err != nil {
+		logging.FromContext(ctx).Warn("failed to read recent files from cache", "error", err)
+	}
+	metrics.RecordCacheLookup(ctx, "recent_files", files != nil)
+
+	if files == nil {
+		files, err = rh.tidbClient.ListRecentFiles(ctx, limit)
+		if err != nil {
+			span.RecordError(err)
+			http.Error(w, fmt.Sprintf("failed to list recent files: %v", err), errorStatus(err))
+			return
+		}
+		if files == nil {
+			files = []*models.File{}
+		}
+
+		if err := rh.redisClient.SetRecentFiles(ctx, limit, files, rh.cacheTTL); err != nil {
+			logging.FromContext(ctx).Warn("failed to cache recent files", "error", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(RecentResponse{Files: files})
+}
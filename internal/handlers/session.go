@@ -0,0 +1,495 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/maneesh/labdropbox/internal/chunker"
+	"github.com/maneesh/labdropbox/internal/crypto"
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/metrics"
+	"github.com/maneesh/labdropbox/internal/models"
+	"github.com/maneesh/labdropbox/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errSessionIncomplete is returned when completing a session that is still
+// missing chunks
+var errSessionIncomplete = errors.New("upload session is missing chunks")
+
+// errChunkConflict is returned when a chunk index already received holds
+// different content
+var errChunkConflict = errors.New("chunk index was already uploaded with a different hash")
+
+// maxListedMissing caps the missing indices named in an error message
+const maxListedMissing = 10
+
+// SessionOptions tunes resumable upload sessions
+type SessionOptions struct {
+	// IdleTimeout is how long a session survives without activity before
+	// CleanIdle purges it and its chunks
+	IdleTimeout time.Duration
+
+	// MaxChunks is the most chunks a session may declare
+	MaxChunks int
+
+	// MaxPerClient caps the open sessions per client address (0 is unlimited)
+	MaxPerClient int
+}
+
+// SessionHandler serves resumable uploads: a session is created with its
+// chunk count, chunks are uploaded individually and retried as needed, and
+// completing the session saves the file
+type SessionHandler struct {
+	writeHandler *WriteHandler
+	opts         SessionOptions
+}
+
+// NewSessionHandler creates a new session handler that stores chunks through
+// the write handler
+func NewSessionHandler(writeHandler *WriteHandler, opts SessionOptions) *SessionHandler {
+	return &SessionHandler{
+		writeHandler: writeHandler,
+		opts:         opts,
+	}
+}
+
+// SessionStatus describes an upload session and which chunks it still needs
+type SessionStatus struct {
+	*models.UploadSession
+	Received []int `json:"received"`
+	Missing  []int `json:"missing"`
+}
+
+// SessionChunkResponse is returned for an uploaded chunk
+type SessionChunkResponse struct {
+	UploadID string `json:"upload_id"`
+	Index    int    `json:"index"`
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size"`
+	Message  string `json:"message"`
+}
+
+// Create handles POST /uploads?name=filename&chunk_count=n
+func (sh *SessionHandler) Create(w http.ResponseWriter, r *http.Request) {
+	wh := sh.writeHandler
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "create_upload_session",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	filename, err := fileName(r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	chunkCount, err := strconv.Atoi(r.URL.Query().Get("chunk_count"))
+	if err != nil || chunkCount < 1 || chunkCount > sh.opts.MaxChunks {
+		http.Error(w, fmt.Sprintf("'chunk_count' must be an integer from 1 to %d", sh.opts.MaxChunks), http.StatusBadRequest)
+		return
+	}
+
+	session := &models.UploadSession{
+		ID:         uuid.New().String(),
+		FileID:     uuid.New().String(),
+		Name:       filename,
+		ChunkCount: chunkCount,
+		Encrypted:  wh.opts.Cipher != nil,
+		Client:     clientAddr(r),
+		CreatedAt:  time.Now(),
+	}
+	span.SetAttributes(
+		attribute.String("upload_id", session.ID),
+		attribute.String("file_id", session.FileID),
+		attribute.Int("chunk_count", chunkCount),
+	)
+
+	if err := wh.redisClient.CreateUploadSession(ctx, session, sh.opts.IdleTimeout, sh.opts.MaxPerClient); err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to create upload session: %v", err), errorStatus(err))
+		return
+	}
+
+	logging.FromContext(ctx).Info("upload session created", "file_name", filename, "upload_id", session.ID, "chunk_count", chunkCount)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sh.status(session))
+}
+
+// Status handles GET /uploads/{upload_id}
+func (sh *SessionHandler) Status(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "get_upload_session",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	session, err := sh.writeHandler.redisClient.GetUploadSession(ctx, mux.Vars(r)["upload_id"])
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to get upload session: %v", err), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sh.status(session))
+}
+
+// PutChunk handles PUT /uploads/{upload_id}/chunks/{index}?hash=sha256. The
+// body is the chunk's bytes, checked against hash. Re-uploading a received
+// index with the same hash succeeds without storing it again; a different
+// hash is rejected with 409.
+func (sh *SessionHandler) PutChunk(w http.ResponseWriter, r *http.Request) {
+	defer metrics.StartWrite()()
+
+	wh := sh.writeHandler
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "put_session_chunk",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	vars := mux.Vars(r)
+	span.SetAttributes(attribute.String("upload_id", vars["upload_id"]))
+
+	session, err := wh.redisClient.GetUploadSession(ctx, vars["upload_id"])
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to get upload session: %v", err), errorStatus(err))
+		return
+	}
+
+	index, err := strconv.Atoi(vars["index"])
+	if err != nil || index < 0 || index >= session.ChunkCount {
+		http.Error(w, fmt.Sprintf("chunk index must be from 0 to %d", session.ChunkCount-1), http.StatusBadRequest)
+		return
+	}
+	hash := strings.ToLower(r.URL.Query().Get("hash"))
+	if hash == "" {
+		http.Error(w, "missing 'hash' query parameter", http.StatusBadRequest)
+		return
+	}
+	span.SetAttributes(
+		attribute.String("file_id", session.FileID),
+		attribute.Int("chunk_index", index),
+	)
+
+	// A retry of a chunk already received needs no upload
+	if recorded, ok := session.Chunks[index]; ok {
+		sh.respondRecorded(w, session, recorded, hash)
+		return
+	}
+
+	// The chunk may fill whatever room the file has left
+	limit := chunker.MaxChunkSize
+	if wh.opts.MaxFileSize > 0 {
+		limit = min(limit, max(0, wh.opts.MaxFileSize-receivedBytes(session)))
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to read chunk: %v", err), errorStatus(err))
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "chunk body must not be empty", http.StatusBadRequest)
+		return
+	}
+	if !chunker.VerifyChunkHash(data, hash) {
+		http.Error(w, fmt.Sprintf("chunk body does not match hash %s", hash), http.StatusBadRequest)
+		return
+	}
+
+	if session.Encrypted && wh.opts.Cipher == nil {
+		span.RecordError(errNoEncryptionKey)
+		http.Error(w, errNoEncryptionKey.Error(), errorStatus(errNoEncryptionKey))
+		return
+	}
+
+	// Objects get the chunk ID in their key, so a concurrent upload of the
+	// same index can't overwrite ours before one of them is recorded
+	target := sessionTarget(session)
+	chunk, err := wh.uploadChunk(ctx, target, &models.ChunkData{
+		Data:       data,
+		OrderIndex: index,
+		Hash:       hash,
+		Size:       int64(len(data)),
+	})
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to upload chunk: %v", err), errorStatus(err))
+		return
+	}
+
+	recorded, err := wh.redisClient.AddSessionChunk(ctx, session, chunk, sh.opts.IdleTimeout)
+	if err != nil || recorded != nil {
+		wh.deleteChunks(ctx, target, []*models.Chunk{chunk})
+	}
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to record chunk: %v", err), errorStatus(err))
+		return
+	}
+	if recorded != nil {
+		// A concurrent upload of this index was recorded first
+		sh.respondRecorded(w, session, recorded, hash)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(SessionChunkResponse{
+		UploadID: session.ID,
+		Index:    index,
+		Hash:     hash,
+		Size:     chunk.Size,
+		Message:  "Chunk uploaded successfully",
+	})
+}
+
+// respondRecorded answers the upload of an index that was already received
+func (sh *SessionHandler) respondRecorded(w http.ResponseWriter, session *models.UploadSession, recorded *models.Chunk, hash string) {
+	if recorded.Hash != hash {
+		err := fmt.Errorf("%w: chunk %d has hash %s", errChunkConflict, recorded.OrderIndex, recorded.Hash)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SessionChunkResponse{
+		UploadID: session.ID,
+		Index:    recorded.OrderIndex,
+		Hash:     recorded.Hash,
+		Size:     recorded.Size,
+		Message:  "Chunk already uploaded",
+	})
+}
+
+// Complete handles POST /uploads/{upload_id}/complete, saving the file once
+// every chunk has been received
+func (sh *SessionHandler) Complete(w http.ResponseWriter, r *http.Request) {
+	defer metrics.StartWrite()()
+
+	wh := sh.writeHandler
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "complete_upload_session",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	session, err := wh.redisClient.GetUploadSession(ctx, mux.Vars(r)["upload_id"])
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to get upload session: %v", err), errorStatus(err))
+		return
+	}
+	span.SetAttributes(
+		attribute.String("upload_id", session.ID),
+		attribute.String("file_id", session.FileID),
+	)
+	ctx = logging.With(ctx, "file_id", session.FileID)
+
+	if missing := missingChunks(session); len(missing) > 0 {
+		listed := missing
+		if len(listed) > maxListedMissing {
+			listed = listed[:maxListedMissing]
+		}
+		err := fmt.Errorf("%w: %d of %d not received, starting with %v", errSessionIncomplete, len(missing), session.ChunkCount, listed)
+		span.RecordError(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// Keep the cleaner away while the file is being saved
+	if err := wh.redisClient.TouchUploadSession(ctx, session, sh.opts.IdleTimeout); err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to complete upload session: %v", err), errorStatus(err))
+		return
+	}
+
+	chunkModels := make([]*models.Chunk, 0, session.ChunkCount)
+	for index := 0; index < session.ChunkCount; index++ {
+		chunkModels = append(chunkModels, session.Chunks[index])
+	}
+
+	// Concurrent chunk uploads each check the limit against what was
+	// received before them, so together they may overshoot it
+	totalSize := receivedBytes(session)
+	span.SetAttributes(
+		attribute.Int64("file_size", totalSize),
+		attribute.Int64("max_file_size", wh.opts.MaxFileSize),
+	)
+	if wh.opts.MaxFileSize > 0 && totalSize > wh.opts.MaxFileSize {
+		err := fmt.Errorf("file is %d bytes: %w", totalSize, &http.MaxBytesError{Limit: wh.opts.MaxFileSize})
+		span.RecordError(err)
+		recordSizeLimit(span, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	file := &models.File{
+		ID:         session.FileID,
+		Name:       session.Name,
+		Size:       totalSize,
+		ChunkCount: len(chunkModels),
+		CreatedAt:  time.Now(),
+
+		ChunkingStrategy: chunker.StrategyClient,
+	}
+	if session.Encrypted {
+		file.Metadata = map[string]any{models.MetadataEncryption: crypto.Algorithm}
+	}
+
+	if err := wh.saveMetadata(ctx, file, chunkModels); err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to save metadata: %v", err), errorStatus(err))
+		return
+	}
+	// The session held its chunks' claims until now, so a failed complete
+	// can be retried
+	wh.releaseChunks(ctx, sessionTarget(session), chunkModels)
+
+	if err := wh.redisClient.DeleteUploadSession(ctx, session.ID, session.Client); err != nil {
+		logging.FromContext(ctx).Warn("failed to delete upload session", "error", err)
+	}
+	if err := wh.invalidateCache(ctx, file.ID); err != nil {
+		logging.FromContext(ctx).Warn("failed to invalidate cache", "error", err)
+	}
+	if wh.opts.CacheChunks {
+		if err := wh.redisClient.SetChunks(ctx, file.ID, chunkModels); err != nil {
+			logging.FromContext(ctx).Warn("failed to cache chunk list", "error", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(WriteResponse{
+		FileID:     file.ID,
+		FileName:   file.Name,
+		FileSize:   totalSize,
+		ChunkCount: len(chunkModels),
+		Message:    "File uploaded successfully",
+	})
+
+	metrics.RecordFileUpload(ctx, totalSize)
+	logging.FromContext(ctx).Info("upload session completed", "file_name", file.Name)
+}
+
+// CleanIdle deletes sessions idle for longer than IdleTimeout along with the
+// chunk objects they uploaded, returning how many sessions were purged.
+// Sessions whose file was saved keep their chunks.
+func (sh *SessionHandler) CleanIdle(ctx context.Context) (int, error) {
+	wh := sh.writeHandler
+	ctx, span := tracer.Start(ctx, "clean_idle_upload_sessions")
+	defer span.End()
+
+	ids, err := wh.redisClient.IdleUploadSessions(ctx, sh.opts.IdleTimeout)
+	if err != nil {
+		span.RecordError(err)
+		return 0, err
+	}
+
+	purged := 0
+	for _, id := range ids {
+		session, err := wh.redisClient.GetUploadSession(ctx, id)
+		client := ""
+		switch {
+		case err == nil:
+			client = session.Client
+
+			// A completed session whose removal failed belongs to a saved
+			// file, which now owns its chunks; only the session goes
+			_, err := wh.tidbClient.GetFile(ctx, session.FileID)
+			if err == nil {
+				break
+			} else if !errors.Is(err, storage.ErrFileNotFound) {
+				span.RecordError(err)
+				return purged, err
+			}
+
+			chunks := make([]*models.Chunk, 0, len(session.Chunks))
+			for _, chunk := range session.Chunks {
+				chunks = append(chunks, chunk)
+			}
+			wh.deleteChunks(ctx, sessionTarget(session), chunks)
+		case !errors.Is(err, storage.ErrSessionNotFound):
+			span.RecordError(err)
+			return purged, err
+		}
+
+		if err := wh.redisClient.DeleteUploadSession(ctx, id, client); err != nil {
+			span.RecordError(err)
+			return purged, err
+		}
+		purged++
+	}
+
+	span.SetAttributes(attribute.Int("sessions_purged", purged))
+	return purged, nil
+}
+
+// status summarizes a session's received and missing chunks
+func (sh *SessionHandler) status(session *models.UploadSession) SessionStatus {
+	received := make([]int, 0, len(session.Chunks))
+	for index := range session.Chunks {
+		received = append(received, index)
+	}
+	sort.Ints(received)
+
+	return SessionStatus{
+		UploadSession: session,
+		Received:      received,
+		Missing:       missingChunks(session),
+	}
+}
+
+// sessionTarget returns where a session's chunks are uploaded
+func sessionTarget(session *models.UploadSession) uploadTarget {
+	return uploadTarget{
+		fileID:     session.FileID,
+		encrypt:    session.Encrypted,
+		uniqueKeys: true,
+	}
+}
+
+// missingChunks returns the indices a session hasn't received, in order
+func missingChunks(session *models.UploadSession) []int {
+	missing := []int{}
+	for index := 0; index < session.ChunkCount; index++ {
+		if _, ok := session.Chunks[index]; !ok {
+			missing = append(missing, index)
+		}
+	}
+	return missing
+}
+
+// receivedBytes returns the total size of the chunks a session has received
+func receivedBytes(session *models.UploadSession) int64 {
+	var total int64
+	for _, chunk := range session.Chunks {
+		total += chunk.Size
+	}
+	return total
+}
+
+// clientAddr identifies a request's client by its remote IP
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/metrics"
+	"github.com/maneesh/labdropbox/internal/models"
+	"github.com/maneesh/labdropbox/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxStatBatch caps the number of file IDs per stat request
+const maxStatBatch = 100
+
+// StatResponse is the body of POST /files/stat. Every requested ID is a key;
+// missing files map to null.
+type StatResponse struct {
+	Files map[string]*models.File `json:"files"`
+}
+
+// StatHandler returns metadata for a batch of files
+type StatHandler struct {
+	tidbClient  *storage.TiDBClient
+	redisClient *storage.RedisClient
+}
+
+// NewStatHandler creates a new batch stat handler
+func NewStatHandler(
+	tidbClient *storage.TiDBClient,
+	redisClient *storage.RedisClient,
+) *StatHandler {
+	return &StatHandler{
+		tidbClient:  tidbClient,
+		redisClient: redisClient,
+	}
+}
+
+// ServeHTTP handles POST /files/stat with a JSON array of file IDs
+func (sh *StatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "stat_files",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	var fileIDs []string
+	if err := json.NewDecoder(r.Body).Decode(&fileIDs); err != nil {
+		http.Error(w, fmt.Sprintf("request body must be a JSON array of file IDs: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(fileIDs) > maxStatBatch {
+		http.Error(w, fmt.Sprintf("at most %d file IDs per request", maxStatBatch), http.StatusBadRequest)
+		return
+	}
+
+	response := StatResponse{Files: make(map[string]*models.File, len(fileIDs))}
+	for _, id := range fileIDs {
+		response.Files[id] = nil
+	}
+	span.SetAttributes(attribute.Int("file_count", len(response.Files)))
+
+	// Cache first; a cache failure just means everything comes from TiDB
+	cached, err := sh.redisClient.GetFilesMetadata(ctx, fileIDs)
+	if err != nil {
+		logging.FromContext(ctx).Warn("failed to read cache", "error", err)
+	}
+
+	var misses []string
+	for id := range response.Files {
+		file, ok := cached[id]
+		metrics.RecordCacheLookup(ctx, "file_metadata", ok)
+		if ok {
+			response.Files[id] = file
+		} else {
+			misses = append(misses, id)
+		}
+	}
+	span.SetAttributes(attribute.Int("cache_hits", len(response.Files)-len(misses)))
+
+	if len(misses) > 0 {
+		found, err := sh.tidbClient.GetFiles(ctx, misses)
+		if err != nil {
+			span.RecordError(err)
+			http.Error(w, fmt.Sprintf("failed to get file metadata: %v", err), errorStatus(err))
+			return
+		}
+
+		for id, file := range found {
+			response.Files[id] = file
+			if file.Status == models.FileStatusPending {
+				continue
+			}
+			if err := sh.redisClient.SetFileMetadata(ctx, id, file); err != nil {
+				logging.FromContext(ctx).Warn("failed to update cache", "error", err)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
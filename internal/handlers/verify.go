@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/maneesh/labdropbox/internal/chunker"
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/models"
+	"github.com/maneesh/labdropbox/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+)
+
+// VerifyResponse is the body of POST /files/{file_id}/verify. Missing and
+// Corrupted hold chunk order indices.
+type VerifyResponse struct {
+	FileID     string `json:"file_id"`
+	ChunkCount int    `json:"chunk_count"`
+	Healthy    bool   `json:"healthy"`
+	Missing    []int  `json:"missing"`
+	Corrupted  []int  `json:"corrupted"`
+}
+
+// chunkState is the outcome of verifying one chunk
+type chunkState int
+
+const (
+	chunkOK chunkState = iota
+	chunkMissing
+	chunkCorrupted
+)
+
+// VerifyHandler checks that every chunk of a file is still stored in MinIO
+// and matches its recorded hash
+type VerifyHandler struct {
+	readHandler *ReadHandler
+}
+
+// NewVerifyHandler creates a new verify handler that reuses the read
+// handler's metadata lookups and chunk decoding
+func NewVerifyHandler(readHandler *ReadHandler) *VerifyHandler {
+	return &VerifyHandler{
+		readHandler: readHandler,
+	}
+}
+
+// ServeHTTP handles POST /files/{file_id}/verify. Metadata is always read
+// from TiDB, since a stale cached chunk list would check the wrong objects.
+func (vh *VerifyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh := vh.readHandler
+	ctx := r.Context()
+	ctx, span := tracer.Start(ctx, "file_verify",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	fileID := mux.Vars(r)["file_id"]
+	span.SetAttributes(attribute.String("file_id", fileID))
+
+	file, err := rh.getFileMetadata(ctx, fileID, true)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to get file metadata: %v", err), errorStatus(err))
+		return
+	}
+
+	chunks, err := rh.getChunkMetadata(ctx, file, true)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to get chunk metadata: %v", err), errorStatus(err))
+		return
+	}
+	span.SetAttributes(attribute.Int("chunk_count", len(chunks)))
+
+	states, err := vh.verifyChunks(ctx, file, chunks)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("failed to verify chunks: %v", err), errorStatus(err))
+		return
+	}
+
+	resp := VerifyResponse{
+		FileID:     file.ID,
+		ChunkCount: len(chunks),
+		Missing:    []int{},
+		Corrupted:  []int{},
+	}
+	for i, state := range states {
+		switch state {
+		case chunkMissing:
+			resp.Missing = append(resp.Missing, chunks[i].OrderIndex)
+		case chunkCorrupted:
+			resp.Corrupted = append(resp.Corrupted, chunks[i].OrderIndex)
+		}
+	}
+	resp.Healthy = len(resp.Missing) == 0 && len(resp.Corrupted) == 0
+
+	span.SetAttributes(
+		attribute.Int("missing_chunks", len(resp.Missing)),
+		attribute.Int("corrupted_chunks", len(resp.Corrupted)),
+		attribute.Bool("healthy", resp.Healthy),
+	)
+	if !resp.Healthy {
+		logging.FromContext(ctx).Warn("file failed verification",
+			"missing", resp.Missing, "corrupted", resp.Corrupted)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// verifyChunks checks chunks in parallel, as many at a time as a read of the
+// file would download. Any failure other than a missing or corrupted chunk,
+// such as MinIO being unreachable, aborts the scan.
+func (vh *VerifyHandler) verifyChunks(ctx context.Context, file *models.File, chunks []*models.Chunk) ([]chunkState, error) {
+	rh := vh.readHandler
+	concurrency := rh.downloadConcurrency(chunks)
+
+	states := make([]chunkState, len(chunks))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i, meta := range chunks {
+		if gctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			state, err := vh.verifyChunk(gctx, file, meta)
+			if err != nil {
+				return err
+			}
+			states[i] = state
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// verifyChunk checks one chunk in its own span: that its object exists, and
+// that its decoded bytes match the stored hash
+func (vh *VerifyHandler) verifyChunk(ctx context.Context, file *models.File, chunkMeta *models.Chunk) (chunkState, error) {
+	rh := vh.readHandler
+	ctx, span := tracer.Start(ctx, fmt.Sprintf("verify_chunk_%d", chunkMeta.OrderIndex),
+		trace.WithAttributes(
+			attribute.Int("chunk_index", chunkMeta.OrderIndex),
+			attribute.String("object_key", chunkMeta.MinioObjectKey),
+			attribute.Int64("chunk_size", chunkMeta.Size),
+		),
+	)
+	defer span.End()
+
+	exists, err := rh.minioClient.ChunkExists(ctx, chunkMeta.MinioObjectKey)
+	if err != nil {
+		span.RecordError(err)
+		return chunkOK, fmt.Errorf("chunk %d (%s): %w", chunkMeta.OrderIndex, chunkMeta.MinioObjectKey, err)
+	}
+	if !exists {
+		span.SetAttributes(attribute.String("chunk_state", "missing"))
+		return chunkMissing, nil
+	}
+
+	data, err := rh.minioClient.DownloadChunk(ctx, chunkMeta.MinioObjectKey)
+	if errors.Is(err, storage.ErrChunkNotFound) {
+		// Deleted between the stat and the download
+		span.SetAttributes(attribute.String("chunk_state", "missing"))
+		return chunkMissing, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		return chunkOK, fmt.Errorf("chunk %d (%s): %w", chunkMeta.OrderIndex, chunkMeta.MinioObjectKey, err)
+	}
+
+	// The stored hash is of the original bytes. Chunks that fail to decrypt
+	// or decompress count as corrupted, but without a key to decrypt with
+	// nothing can be checked.
+	if decode := rh.chunkDecoder(file, chunkMeta); decode != nil {
+		if data, err = decode(data); errors.Is(err, errNoEncryptionKey) {
+			span.RecordError(err)
+			return chunkOK, err
+		} else if err != nil {
+			span.RecordError(err)
+			span.SetAttributes(attribute.String("chunk_state", "corrupted"))
+			return chunkCorrupted, nil
+		}
+	}
+	if !chunker.VerifyChunkHash(data, chunkMeta.Hash) {
+		span.SetAttributes(attribute.String("chunk_state", "corrupted"))
+		return chunkCorrupted, nil
+	}
+
+	span.SetAttributes(attribute.String("chunk_state", "ok"))
+	return chunkOK, nil
+}
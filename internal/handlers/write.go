@@ -2,30 +2,93 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/maneesh/labdropbox/internal/chunker"
+	"github.com/maneesh/labdropbox/internal/compress"
+	"github.com/maneesh/labdropbox/internal/crypto"
+	"github.com/maneesh/labdropbox/internal/logging"
+	"github.com/maneesh/labdropbox/internal/metrics"
 	"github.com/maneesh/labdropbox/internal/models"
+	"github.com/maneesh/labdropbox/internal/progress"
 	"github.com/maneesh/labdropbox/internal/storage"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 )
 
 var tracer = otel.Tracer("labdropbox-handlers")
 
+// chunkTimeoutRetries is how many times a chunk upload that hit the per-chunk
+// timeout is retried before the write fails
+const chunkTimeoutRetries = 1
+
+// WriteOptions tunes the behavior of the write path
+type WriteOptions struct {
+	// UploadConcurrency is the number of parallel MinIO uploaders and the
+	// capacity of the channels between pipeline stages
+	UploadConcurrency int
+
+	// ChunkUploadTimeout bounds each chunk upload attempt independently of
+	// the request deadline (0 disables)
+	ChunkUploadTimeout time.Duration
+
+	// RetentionMode and RetentionDays are the default object-lock retention
+	// for uploads that don't specify one (empty mode disables)
+	RetentionMode string
+	RetentionDays int
+
+	// ChunkInsertBatchSize splits chunk rows into transactions of this many
+	// rows, ChunkInsertParallelism of them at a time, instead of a single
+	// transaction (0 disables). The file stays pending until every batch
+	// commits.
+	ChunkInsertBatchSize   int
+	ChunkInsertParallelism int
+
+	// ContentAddressed stores chunks under keys derived from their hash and
+	// skips uploading chunks that are already stored. Uploads with object-lock
+	// retention keep per-file keys, since a shared object has one lock.
+	ContentAddressed bool
+
+	// Compression compresses each chunk before upload (and encryption) with
+	// the named algorithm, keeping chunks it doesn't shrink uncompressed
+	Compression string
+
+	// Cipher, if set, encrypts new files' chunks before they are uploaded
+	Cipher *crypto.Cipher
+
+	// MaxFileSize is the largest file an upload may create, in bytes (0 is
+	// unlimited). Larger uploads are aborted with 413.
+	MaxFileSize int64
+
+	// CacheChunks caches a new file's chunk list in Redis right after its
+	// metadata is saved, so the first read skips the chunk query
+	CacheChunks bool
+}
+
 // WriteHandler handles file upload requests
 type WriteHandler struct {
 	minioClient *storage.MinioClient
 	tidbClient  *storage.TiDBClient
 	redisClient *storage.RedisClient
-	chunker     *chunker.Chunker
+	chunker     chunker.Splitter
+	progress    *progress.Registry
+	opts        WriteOptions
 }
 
 // NewWriteHandler creates a new write handler
@@ -33,16 +96,44 @@ func NewWriteHandler(
 	minioClient *storage.MinioClient,
 	tidbClient *storage.TiDBClient,
 	redisClient *storage.RedisClient,
-	chunker *chunker.Chunker,
+	chunker chunker.Splitter,
+	progress *progress.Registry,
+	opts WriteOptions,
 ) *WriteHandler {
+	if opts.UploadConcurrency < 1 {
+		opts.UploadConcurrency = 1
+	}
+
 	return &WriteHandler{
 		minioClient: minioClient,
 		tidbClient:  tidbClient,
 		redisClient: redisClient,
 		chunker:     chunker,
+		progress:    progress,
+		opts:        opts,
 	}
 }
 
+// uploadTarget describes where the chunks of one pipeline run belong
+type uploadTarget struct {
+	fileID     string
+	uploadID   string // progress key, empty if untracked
+	startIndex int    // first order_index, non-zero when appending
+	retention  *storage.Retention
+
+	// checksum, if set, is fed every byte of the body as it is read
+	checksum hash.Hash
+
+	// encrypt seals each chunk with the handler's cipher before upload. The
+	// chunk hash stays that of the plaintext.
+	encrypt bool
+
+	// uniqueKeys suffixes object keys with the chunk ID, for uploads whose
+	// plain keys could collide with another upload's objects (appends and
+	// client-chosen file IDs)
+	uniqueKeys bool
+}
+
 // WriteResponse represents the response for a write operation
 type WriteResponse struct {
 	FileID     string `json:"file_id"`
@@ -52,8 +143,10 @@ type WriteResponse struct {
 	Message    string `json:"message"`
 }
 
-// ServeHTTP handles PUT /write?name=filename
+// ServeHTTP handles PUT /write?name=filename[&id=uuid[&overwrite=true]][&upload_id=id][&content_hash=sha256][&retention_mode=mode&retention_days=n]
 func (wh *WriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer metrics.StartWrite()()
+
 	ctx := r.Context()
 	ctx, span := tracer.Start(ctx, "write_file",
 		trace.WithSpanKind(trace.SpanKindServer),
@@ -61,64 +154,197 @@ func (wh *WriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer span.End()
 
 	// Get filename from query parameter
-	filename := r.URL.Query().Get("name")
-	if filename == "" {
-		http.Error(w, "missing 'name' query parameter", http.StatusBadRequest)
+	filename, err := fileName(r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
 	span.SetAttributes(attribute.String("file_name", filename))
 
-	// Generate file ID
-	fileID := uuid.New().String()
-	span.SetAttributes(attribute.String("file_id", fileID))
+	// A retried upload of content that is already stored returns the
+	// existing file instead of creating a duplicate
+	contentHash, err := requestContentHash(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if contentHash != "" {
+		span.SetAttributes(attribute.String("content_hash", contentHash))
+		existing, err := wh.tidbClient.GetFileByChecksum(ctx, contentHash)
+		switch {
+		case err == nil:
+			span.SetAttributes(
+				attribute.Bool("existing_file", true),
+				attribute.String("file_id", existing.ID),
+			)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(WriteResponse{
+				FileID:     existing.ID,
+				FileName:   existing.Name,
+				FileSize:   existing.Size,
+				ChunkCount: existing.ChunkCount,
+				Message:    "File already exists",
+			})
+			return
+		case !errors.Is(err, storage.ErrFileNotFound):
+			span.RecordError(err)
+			http.Error(w, fmt.Sprintf("failed to look up content hash: %v", err), errorStatus(err))
+			return
+		}
+	}
+
+	// Use the client's file ID if given, otherwise generate one
+	overwrite, _ := strconv.ParseBool(r.URL.Query().Get("overwrite"))
+	fileID, clientID, replace, err := wh.resolveFileID(ctx, r.URL.Query().Get("id"), overwrite)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	span.SetAttributes(
+		attribute.String("file_id", fileID),
+		attribute.Bool("client_file_id", clientID),
+		attribute.Bool("replace", replace),
+	)
+	ctx = logging.With(ctx, "file_id", fileID)
 
-	// Step 1: Chunk the stream
-	log.Printf("Chunking file: %s (ID: %s)", filename, fileID)
-	chunks, totalSize, err := wh.chunkStream(ctx, r.Body)
+	retention, err := wh.parseRetention(r)
 	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// A gzip-encoded body is stored compressed as-is
+	encoding, err := requestEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// Optionally publish progress under a client-chosen upload ID
+	uploadID := r.URL.Query().Get("upload_id")
+	if uploadID != "" {
+		if err := wh.progress.Start(uploadID, fileID); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		span.SetAttributes(attribute.String("upload_id", uploadID))
+	}
+
+	var uploadErr error
+	defer func() { wh.progress.Finish(uploadID, uploadErr) }()
+
+	body := wh.limitBody(w, r.Body, 0)
+	span.SetAttributes(attribute.Int64("max_file_size", wh.opts.MaxFileSize))
+
+	// Without a usable Content-Type, the type is sniffed from the first
+	// bytes, unless they are stored encoded
+	contentType := requestContentType(r)
+	var sniffer *sniffReader
+	if contentType == "" && encoding == "" {
+		sniffer = &sniffReader{ReadCloser: body}
+		body = sniffer
+	}
+
+	// Step 1: Chunk, hash and upload the stream as overlapping pipeline stages
+	logging.FromContext(ctx).Info("chunking and uploading file", "file_name", filename)
+	checksum := sha256.New()
+	target := uploadTarget{
+		fileID:     fileID,
+		uploadID:   uploadID,
+		retention:  retention,
+		checksum:   checksum,
+		encrypt:    wh.opts.Cipher != nil,
+		uniqueKeys: clientID,
+	}
+	chunkModels, totalSize, err := wh.uploadPipeline(ctx, target, body)
+	if err != nil {
+		uploadErr = err
 		span.RecordError(err)
-		http.Error(w, fmt.Sprintf("failed to chunk file: %v", err), http.StatusInternalServerError)
+		recordSizeLimit(span, err)
+		http.Error(w, fmt.Sprintf("failed to upload file: %v", err), errorStatus(err))
 		return
 	}
 
 	span.SetAttributes(
 		attribute.Int64("file_size", totalSize),
-		attribute.Int("chunk_count", len(chunks)),
+		attribute.Int("chunk_count", len(chunkModels)),
 	)
 
-	log.Printf("File chunked: %d chunks, total size: %d bytes", len(chunks), totalSize)
+	logging.FromContext(ctx).Info("file uploaded", "chunk_count", len(chunkModels), "total_size", totalSize)
 
-	// Step 2: Upload chunks to MinIO
-	log.Printf("Uploading chunks to MinIO...")
-	chunkModels, err := wh.uploadChunks(ctx, fileID, chunks)
-	if err != nil {
-		span.RecordError(err)
-		http.Error(w, fmt.Sprintf("failed to upload chunks: %v", err), http.StatusInternalServerError)
+	sum := hex.EncodeToString(checksum.Sum(nil))
+	if contentHash != "" && sum != contentHash {
+		uploadErr = invalidRequest("body SHA256 %s does not match content hash %s", sum, contentHash)
+		span.RecordError(uploadErr)
+		wh.deleteChunks(ctx, target, chunkModels)
+		http.Error(w, uploadErr.Error(), errorStatus(uploadErr))
 		return
 	}
 
-	// Step 3: Save metadata to TiDB
-	log.Printf("Saving metadata to TiDB...")
+	// Step 2: Save metadata to TiDB
+	logging.FromContext(ctx).Info("saving metadata")
 	file := &models.File{
 		ID:         fileID,
 		Name:       filename,
 		Size:       totalSize,
-		ChunkCount: len(chunks),
+		ChunkCount: len(chunkModels),
 		CreatedAt:  time.Now(),
+
+		ChunkingStrategy: wh.chunker.Strategy(),
+		TargetChunkSize:  wh.chunker.ChunkSize(),
+
+		Checksum:    sum,
+		ContentType: contentType,
+	}
+	if sniffer != nil && len(sniffer.head) > 0 {
+		file.ContentType = http.DetectContentType(sniffer.head)
+	}
+	if file.ContentType == "" {
+		file.ContentType = defaultContentType
+	}
+	span.SetAttributes(attribute.String("content_type", file.ContentType))
+	if encoding != "" {
+		file.Metadata = map[string]any{models.MetadataContentEncoding: encoding}
+		span.SetAttributes(attribute.String("content_encoding", encoding))
+	}
+	if wh.opts.Cipher != nil {
+		if file.Metadata == nil {
+			file.Metadata = map[string]any{}
+		}
+		file.Metadata[models.MetadataEncryption] = crypto.Algorithm
+	}
+	if retention != nil {
+		file.RetentionMode = retention.Mode
+		file.RetainUntil = &retention.RetainUntil
 	}
 
-	if err := wh.saveMetadata(ctx, file, chunkModels); err != nil {
+	if replace {
+		err = wh.replaceMetadata(ctx, file, chunkModels)
+	} else {
+		err = wh.saveMetadata(ctx, file, chunkModels)
+	}
+	if err != nil {
+		uploadErr = err
 		span.RecordError(err)
-		http.Error(w, fmt.Sprintf("failed to save metadata: %v", err), http.StatusInternalServerError)
+		// No rows are left behind: a lost race for a client-chosen ID
+		// writes none, and a failed save removes its own
+		wh.deleteChunks(ctx, target, chunkModels)
+		http.Error(w, fmt.Sprintf("failed to save metadata: %v", err), errorStatus(err))
 		return
 	}
+	wh.releaseChunks(ctx, target, chunkModels)
 
-	// Step 4: Invalidate cache (if file was previously cached)
-	log.Printf("Invalidating cache...")
+	// Step 3: Invalidate cache (if file was previously cached)
+	logging.FromContext(ctx).Info("invalidating cache")
 	if err := wh.invalidateCache(ctx, fileID); err != nil {
 		// Log error but don't fail the request
-		log.Printf("Warning: failed to invalidate cache: %v", err)
+		logging.FromContext(ctx).Warn("failed to invalidate cache", "error", err)
+	}
+	if wh.opts.CacheChunks {
+		if err := wh.redisClient.SetChunks(ctx, fileID, chunkModels); err != nil {
+			logging.FromContext(ctx).Warn("failed to cache chunk list", "error", err)
+		}
 	}
 
 	// Return success response
@@ -126,7 +352,7 @@ func (wh *WriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		FileID:     fileID,
 		FileName:   filename,
 		FileSize:   totalSize,
-		ChunkCount: len(chunks),
+		ChunkCount: len(chunkModels),
 		Message:    "File uploaded successfully",
 	}
 
@@ -134,80 +360,652 @@ func (wh *WriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(response)
 
-	log.Printf("File upload completed: %s (ID: %s)", filename, fileID)
+	metrics.RecordFileUpload(ctx, totalSize)
+	logging.FromContext(ctx).Info("file upload completed", "file_name", filename)
 }
 
-func (wh *WriteHandler) chunkStream(ctx context.Context, body io.ReadCloser) ([]*models.ChunkData, int64, error) {
-	ctx, span := tracer.Start(ctx, "chunk_stream")
+// limitBody caps an upload body at MaxFileSize less the existing bytes of
+// the file it is added to
+func (wh *WriteHandler) limitBody(w http.ResponseWriter, body io.ReadCloser, existing int64) io.ReadCloser {
+	if wh.opts.MaxFileSize <= 0 {
+		return body
+	}
+	return http.MaxBytesReader(w, body, max(0, wh.opts.MaxFileSize-existing))
+}
+
+// recordSizeLimit marks span if err is an upload aborted for exceeding the
+// maximum file size
+func recordSizeLimit(span trace.Span, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		span.SetAttributes(attribute.Bool("max_file_size_exceeded", true))
+	}
+}
+
+// uploadPipeline reads, hashes and uploads chunks as three concurrent stages
+// connected by bounded channels, so uploading chunk N overlaps with reading
+// chunk N+1 and at most a few chunks are held in memory at once. The first
+// error in any stage cancels the others, and the chunks uploaded before it
+// are deleted again.
+func (wh *WriteHandler) uploadPipeline(ctx context.Context, target uploadTarget, body io.ReadCloser) ([]*models.Chunk, int64, error) {
+	ctx, span := tracer.Start(ctx, "upload_pipeline",
+		trace.WithAttributes(
+			attribute.Int("upload_concurrency", wh.opts.UploadConcurrency),
+			attribute.Int("start_index", target.startIndex),
+		),
+	)
 	defer span.End()
 	defer body.Close()
 
-	return wh.chunker.ChunkStream(body)
+	// Cleanup must outlive the cancellation that a failure (or the client
+	// going away) triggers
+	cleanupCtx := context.WithoutCancel(ctx)
+	g, ctx := errgroup.WithContext(ctx)
+
+	rawChunks := make(chan *models.ChunkData, wh.opts.UploadConcurrency)
+	hashedChunks := make(chan *models.ChunkData, wh.opts.UploadConcurrency)
+
+	// Stage 1: read the body into chunks
+	var reader io.Reader = body
+	if target.checksum != nil {
+		reader = io.TeeReader(body, target.checksum)
+	}
+	var totalSize int64
+	g.Go(func() error {
+		var err error
+		totalSize, err = wh.chunker.ReadChunks(ctx, reader, rawChunks)
+		return err
+	})
+
+	// Stage 2: hash each chunk
+	g.Go(func() error {
+		defer close(hashedChunks)
+		for chunkData := range rawChunks {
+			wh.progress.AddBytes(target.uploadID, chunkData.Size)
+			chunkData.OrderIndex += target.startIndex
+			chunkData.Hash = chunker.ComputeHash(chunkData.Data)
+			select {
+			case hashedChunks <- chunkData:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	// Stage 3: upload chunks to MinIO with a pool of workers
+	var mu sync.Mutex
+	var chunkModels []*models.Chunk
+	for i := 0; i < wh.opts.UploadConcurrency; i++ {
+		g.Go(func() error {
+			for chunkData := range hashedChunks {
+				chunk, err := wh.uploadChunk(ctx, target, chunkData)
+				if err != nil {
+					return err
+				}
+
+				mu.Lock()
+				chunkModels = append(chunkModels, chunk)
+				mu.Unlock()
+				wh.progress.AddChunk(target.uploadID)
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		span.RecordError(err)
+		span.SetAttributes(attribute.Int("chunks_cleaned_up", len(chunkModels)))
+		wh.deleteChunks(cleanupCtx, target, chunkModels)
+		return nil, 0, err
+	}
+
+	// Workers finish out of order; restore chunk order for metadata
+	sort.Slice(chunkModels, func(i, j int) bool {
+		return chunkModels[i].OrderIndex < chunkModels[j].OrderIndex
+	})
+
+	span.SetAttributes(
+		attribute.Int("chunks_uploaded", len(chunkModels)),
+		attribute.Int64("file_size", totalSize),
+	)
+	return chunkModels, totalSize, nil
 }
 
-func (wh *WriteHandler) uploadChunks(ctx context.Context, fileID string, chunks []*models.ChunkData) ([]*models.Chunk, error) {
-	ctx, span := tracer.Start(ctx, "upload_chunks",
+// uploadChunk uploads a single chunk to MinIO and returns its metadata.
+// Appended chunks get the chunk ID in their object key: two concurrent
+// appends race for the same order_index, and the loser must not overwrite
+// (or later clean up) the winner's object.
+func (wh *WriteHandler) uploadChunk(ctx context.Context, target uploadTarget, chunkData *models.ChunkData) (*models.Chunk, error) {
+	// Each worker's uploads get their own span so parallel uploads show up
+	// side by side in traces, timeout retries and dedup checks included
+	ctx, span := tracer.Start(ctx, "upload_chunk",
 		trace.WithAttributes(
-			attribute.Int("chunk_count", len(chunks)),
+			attribute.Int("chunk_index", chunkData.OrderIndex),
+			attribute.Int64("size_bytes", chunkData.Size),
 		),
 	)
 	defer span.End()
 
-	var chunkModels []*models.Chunk
+	fileID := target.fileID
+
+	// Encode the chunk as it will be stored: compressed, then encrypted
+	payload, compression, err := wh.encodeChunk(target, chunkData.Data)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to encode chunk %d: %w", chunkData.OrderIndex, err)
+	}
+	span.SetAttributes(
+		attribute.String("compression", compression),
+		attribute.Int("stored_size_bytes", len(payload)),
+	)
 
-	for _, chunkData := range chunks {
-		// Generate chunk ID and MinIO object key
-		chunkID := uuid.New().String()
-		objectKey := fmt.Sprintf("chunks/%s/%d", fileID, chunkData.OrderIndex)
+	// Generate chunk ID and MinIO object key
+	chunkID := uuid.New().String()
+	suffix := ""
+	if target.uniqueKeys {
+		suffix = chunkID
+	}
+	objectKey := wh.minioClient.ChunkKey(fileID, chunkData.OrderIndex, suffix)
 
+	stored := false
+	claimed := false
+	if wh.contentAddressed(target) {
+		objectKey = wh.minioClient.ContentKey(chunkData.Hash, storedFormSuffix(compression, target.encrypt))
+
+		// Reference the object before looking for it, so deleting the last
+		// file using it can't remove it before our chunk row is saved
+		if err := wh.tidbClient.ClaimChunkObject(ctx, objectKey); err != nil {
+			span.RecordError(err)
+			return nil, fmt.Errorf("failed to claim chunk %d: %w", chunkData.OrderIndex, err)
+		}
+		claimed = true
+
+		exists, err := wh.minioClient.ChunkExists(ctx, objectKey)
+		if err != nil {
+			span.RecordError(err)
+			wh.releaseObjects(ctx, []string{objectKey})
+			return nil, fmt.Errorf("failed to check chunk %d: %w", chunkData.OrderIndex, err)
+		}
+		stored = exists
+	}
+	span.SetAttributes(
+		attribute.String("object_key", objectKey),
+		attribute.Bool("deduplicated", stored),
+	)
+
+	if stored {
+		metrics.RecordChunkDeduplicated(ctx, chunkData.Size)
+	} else {
 		// Upload to MinIO
-		if err := wh.minioClient.UploadChunk(ctx, objectKey, chunkData.Data); err != nil {
+		upload := &models.ChunkData{Data: payload, OrderIndex: chunkData.OrderIndex, Hash: chunkData.Hash, Size: int64(len(payload))}
+		if err := wh.uploadWithTimeout(ctx, objectKey, upload, target.retention); err != nil {
 			span.RecordError(err)
+			if claimed {
+				wh.releaseObjects(ctx, []string{objectKey})
+			}
 			return nil, fmt.Errorf("failed to upload chunk %d: %w", chunkData.OrderIndex, err)
 		}
+		metrics.RecordChunkUpload(ctx, int64(len(payload)))
+	}
+
+	return &models.Chunk{
+		ID:             chunkID,
+		FileID:         fileID,
+		OrderIndex:     chunkData.OrderIndex,
+		Hash:           chunkData.Hash,
+		MinioObjectKey: objectKey,
+		Size:           chunkData.Size,
+		Compression:    compression,
+		StoredSize:     int64(len(payload)),
+	}, nil
+}
+
+// encodeChunk returns data as it is stored in MinIO and the compression it
+// was stored with. Compression comes first, since ciphertext doesn't compress.
+func (wh *WriteHandler) encodeChunk(target uploadTarget, data []byte) ([]byte, string, error) {
+	payload, compression, err := compress.Compress(wh.opts.Compression, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if target.encrypt {
+		if payload, err = wh.opts.Cipher.Encrypt(payload); err != nil {
+			return nil, "", err
+		}
+	}
+	return payload, compression, nil
+}
+
+// storedFormSuffix distinguishes content-addressed objects by how their
+// content is stored, so a chunk row never points at an object stored with a
+// different compression or encryption than it records
+func storedFormSuffix(compression string, encrypted bool) string {
+	var parts []string
+	if compression != "" && compression != compress.None {
+		parts = append(parts, compression)
+	}
+	if encrypted {
+		parts = append(parts, "enc")
+	}
+	return strings.Join(parts, "-")
+}
+
+// contentAddressed reports whether target's chunks use shared,
+// content-addressed object keys
+func (wh *WriteHandler) contentAddressed(target uploadTarget) bool {
+	return wh.opts.ContentAddressed && target.retention == nil
+}
+
+// uploadWithTimeout uploads one chunk, giving each attempt its own
+// ChunkUploadTimeout so a stuck upload fails on its own instead of holding
+// the request until its overall deadline. Timed-out attempts are retried.
+func (wh *WriteHandler) uploadWithTimeout(ctx context.Context, objectKey string, chunkData *models.ChunkData, retention *storage.Retention) error {
+	if wh.opts.ChunkUploadTimeout <= 0 {
+		return wh.minioClient.UploadChunk(ctx, objectKey, chunkData.Data, retention)
+	}
+
+	span := trace.SpanFromContext(ctx)
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, wh.opts.ChunkUploadTimeout)
+		err := wh.minioClient.UploadChunk(attemptCtx, objectKey, chunkData.Data, retention)
+		timedOut := attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+
+		if !timedOut {
+			return err
+		}
+
+		span.AddEvent("chunk_upload_timeout", trace.WithAttributes(
+			attribute.Int("chunk_index", chunkData.OrderIndex),
+			attribute.Int("attempt", attempt+1),
+			attribute.Int64("timeout_ms", wh.opts.ChunkUploadTimeout.Milliseconds()),
+		))
+		if attempt >= chunkTimeoutRetries {
+			return fmt.Errorf("timed out after %s: %w", wh.opts.ChunkUploadTimeout, err)
+		}
+	}
+}
+
+// fileName returns a requested file name with surrounding whitespace
+// trimmed, rejecting missing and blank names. Length, encoding, control
+// characters and path separators were already checked for every name
+// parameter by middleware.ValidateRequest.
+func fileName(requested string) (string, error) {
+	name := strings.TrimSpace(requested)
+	switch {
+	case requested == "":
+		return "", invalidRequest("missing 'name' query parameter")
+	case name == "":
+		return "", invalidRequest("'name' must not be blank")
+	}
+	return name, nil
+}
+
+// errInvalidFileID is returned by resolveFileID for a malformed client ID
+var errInvalidFileID = invalidRequest("'id' must be a well-formed UUID")
+
+// resolveFileID returns the client-requested file ID after checking it is a
+// UUID not already in use, or a freshly generated one when none was given.
+// clientID reports which. With overwrite, an ID in use by a file that could
+// be deleted is accepted too, and replace reports that its file must be
+// replaced.
+func (wh *WriteHandler) resolveFileID(ctx context.Context, requested string, overwrite bool) (fileID string, clientID, replace bool, err error) {
+	if requested == "" {
+		return uuid.New().String(), false, false, nil
+	}
+
+	parsed, err := uuid.Parse(requested)
+	if err != nil {
+		return "", false, false, errInvalidFileID
+	}
+	fileID = parsed.String()
+
+	existing, err := wh.tidbClient.GetFile(ctx, fileID)
+	switch {
+	case err == nil && !overwrite:
+		return "", false, false, fmt.Errorf("%w: %s", storage.ErrFileExists, fileID)
+	case err == nil:
+		if err := checkDeletable(existing); err != nil {
+			return "", false, false, err
+		}
+		return fileID, true, true, nil
+	case !errors.Is(err, storage.ErrFileNotFound):
+		return "", false, false, err
+	}
+	return fileID, true, false, nil
+}
+
+// requestContentHash returns the lowercase hex SHA256 the client declared
+// for the body in X-Content-SHA256 or ?content_hash=, or "" if neither is set
+func requestContentHash(r *http.Request) (string, error) {
+	contentHash := r.Header.Get("X-Content-SHA256")
+	if contentHash == "" {
+		contentHash = r.URL.Query().Get("content_hash")
+	}
+	if contentHash == "" {
+		return "", nil
+	}
+
+	contentHash = strings.ToLower(strings.TrimSpace(contentHash))
+	if decoded, err := hex.DecodeString(contentHash); err != nil || len(decoded) != sha256.Size {
+		return "", invalidRequest("content hash must be a hex-encoded SHA256")
+	}
+	return contentHash, nil
+}
+
+// requestEncoding returns the body's Content-Encoding as stored with the file:
+// "" for an unencoded body or "gzip". Other encodings are rejected.
+func requestEncoding(r *http.Request) (string, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return "", nil
+	case "gzip":
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("%w %q: only gzip can be stored", errUnsupportedEncoding, encoding)
+	}
+}
+
+// defaultContentType is served for files whose type isn't known
+const defaultContentType = "application/octet-stream"
+
+// genericContentTypes say nothing about a body's content; curl sends
+// application/x-www-form-urlencoded for --data-binary unless told otherwise
+var genericContentTypes = map[string]bool{
+	defaultContentType:                  true,
+	"application/x-www-form-urlencoded": true,
+	"multipart/form-data":               true,
+}
+
+// requestContentType returns the upload's Content-Type, or "" if it is
+// missing, malformed or generic
+func requestContentType(r *http.Request) string {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return ""
+	}
+	mediaType, params, err := mime.ParseMediaType(header)
+	if err != nil || genericContentTypes[mediaType] {
+		return ""
+	}
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// sniffLen is how many bytes http.DetectContentType considers
+const sniffLen = 512
+
+// sniffReader keeps the first sniffLen bytes read through it
+type sniffReader struct {
+	io.ReadCloser
+	head []byte
+}
+
+func (sr *sniffReader) Read(p []byte) (int, error) {
+	n, err := sr.ReadCloser.Read(p)
+	if remaining := sniffLen - len(sr.head); remaining > 0 {
+		sr.head = append(sr.head, p[:min(n, remaining)]...)
+	}
+	return n, err
+}
 
-		// Create chunk model
-		chunk := &models.Chunk{
-			ID:             chunkID,
-			FileID:         fileID,
-			OrderIndex:     chunkData.OrderIndex,
-			Hash:           chunkData.Hash,
-			MinioObjectKey: objectKey,
-			Size:           chunkData.Size,
+// parseRetention returns the object-lock retention for an upload from the
+// retention_mode and retention_days query parameters, falling back to the
+// configured defaults. It returns nil when no retention applies.
+func (wh *WriteHandler) parseRetention(r *http.Request) (*storage.Retention, error) {
+	mode := r.URL.Query().Get("retention_mode")
+	days := wh.opts.RetentionDays
+	if mode == "" {
+		mode = wh.opts.RetentionMode
+	}
+	if raw := r.URL.Query().Get("retention_days"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			return nil, invalidRequest("'retention_days' must be a positive integer")
 		}
+		days = parsed
+	}
+
+	if mode == "" {
+		return nil, nil
+	}
 
-		chunkModels = append(chunkModels, chunk)
+	mode = strings.ToUpper(mode)
+	if mode != "GOVERNANCE" && mode != "COMPLIANCE" {
+		return nil, invalidRequest("'retention_mode' must be GOVERNANCE or COMPLIANCE")
+	}
+	if days < 1 {
+		return nil, invalidRequest("'retention_days' is required with a retention mode")
+	}
+	if !wh.minioClient.ObjectLockingEnabled() {
+		return nil, invalidRequest("retention requires object locking to be enabled on the bucket")
 	}
 
-	span.SetAttributes(attribute.Int("chunks_uploaded", len(chunkModels)))
-	return chunkModels, nil
+	return &storage.Retention{
+		Mode:        mode,
+		RetainUntil: time.Now().AddDate(0, 0, days).UTC(),
+	}, nil
 }
 
 func (wh *WriteHandler) saveMetadata(ctx context.Context, file *models.File, chunks []*models.Chunk) error {
 	ctx, span := tracer.Start(ctx, "save_metadata")
 	defer span.End()
 
-	// Create file record
-	if err := wh.tidbClient.CreateFile(ctx, file); err != nil {
+	if wh.opts.ChunkInsertBatchSize > 0 {
+		if err := wh.saveMetadataBatched(ctx, file, chunks); err != nil {
+			span.RecordError(err)
+			return err
+		}
+		span.SetAttributes(attribute.Bool("metadata_saved", true))
+		return nil
+	}
+
+	// The file and chunk rows commit together, so a failure never leaves a
+	// file row with chunks missing
+	tx, err := wh.tidbClient.BeginTx(ctx)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	file.Status = models.FileStatusComplete
+	if err := wh.tidbClient.CreateFileTx(ctx, tx, file); err != nil {
 		span.RecordError(err)
 		return fmt.Errorf("failed to create file record: %w", err)
 	}
+	if err := wh.tidbClient.CreateChunksTx(ctx, tx, chunks); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to create chunk records: %w", err)
+	}
 
-	// Create chunk records
-	for _, chunk := range chunks {
-		if err := wh.tidbClient.CreateChunk(ctx, chunk); err != nil {
-			span.RecordError(err)
-			return fmt.Errorf("failed to create chunk record: %w", err)
-		}
+	if err := tx.Commit(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to commit metadata: %w", err)
 	}
 
 	span.SetAttributes(attribute.Bool("metadata_saved", true))
 	return nil
 }
 
+// replaceMetadata saves file and its chunk rows in place of the existing
+// file with the same ID, in one transaction, then deletes the objects only
+// the replaced file referenced. The file was created by a writer that
+// checked it could be deleted; one deleted since is simply created again.
+func (wh *WriteHandler) replaceMetadata(ctx context.Context, file *models.File, chunks []*models.Chunk) error {
+	ctx, span := tracer.Start(ctx, "replace_metadata")
+	defer span.End()
+
+	tx, err := wh.tidbClient.BeginTx(ctx)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	unreferenced, err := wh.tidbClient.DeleteFileTx(ctx, tx, file.ID)
+	if err != nil && !errors.Is(err, storage.ErrFileNotFound) {
+		span.RecordError(err)
+		return fmt.Errorf("failed to delete replaced file: %w", err)
+	}
+
+	file.Status = models.FileStatusComplete
+	if err := wh.tidbClient.CreateFileTx(ctx, tx, file); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to create file record: %w", err)
+	}
+	if err := wh.tidbClient.CreateChunksTx(ctx, tx, chunks); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to create chunk records: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to commit metadata: %w", err)
+	}
+
+	// Another write may have started reusing a shared object since, so each
+	// is only removed if still unreferenced
+	for _, key := range unreferenced {
+		_, err := wh.tidbClient.DeleteChunkObject(ctx, key, func(ctx context.Context) error {
+			return wh.minioClient.DeleteChunk(ctx, key)
+		})
+		if err != nil {
+			logging.FromContext(ctx).Warn("failed to delete chunk of replaced file", "object_key", key, "error", err)
+		}
+	}
+
+	span.SetAttributes(attribute.Int("unreferenced_objects", len(unreferenced)))
+	return nil
+}
+
+// saveMetadataBatched saves the file row pending, then its chunk rows in
+// parallel batched transactions, then marks it complete. Batches commit
+// independently, so a failure can leave some rows of the still-pending file
+// behind, which are deleted again before returning.
+func (wh *WriteHandler) saveMetadataBatched(ctx context.Context, file *models.File, chunks []*models.Chunk) error {
+	// Create file record, pending so it isn't served with missing chunks
+	file.Status = models.FileStatusPending
+	if err := wh.tidbClient.CreateFile(ctx, file); err != nil {
+		return fmt.Errorf("failed to create file record: %w", err)
+	}
+
+	err := wh.saveChunkRows(ctx, chunks)
+	if err == nil {
+		err = wh.tidbClient.MarkFileComplete(ctx, file.ID)
+	}
+	if err != nil {
+		wh.deleteFileRows(ctx, file.ID)
+		return err
+	}
+	file.Status = models.FileStatusComplete
+	return nil
+}
+
+// deleteFileRows removes the pending file row and whatever chunk rows were
+// saved for it after a failed batched save. The objects stay: the caller
+// still owns them, and an upload session keeps them for a retry. Only the
+// refcount rows left at zero are dropped.
+func (wh *WriteHandler) deleteFileRows(ctx context.Context, fileID string) {
+	ctx = context.WithoutCancel(ctx)
+
+	unreferenced, err := wh.tidbClient.DeleteFile(ctx, fileID)
+	if err != nil {
+		logging.FromContext(ctx).Warn("failed to delete rows of unsaved file", "error", err)
+		return
+	}
+	for _, key := range unreferenced {
+		_, err := wh.tidbClient.DeleteChunkObject(ctx, key, func(context.Context) error { return nil })
+		if err != nil {
+			logging.FromContext(ctx).Warn("failed to drop chunk object refcount", "object_key", key, "error", err)
+		}
+	}
+}
+
+// saveChunkRows inserts chunk rows in transactions of ChunkInsertBatchSize
+// rows, ChunkInsertParallelism of them at a time
+func (wh *WriteHandler) saveChunkRows(ctx context.Context, chunks []*models.Chunk) error {
+	batchSize := wh.opts.ChunkInsertBatchSize
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(wh.opts.ChunkInsertParallelism, 1))
+	for start := 0; start < len(chunks); start += batchSize {
+		batch := chunks[start:min(start+batchSize, len(chunks))]
+		g.Go(func() error {
+			if err := wh.tidbClient.CreateChunks(gctx, batch); err != nil {
+				return fmt.Errorf("failed to create chunk records %d-%d: %w",
+					batch[0].OrderIndex, batch[len(batch)-1].OrderIndex, err)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
 func (wh *WriteHandler) invalidateCache(ctx context.Context, fileID string) error {
 	ctx, span := tracer.Start(ctx, "invalidate_cache")
 	defer span.End()
 
-	return wh.redisClient.InvalidateFileMetadata(ctx, fileID)
+	return errors.Join(
+		wh.redisClient.InvalidateFileMetadata(ctx, fileID),
+		wh.redisClient.InvalidateChunks(ctx, fileID),
+	)
+}
+
+// deleteChunks removes uploaded objects on a best-effort basis after a failed
+// write. Content-addressed objects are released instead, so the ones other
+// files or uploads still reference are kept.
+func (wh *WriteHandler) deleteChunks(ctx context.Context, target uploadTarget, chunks []*models.Chunk) {
+	if wh.contentAddressed(target) {
+		wh.releaseChunks(ctx, target, chunks)
+		return
+	}
+
+	for _, chunk := range chunks {
+		if err := wh.minioClient.DeleteChunk(ctx, chunk.MinioObjectKey); err != nil {
+			logging.FromContext(ctx).Warn("failed to clean up chunk", "object_key", chunk.MinioObjectKey, "error", err)
+		}
+	}
+}
+
+// releaseChunks gives back the references uploadChunk claimed on
+// content-addressed objects, once the chunk rows hold their own or the write
+// has failed
+func (wh *WriteHandler) releaseChunks(ctx context.Context, target uploadTarget, chunks []*models.Chunk) {
+	if !wh.contentAddressed(target) || len(chunks) == 0 {
+		return
+	}
+
+	keys := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		keys[i] = chunk.MinioObjectKey
+	}
+	wh.releaseObjects(ctx, keys)
+}
+
+// releaseObjects releases claimed objects and deletes those left without any
+// reference, such as objects only a failed write uploaded. It runs even if
+// the request was cancelled, since a claim that is never released keeps its
+// object forever.
+func (wh *WriteHandler) releaseObjects(ctx context.Context, keys []string) {
+	releaseObjects(ctx, wh.tidbClient, wh.minioClient, keys)
+}
+
+// releaseObjects releases claimed objects through tidbClient and deletes
+// those left unreferenced from minioClient
+func releaseObjects(ctx context.Context, tidbClient *storage.TiDBClient, minioClient *storage.MinioClient, keys []string) {
+	ctx = context.WithoutCancel(ctx)
+
+	unreferenced, err := tidbClient.ReleaseChunkObjects(ctx, keys)
+	if err != nil {
+		logging.FromContext(ctx).Warn("failed to release chunk objects", "object_count", len(keys), "error", err)
+		return
+	}
+	for _, key := range unreferenced {
+		_, err := tidbClient.DeleteChunkObject(ctx, key, func(ctx context.Context) error {
+			return minioClient.DeleteChunk(ctx, key)
+		})
+		if err != nil {
+			logging.FromContext(ctx).Warn("failed to clean up chunk", "object_key", key, "error", err)
+		}
+	}
 }
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/maneesh/labdropbox/internal/chunker"
+	"github.com/maneesh/labdropbox/internal/storage"
+)
+
+// newFakeMinio returns a MinioClient backed by an in-process S3 endpoint
+// that accepts every upload after sleeping for latency, standing in for the
+// round trip to a real MinIO
+func newFakeMinio(b *testing.B, latency time.Duration) *storage.MinioClient {
+	b.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Has("location"):
+			w.Header().Set("Content-Type", "application/xml")
+			io.WriteString(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+		case r.Method == http.MethodPut:
+			io.Copy(io.Discard, r.Body)
+			time.Sleep(latency)
+			w.Header().Set("ETag", `"0"`)
+		}
+	}))
+	b.Cleanup(server.Close)
+
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	mc, err := storage.NewMinioClient(endpoint.Host, "access", "secret", "bench", storage.MinioOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return mc
+}
+
+// BenchmarkUploadPipeline compares writing a 16MB body in 1MB chunks the
+// way writes worked before the pipeline (read the whole body into hashed
+// chunks, then upload them one by one) with uploadPipeline, at zero and
+// realistic per-upload latency
+func BenchmarkUploadPipeline(b *testing.B) {
+	const fileSize = 16 << 20
+	const chunkSize = 1 << 20
+
+	body := make([]byte, fileSize)
+	rand.Read(body)
+	c, err := chunker.NewChunker(chunkSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, latency := range []time.Duration{0, 5 * time.Millisecond} {
+		mc := newFakeMinio(b, latency)
+
+		b.Run(fmt.Sprintf("latency=%s/sequential", latency), func(b *testing.B) {
+			wh := NewWriteHandler(mc, nil, nil, c, nil, WriteOptions{})
+			target := uploadTarget{fileID: "bench"}
+			b.SetBytes(fileSize)
+			for i := 0; i < b.N; i++ {
+				chunks, _, err := c.ChunkStream(ctx, bytes.NewReader(body))
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, chunkData := range chunks {
+					if _, err := wh.uploadChunk(ctx, target, chunkData); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+
+		for _, concurrency := range []int{1, 4} {
+			b.Run(fmt.Sprintf("latency=%s/pipelined/concurrency=%d", latency, concurrency), func(b *testing.B) {
+				wh := NewWriteHandler(mc, nil, nil, c, nil, WriteOptions{UploadConcurrency: concurrency})
+				target := uploadTarget{fileID: "bench"}
+				b.SetBytes(fileSize)
+				for i := 0; i < b.N; i++ {
+					if _, _, err := wh.uploadPipeline(ctx, target, io.NopCloser(bytes.NewReader(body))); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
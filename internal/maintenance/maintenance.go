@@ -0,0 +1,56 @@
+package maintenance
+
+import (
+	"sync"
+	"time"
+)
+
+// Status is a snapshot of the service's maintenance mode
+type Status struct {
+	ReadOnly bool       `json:"read_only"`
+	Reason   string     `json:"reason,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+// Mode is a runtime-togglable read-only switch. While read-only, handlers
+// that modify files reject requests and reads continue as normal.
+type Mode struct {
+	mu     sync.RWMutex
+	status Status
+}
+
+// NewMode creates a mode, optionally starting in read-only
+func NewMode(readOnly bool) *Mode {
+	m := &Mode{}
+	if readOnly {
+		m.Set(true, "read-only at startup")
+	}
+	return m
+}
+
+// Set switches read-only mode on or off. The reason is shown to rejected
+// clients and in /health.
+func (m *Mode) Set(readOnly bool, reason string) Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !readOnly {
+		m.status = Status{}
+		return m.status
+	}
+
+	if !m.status.ReadOnly {
+		now := time.Now().UTC()
+		m.status.Since = &now
+	}
+	m.status.ReadOnly = true
+	m.status.Reason = reason
+	return m.status
+}
+
+// Status returns the current mode
+func (m *Mode) Status() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
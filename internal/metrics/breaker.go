@@ -0,0 +1,30 @@
+package metrics
+
+import "sync/atomic"
+
+// breakerState reports the MinIO circuit breaker state, once registered
+var breakerState atomic.Pointer[func() string]
+
+// ObserveBreaker registers the function the breaker state gauge reads, such
+// as MinioClient.BreakerState
+func ObserveBreaker(state func() string) {
+	breakerState.Store(&state)
+}
+
+// breakerValue maps a breaker state to the gauge value: 0 closed,
+// 1 half-open, 2 open. ok is false when there is no breaker to report.
+func breakerValue() (value int64, ok bool) {
+	state := breakerState.Load()
+	if state == nil {
+		return 0, false
+	}
+	switch (*state)() {
+	case "closed":
+		return 0, true
+	case "half-open":
+		return 1, true
+	case "open":
+		return 2, true
+	}
+	return 0, false
+}
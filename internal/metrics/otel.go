@@ -0,0 +1,215 @@
+package metrics
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// OTel instruments. They are no-ops until a meter provider is installed
+// (tracing.InitMeter); HTTP request counts, durations and status codes come
+// from otelhttp.
+var (
+	meter = otel.Meter("labdropbox")
+
+	chunkTransfers metric.Int64Counter
+	chunkBytes     metric.Int64Histogram
+	chunkDuration  metric.Float64Histogram
+	fileTransfers  metric.Int64Counter
+	fileBytes      metric.Int64Histogram
+	cacheLookups   metric.Int64Counter
+)
+
+// sizeBuckets are histogram boundaries for byte sizes, 1KB to 16GB in
+// powers of 4; the OTel defaults stop at 10000
+var sizeBuckets = func() []float64 {
+	var bounds []float64
+	for b := float64(1 << 10); b <= 1<<34; b *= 4 {
+		bounds = append(bounds, b)
+	}
+	return bounds
+}()
+
+// durationBuckets are histogram boundaries for object storage calls in
+// seconds, 1ms to about 65s in powers of 2
+var durationBuckets = func() []float64 {
+	var bounds []float64
+	for b := 0.001; b <= 66; b *= 2 {
+		bounds = append(bounds, b)
+	}
+	return bounds
+}()
+
+func init() {
+	var err error
+	if chunkTransfers, err = meter.Int64Counter("labdropbox.chunks",
+		metric.WithDescription("Chunks transferred to or from object storage"),
+		metric.WithUnit("{chunk}"),
+	); err != nil {
+		log.Printf("Warning: failed to create chunk counter: %v", err)
+	}
+
+	if chunkBytes, err = meter.Int64Histogram("labdropbox.chunk.size",
+		metric.WithDescription("Size of chunks transferred to or from object storage"),
+		metric.WithUnit("By"),
+		metric.WithExplicitBucketBoundaries(sizeBuckets...),
+	); err != nil {
+		log.Printf("Warning: failed to create chunk size histogram: %v", err)
+	}
+
+	if chunkDuration, err = meter.Float64Histogram("labdropbox.chunk.duration",
+		metric.WithDescription("Duration of chunk uploads to and downloads from object storage, including retries"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(durationBuckets...),
+	); err != nil {
+		log.Printf("Warning: failed to create chunk duration histogram: %v", err)
+	}
+
+	if fileTransfers, err = meter.Int64Counter("labdropbox.files",
+		metric.WithDescription("Completed file uploads, appends and downloads"),
+		metric.WithUnit("{file}"),
+	); err != nil {
+		log.Printf("Warning: failed to create file counter: %v", err)
+	}
+
+	if fileBytes, err = meter.Int64Histogram("labdropbox.file.size",
+		metric.WithDescription("Size of uploaded, appended and downloaded files"),
+		metric.WithUnit("By"),
+		metric.WithExplicitBucketBoundaries(sizeBuckets...),
+	); err != nil {
+		log.Printf("Warning: failed to create file size histogram: %v", err)
+	}
+
+	if cacheLookups, err = meter.Int64Counter("labdropbox.cache.lookups",
+		metric.WithDescription("Redis cache lookups by result"),
+		metric.WithUnit("{lookup}"),
+	); err != nil {
+		log.Printf("Warning: failed to create cache lookup counter: %v", err)
+	}
+
+	breaker, err := meter.Int64ObservableGauge("labdropbox.minio.breaker.state",
+		metric.WithDescription("MinIO circuit breaker state: 0 closed, 1 half-open, 2 open"),
+	)
+	if err != nil {
+		log.Printf("Warning: failed to create breaker state gauge: %v", err)
+	} else if _, err := meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		if value, ok := breakerValue(); ok {
+			o.ObserveInt64(breaker, value)
+		}
+		return nil
+	}, breaker); err != nil {
+		log.Printf("Warning: failed to register breaker state callback: %v", err)
+	}
+
+	streams, err := meter.Int64ObservableUpDownCounter("labdropbox.streams.active",
+		metric.WithDescription("Read and write streams in progress"),
+		metric.WithUnit("{stream}"),
+	)
+	if err != nil {
+		log.Printf("Warning: failed to create active streams gauge: %v", err)
+		return
+	}
+	if _, err := meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		o.ObserveInt64(streams, ActiveReads(), metric.WithAttributes(attribute.String("direction", "read")))
+		o.ObserveInt64(streams, ActiveWrites(), metric.WithAttributes(attribute.String("direction", "write")))
+		return nil
+	}, streams); err != nil {
+		log.Printf("Warning: failed to register active streams callback: %v", err)
+	}
+}
+
+// RecordChunkUpload records a chunk written to object storage
+func RecordChunkUpload(ctx context.Context, size int64) {
+	recordChunk(ctx, "upload", size)
+}
+
+// RecordChunkDeduplicated records a chunk whose upload was skipped because
+// identical content was already stored
+func RecordChunkDeduplicated(ctx context.Context, size int64) {
+	recordChunk(ctx, "deduplicated", size)
+}
+
+// RecordChunkDownload records a chunk read from object storage
+func RecordChunkDownload(ctx context.Context, size int64) {
+	recordChunk(ctx, "download", size)
+}
+
+func recordChunk(ctx context.Context, direction string, size int64) {
+	attrs := metric.WithAttributes(attribute.String("direction", direction))
+	if chunkTransfers != nil {
+		chunkTransfers.Add(ctx, 1, attrs)
+	}
+	if chunkBytes != nil {
+		chunkBytes.Record(ctx, size, attrs)
+	}
+}
+
+// RecordChunkUploadDuration records how long a chunk upload took, and
+// whether it failed
+func RecordChunkUploadDuration(ctx context.Context, d time.Duration, err error) {
+	recordChunkDuration(ctx, "upload", d, err)
+}
+
+// RecordChunkDownloadDuration records how long a chunk download took, and
+// whether it failed
+func RecordChunkDownloadDuration(ctx context.Context, d time.Duration, err error) {
+	recordChunkDuration(ctx, "download", d, err)
+}
+
+func recordChunkDuration(ctx context.Context, direction string, d time.Duration, err error) {
+	if chunkDuration == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	chunkDuration.Record(ctx, d.Seconds(), metric.WithAttributes(
+		attribute.String("direction", direction),
+		attribute.String("result", result),
+	))
+}
+
+// RecordFileUpload records a completed upload of size bytes
+func RecordFileUpload(ctx context.Context, size int64) {
+	recordFile(ctx, "upload", size)
+}
+
+// RecordFileAppend records size bytes successfully appended to a file
+func RecordFileAppend(ctx context.Context, size int64) {
+	recordFile(ctx, "append", size)
+}
+
+// RecordFileDownload records a completed download of size bytes
+func RecordFileDownload(ctx context.Context, size int64) {
+	recordFile(ctx, "download", size)
+}
+
+func recordFile(ctx context.Context, direction string, size int64) {
+	attrs := metric.WithAttributes(attribute.String("direction", direction))
+	if fileTransfers != nil {
+		fileTransfers.Add(ctx, 1, attrs)
+	}
+	if fileBytes != nil {
+		fileBytes.Record(ctx, size, attrs)
+	}
+}
+
+// RecordCacheLookup records a hit or miss on the named cache
+func RecordCacheLookup(ctx context.Context, cache string, hit bool) {
+	if cacheLookups == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("cache", cache),
+		attribute.String("result", result),
+	))
+}
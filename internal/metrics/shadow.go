@@ -0,0 +1,41 @@
+package metrics
+
+import "sync/atomic"
+
+// Outcomes of shadow reads against the secondary store
+var (
+	shadowMatches    atomic.Int64
+	shadowMismatches atomic.Int64
+	shadowErrors     atomic.Int64
+	shadowSkipped    atomic.Int64
+)
+
+// ShadowCounts is a snapshot of shadow read outcomes
+type ShadowCounts struct {
+	Matches    int64 `json:"matches"`
+	Mismatches int64 `json:"mismatches"`
+	Errors     int64 `json:"errors"`
+	Skipped    int64 `json:"skipped"`
+}
+
+// ShadowMatch records a secondary chunk whose hash matched
+func ShadowMatch() { shadowMatches.Add(1) }
+
+// ShadowMismatch records a secondary chunk whose hash differed
+func ShadowMismatch() { shadowMismatches.Add(1) }
+
+// ShadowError records a secondary read that failed
+func ShadowError() { shadowErrors.Add(1) }
+
+// ShadowSkipped records a comparison dropped because too many were in flight
+func ShadowSkipped() { shadowSkipped.Add(1) }
+
+// Shadow returns the current shadow read counts
+func Shadow() ShadowCounts {
+	return ShadowCounts{
+		Matches:    shadowMatches.Load(),
+		Mismatches: shadowMismatches.Load(),
+		Errors:     shadowErrors.Load(),
+		Skipped:    shadowSkipped.Load(),
+	}
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import "sync/atomic"
+
+// Active read and write streams are counted separately since they have
+// different resource profiles (reads hold chunk buffers, writes hold the
+// upload pipeline)
+var (
+	activeReads  atomic.Int64
+	activeWrites atomic.Int64
+)
+
+// StartRead counts a read stream as active until the returned func is called.
+// Use as: defer metrics.StartRead()()
+func StartRead() func() {
+	activeReads.Add(1)
+	return func() { activeReads.Add(-1) }
+}
+
+// StartWrite counts a write stream as active until the returned func is called.
+// Use as: defer metrics.StartWrite()()
+func StartWrite() func() {
+	activeWrites.Add(1)
+	return func() { activeWrites.Add(-1) }
+}
+
+// ActiveReads returns the number of read streams currently in progress
+func ActiveReads() int64 {
+	return activeReads.Load()
+}
+
+// ActiveWrites returns the number of write streams currently in progress
+func ActiveWrites() int64 {
+	return activeWrites.Load()
+}
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RequireAdminToken only lets through requests carrying adminToken as a
+// bearer token. With no admin token configured the routes are disabled.
+func RequireAdminToken(adminToken string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if adminToken == "" {
+				http.Error(w, "admin endpoints are disabled", http.StatusForbidden)
+				return
+			}
+
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || !hasToken(token, adminToken) {
+				http.Error(w, "invalid admin token", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/maneesh/labdropbox/internal/capacity"
+)
+
+// RejectWhenFull fails requests with 507 while stored bytes are at or over
+// the guard's soft limit. Wrap only the routes that store new data.
+func RejectWhenFull(guard *capacity.Guard) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !guard.Full() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			used, limit := guard.Usage()
+			http.Error(w, fmt.Sprintf("storage is near capacity: %d of %d bytes used", used, limit),
+				http.StatusInsufficientStorage)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// DebugTokenHeader enables debug logging for a single request when it
+// carries the admin token
+const DebugTokenHeader = "X-Debug-Token"
+
+// maxLoggedBodyBytes caps how much of a JSON response body is logged
+const maxLoggedBodyBytes = 4096
+
+// loggedHeaders are the request headers worth seeing when debugging a client
+var loggedHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding", "User-Agent", "Accept", "Accept-Encoding"}
+
+// redactedHeaders are logged only as present/absent, never by value
+var redactedHeaders = []string{"Authorization", "Cookie", DebugTokenHeader}
+
+// DebugLog logs request metadata (method, path, query, key headers) and JSON
+// response bodies for debugging client integrations. It is active for every
+// request when enabled is true, or per request when the request carries
+// adminToken in the X-Debug-Token header. Request bodies and non-JSON
+// responses (i.e. chunk data) are never logged.
+func DebugLog(enabled bool, adminToken string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !enabled && !hasToken(r.Header.Get(DebugTokenHeader), adminToken) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(cw, r)
+
+			attrs := []any{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"query", r.URL.Query(),
+				"headers", debugHeaders(r.Header),
+				"status", cw.status,
+			}
+			if cw.body.Len() > 0 {
+				attrs = append(attrs, "response", cw.body.String())
+			}
+			slog.Info("debug request", attrs...)
+		})
+	}
+}
+
+// hasToken compares tokens in constant time; an empty admin token never matches
+func hasToken(given, adminToken string) bool {
+	if adminToken == "" || given == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(adminToken)) == 1
+}
+
+func debugHeaders(h http.Header) map[string]string {
+	out := make(map[string]string)
+	for _, name := range loggedHeaders {
+		if v := h.Get(name); v != "" {
+			out[name] = v
+		}
+	}
+	for _, name := range redactedHeaders {
+		if h.Get(name) != "" {
+			out[name] = "[REDACTED]"
+		}
+	}
+	return out
+}
+
+// captureWriter records the status and, for JSON responses only, a bounded
+// copy of the body
+type captureWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	isJSON      bool
+	body        bytes.Buffer
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		cw.status = status
+		cw.isJSON = strings.HasPrefix(cw.Header().Get("Content-Type"), "application/json")
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.isJSON && cw.body.Len() < maxLoggedBodyBytes {
+		remaining := maxLoggedBodyBytes - cw.body.Len()
+		cw.body.Write(p[:min(len(p), remaining)])
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming responses working through the wrapper
+func (cw *captureWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
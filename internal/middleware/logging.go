@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/maneesh/labdropbox/internal/logging"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// loggedVars are the path variables added to a request's log lines
+var loggedVars = []string{"file_id", "upload_id", "alias"}
+
+// RequestLogger stores a logger on the request context that tags every line
+// with the request's trace ID, method and path, plus any file ID, upload ID
+// or alias in the path. Handlers log through logging.FromContext. It must
+// sit inside the otelhttp handler for the span to be available.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		args := []any{"method", r.Method, "path", r.URL.Path}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			args = append(args, "trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+		}
+		vars := mux.Vars(r)
+		for _, name := range loggedVars {
+			if v, ok := vars[name]; ok {
+				args = append(args, name, v)
+			}
+		}
+
+		ctx := logging.With(r.Context(), args...)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
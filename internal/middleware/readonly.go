@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/maneesh/labdropbox/internal/maintenance"
+)
+
+// RejectWhenReadOnly fails requests with 503 while the service is in
+// read-only mode. Wrap only the routes that modify files.
+func RejectWhenReadOnly(mode *maintenance.Mode) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status := mode.Status()
+			if !status.ReadOnly {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			msg := "service is in read-only mode"
+			if status.Reason != "" {
+				msg = fmt.Sprintf("%s: %s", msg, status.Reason)
+			}
+			http.Error(w, msg, http.StatusServiceUnavailable)
+		})
+	}
+}
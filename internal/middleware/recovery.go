@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/maneesh/labdropbox/internal/logging"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Recover catches panics from the wrapped handler, logs them with the stack
+// trace through the request logger, records them on the request span and
+// responds with a JSON 500 instead of dropping the connection. A response
+// that has already started is aborted instead, so a partial body isn't
+// followed by the error. The panic is only recorded on the request span when
+// Recover sits inside the otelhttp handler.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &startedWriter{ResponseWriter: w}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// ErrAbortHandler is the sanctioned way to abort a response
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			err := fmt.Errorf("panic: %v", rec)
+			span := trace.SpanFromContext(r.Context())
+			span.RecordError(err, trace.WithStackTrace(true))
+			span.SetStatus(codes.Error, err.Error())
+
+			logging.FromContext(r.Context()).Error("recovered from panic",
+				"error", err.Error(),
+				"stack", string(debug.Stack()),
+			)
+
+			// A response already under way can't become a 500; cut the
+			// connection so the client sees it was incomplete
+			if sw.started {
+				panic(http.ErrAbortHandler)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}()
+
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// startedWriter records whether a response has been started
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (sw *startedWriter) WriteHeader(code int) {
+	sw.started = true
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *startedWriter) Write(p []byte) (int, error) {
+	sw.started = true
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming responses working through the wrapper
+func (sw *startedWriter) Flush() {
+	sw.started = true
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sw *startedWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// rateCheckBytes is how much of a response is written per write deadline, so
+// progress is checked regularly even when the handler writes one big buffer
+const rateCheckBytes = 64 * 1024
+
+// MinDownloadRate aborts responses that the client drains slower than
+// bytesPerSec. Each slice of the body gets a write deadline of window plus the
+// time it should take at the minimum rate, pushed forward as the client makes
+// progress; a client that stalls past it has its connection closed. A zero
+// rate disables the check.
+func MinDownloadRate(bytesPerSec int64, window time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if bytesPerSec <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := &rateWriter{
+				ResponseWriter: w,
+				rc:             http.NewResponseController(w),
+				bytesPerSec:    bytesPerSec,
+				window:         window,
+			}
+			next.ServeHTTP(rw, r)
+
+			if errors.Is(rw.err, os.ErrDeadlineExceeded) {
+				slog.Warn("aborted slow download",
+					"path", r.URL.Path,
+					"remote_addr", r.RemoteAddr,
+					"bytes_written", rw.written,
+					"min_bytes_per_sec", bytesPerSec,
+				)
+			}
+		})
+	}
+}
+
+// rateWriter enforces the minimum rate by refreshing the connection's write
+// deadline before each slice of the body
+type rateWriter struct {
+	http.ResponseWriter
+	rc          *http.ResponseController
+	bytesPerSec int64
+	window      time.Duration
+	written     int64
+	err         error
+}
+
+func (rw *rateWriter) Write(p []byte) (int, error) {
+	if rw.err != nil {
+		return 0, rw.err
+	}
+
+	var total int
+	for len(p) > 0 {
+		n := min(len(p), rateCheckBytes)
+		allowed := rw.window + time.Duration(int64(n)*int64(time.Second)/rw.bytesPerSec)
+		if err := rw.rc.SetWriteDeadline(time.Now().Add(allowed)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			rw.err = err
+			return total, err
+		}
+
+		written, err := rw.ResponseWriter.Write(p[:n])
+		total += written
+		rw.written += int64(written)
+		if err != nil {
+			rw.err = err
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// Flush keeps streaming responses working through the wrapper
+func (rw *rateWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rw *rateWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
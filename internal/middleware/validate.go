@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// nameParams are query parameters that become stored names, so they get the
+// stricter name checks on top of the generic ones
+var nameParams = []string{"name", "alias"}
+
+// ValidationOptions bounds request parameters accepted by ValidateRequest
+type ValidationOptions struct {
+	// MaxNameLength is the longest file name or alias accepted
+	MaxNameLength int
+	// MaxParamLength is the longest value accepted for any other query
+	// parameter or path variable
+	MaxParamLength int
+}
+
+// ValidateRequest rejects requests with oversized parameters, control
+// characters, or invalid UTF-8 or path separators in names with 400 before
+// they reach a handler. It must be installed with router.Use so path variables are set.
+func ValidateRequest(opts ValidationOptions) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := validateParams(r, opts); err != nil {
+				http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func validateParams(r *http.Request, opts ValidationOptions) error {
+	for key, value := range mux.Vars(r) {
+		if err := checkValue(key, value, opts.MaxParamLength); err != nil {
+			return err
+		}
+	}
+
+	for key, values := range r.URL.Query() {
+		for _, value := range values {
+			var err error
+			if isNameParam(key) {
+				err = checkName(key, value, opts.MaxNameLength)
+			} else {
+				err = checkValue(key, value, opts.MaxParamLength)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkValue rejects values longer than maxLen or containing control characters
+func checkValue(key, value string, maxLen int) error {
+	if maxLen > 0 && len(value) > maxLen {
+		return fmt.Errorf("%s is longer than %d bytes", key, maxLen)
+	}
+	if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%s contains control characters", key)
+	}
+	return nil
+}
+
+// checkName additionally rejects invalid UTF-8, since names are echoed back
+// in response headers, and path separators and "." or "..", so a name can
+// never be interpreted as a path
+func checkName(key, value string, maxLen int) error {
+	if err := checkValue(key, value, maxLen); err != nil {
+		return err
+	}
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("%s must be valid UTF-8", key)
+	}
+	// Handlers store names trimmed, so " .. " must be caught as ".."
+	trimmed := strings.TrimSpace(value)
+	if strings.ContainsAny(value, `/\`) || trimmed == "." || trimmed == ".." {
+		return fmt.Errorf("%s must not contain path separators or be a relative path", key)
+	}
+	return nil
+}
+
+func isNameParam(key string) bool {
+	for _, name := range nameParams {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,21 @@ package models
 
 import "time"
 
+// Upload status of a file. A file is pending from the moment its row is
+// created until all of its chunk rows are saved.
+const (
+	FileStatusPending  = "pending"
+	FileStatusComplete = "complete"
+)
+
+// MetadataContentEncoding is the File.Metadata key holding the encoding the
+// file's bytes are stored in (e.g. "gzip"); absent means stored as uploaded
+const MetadataContentEncoding = "content_encoding"
+
+// MetadataEncryption is the File.Metadata key naming the scheme the file's
+// chunk objects are encrypted with; absent means stored in plaintext
+const MetadataEncryption = "encryption"
+
 // File represents file metadata stored in TiDB
 type File struct {
 	ID         string    `json:"id"`
@@ -9,6 +24,42 @@ type File struct {
 	Size       int64     `json:"size"`
 	ChunkCount int       `json:"chunk_count"`
 	CreatedAt  time.Time `json:"created_at"`
+	Status     string    `json:"status,omitempty"`
+
+	// Object-lock retention applied to the file's chunks, if any
+	RetentionMode string     `json:"retention_mode,omitempty"`
+	RetainUntil   *time.Time `json:"retain_until,omitempty"`
+
+	// How the file was chunked when written (empty for files written before
+	// this was recorded)
+	ChunkingStrategy string `json:"chunking_strategy,omitempty"`
+	TargetChunkSize  int64  `json:"target_chunk_size,omitempty"`
+
+	// Hex SHA256 of the whole file as stored, checked on read. Empty for
+	// files written before it was recorded or appended to since.
+	Checksum string `json:"checksum,omitempty"`
+
+	// MIME type served on read. Empty for files written before it was
+	// recorded, which are served as application/octet-stream.
+	ContentType string `json:"content_type,omitempty"`
+
+	// Extensible attributes stored in the files.metadata JSON column. Fields
+	// that need indexing or filtering belong in their own column instead.
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+// ContentEncoding returns the encoding the file is stored in, or "" if it
+// is stored unencoded
+func (f *File) ContentEncoding() string {
+	encoding, _ := f.Metadata[MetadataContentEncoding].(string)
+	return encoding
+}
+
+// Encryption returns the scheme the file's chunks are encrypted with, or ""
+// if they are stored in plaintext
+func (f *File) Encryption() string {
+	encryption, _ := f.Metadata[MetadataEncryption].(string)
+	return encryption
 }
 
 // Chunk represents a chunk of a file
@@ -19,6 +70,11 @@ type Chunk struct {
 	Hash           string `json:"hash"`
 	MinioObjectKey string `json:"minio_object_key"`
 	Size           int64  `json:"size"`
+
+	// How the object is compressed ("none" if compression didn't help, empty
+	// if it wasn't tried) and its size in MinIO. Size stays the original size.
+	Compression string `json:"compression,omitempty"`
+	StoredSize  int64  `json:"stored_size,omitempty"`
 }
 
 // ChunkData holds chunk information during upload/download
@@ -28,3 +84,27 @@ type ChunkData struct {
 	Hash       string
 	Size       int64
 }
+
+// Alias is a short, shareable name for a file
+type Alias struct {
+	Alias     string     `json:"alias"`
+	FileID    string     `json:"file_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// UploadSession is a resumable upload whose chunks the client uploads one
+// at a time, in any order, before completing it into a file
+type UploadSession struct {
+	ID         string    `json:"upload_id"`
+	FileID     string    `json:"file_id"`
+	Name       string    `json:"file_name"`
+	ChunkCount int       `json:"chunk_count"`
+	Encrypted  bool      `json:"encrypted"`
+	Client     string    `json:"client"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// Chunks holds the chunks received so far, by order index. They are
+	// stored alongside the session, not in its JSON.
+	Chunks map[int]*Chunk `json:"-"`
+}
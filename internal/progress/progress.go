@@ -0,0 +1,122 @@
+package progress
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RetentionPeriod is how long a finished upload's final progress stays
+// available to late subscribers before it is forgotten
+const RetentionPeriod = time.Minute
+
+// Progress is a point-in-time snapshot of an upload
+type Progress struct {
+	UploadID       string `json:"upload_id"`
+	FileID         string `json:"file_id"`
+	BytesReceived  int64  `json:"bytes_received"`
+	ChunksUploaded int    `json:"chunks_uploaded"`
+	Done           bool   `json:"done"`
+	Error          string `json:"error,omitempty"`
+}
+
+type entry struct {
+	progress Progress
+	// changed is closed and replaced on every update to wake up watchers
+	changed chan struct{}
+}
+
+// Registry tracks in-flight uploads in memory, keyed by upload ID
+type Registry struct {
+	mu      sync.Mutex
+	uploads map[string]*entry
+}
+
+// NewRegistry creates an empty progress registry
+func NewRegistry() *Registry {
+	return &Registry{
+		uploads: make(map[string]*entry),
+	}
+}
+
+// Start registers a new upload. It fails if the upload ID is already in use.
+func (r *Registry) Start(uploadID, fileID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.uploads[uploadID]; exists {
+		return fmt.Errorf("upload %s is already tracked", uploadID)
+	}
+
+	r.uploads[uploadID] = &entry{
+		progress: Progress{UploadID: uploadID, FileID: fileID},
+		changed:  make(chan struct{}),
+	}
+	return nil
+}
+
+// AddBytes records bytes received for an upload
+func (r *Registry) AddBytes(uploadID string, n int64) {
+	r.update(uploadID, func(p *Progress) {
+		p.BytesReceived += n
+	})
+}
+
+// AddChunk records a chunk successfully uploaded to storage
+func (r *Registry) AddChunk(uploadID string) {
+	r.update(uploadID, func(p *Progress) {
+		p.ChunksUploaded++
+	})
+}
+
+// Finish marks an upload as done (with an error if it failed) and schedules
+// its removal after RetentionPeriod
+func (r *Registry) Finish(uploadID string, err error) {
+	if r == nil || uploadID == "" {
+		return
+	}
+
+	r.update(uploadID, func(p *Progress) {
+		p.Done = true
+		if err != nil {
+			p.Error = err.Error()
+		}
+	})
+
+	time.AfterFunc(RetentionPeriod, func() {
+		r.mu.Lock()
+		delete(r.uploads, uploadID)
+		r.mu.Unlock()
+	})
+}
+
+// Watch returns the current progress of an upload and a channel that is
+// closed on its next update. ok is false if the upload is unknown.
+func (r *Registry) Watch(uploadID string) (Progress, <-chan struct{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.uploads[uploadID]
+	if !ok {
+		return Progress{}, nil, false
+	}
+	return e.progress, e.changed, true
+}
+
+func (r *Registry) update(uploadID string, fn func(*Progress)) {
+	if r == nil || uploadID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.uploads[uploadID]
+	if !ok {
+		return
+	}
+
+	fn(&e.progress)
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
@@ -3,12 +3,21 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand/v2"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/maneesh/labdropbox/internal/metrics"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/sony/gobreaker"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -16,25 +25,117 @@ import (
 
 var tracer = otel.Tracer("labdropbox-storage")
 
+// ErrObjectLocked is returned when deleting a chunk that is still under
+// object-lock retention
+var ErrObjectLocked = errors.New("object is under retention and cannot be deleted yet")
+
+// ErrStorageUnavailable is returned without contacting MinIO while the
+// circuit breaker is open after repeated failures
+var ErrStorageUnavailable = errors.New("object storage is unavailable")
+
+// ErrChunkNotFound is returned when a chunk object is missing from the bucket
+var ErrChunkNotFound = errors.New("chunk not found")
+
+// multipartThreshold is the object size from which minio-go uploads in
+// parts, which can be left behind as incomplete uploads
+const multipartThreshold = 16 * 1024 * 1024
+
+// maxRetryDelay caps the backoff between retries of a MinIO call
+const maxRetryDelay = 10 * time.Second
+
+// Retention is an object-lock (WORM) retention setting for chunk objects
+type Retention struct {
+	Mode        string // "GOVERNANCE" or "COMPLIANCE"
+	RetainUntil time.Time
+}
+
+// MinioOptions configures a MinioClient
+type MinioOptions struct {
+	UseSSL bool
+
+	// ObjectLocking creates a new bucket with object lock enabled; an
+	// existing bucket must already have it, since it cannot be turned on
+	// after creation
+	ObjectLocking bool
+
+	// KeySecret, if set, makes chunk object keys an HMAC of the file ID and
+	// index so they don't reveal file IDs to anyone listing the bucket
+	KeySecret string
+
+	// WriteCheck writes and deletes a canary object at startup to confirm
+	// the credentials can upload and delete, not just see the bucket
+	WriteCheck bool
+
+	// BreakerFailures is the number of consecutive failures that opens the
+	// circuit breaker (0 disables it)
+	BreakerFailures uint32
+	// BreakerOpenTimeout is how long the breaker stays open before letting
+	// a probe request through
+	BreakerOpenTimeout time.Duration
+
+	// MaxRetries is how many times a chunk upload or download that failed
+	// with a transient error is retried, waiting RetryBaseDelay doubled per
+	// attempt (with jitter) in between
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+
+	// OpTimeout bounds each MinIO call, and each attempt of a retried one
+	// (0 leaves them to the caller's context). An attempt that times out is
+	// retried like a transient error.
+	OpTimeout time.Duration
+}
+
 // MinioClient wraps MinIO operations with tracing
 type MinioClient struct {
-	client     *minio.Client
-	bucketName string
+	client        *minio.Client
+	bucketName    string
+	objectLocking bool
+	keySecret     []byte
+	breaker       *gobreaker.CircuitBreaker
+
+	maxRetries     int
+	retryBaseDelay time.Duration
+	opTimeout      time.Duration
 }
 
 // NewMinioClient initializes a new MinIO client
-func NewMinioClient(endpoint, accessKey, secretKey, bucketName string, useSSL bool) (*MinioClient, error) {
+func NewMinioClient(endpoint, accessKey, secretKey, bucketName string, opts MinioOptions) (*MinioClient, error) {
 	client, err := minio.New(endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
-		Secure: useSSL,
+		Secure: opts.UseSSL,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create MinIO client: %w", err)
 	}
 
 	mc := &MinioClient{
-		client:     client,
-		bucketName: bucketName,
+		client:        client,
+		bucketName:    bucketName,
+		objectLocking: opts.ObjectLocking,
+
+		maxRetries:     opts.MaxRetries,
+		retryBaseDelay: opts.RetryBaseDelay,
+		opTimeout:      opts.OpTimeout,
+	}
+	if opts.KeySecret != "" {
+		mc.keySecret = []byte(opts.KeySecret)
+	}
+
+	if opts.BreakerFailures > 0 {
+		mc.breaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    "minio",
+			Timeout: opts.BreakerOpenTimeout,
+			ReadyToTrip: func(counts gobreaker.Counts) bool {
+				return counts.ConsecutiveFailures >= opts.BreakerFailures
+			},
+			// Missing objects and cancelled requests say nothing about MinIO's health
+			IsSuccessful: func(err error) bool {
+				return err == nil || IsNotFound(err) || errors.Is(err, context.Canceled)
+			},
+			OnStateChange: func(name string, from, to gobreaker.State) {
+				log.Printf("Circuit breaker %s: %s -> %s", name, from, to)
+			},
+		})
 	}
 
 	// Ensure bucket exists
@@ -46,18 +147,202 @@ func NewMinioClient(endpoint, accessKey, secretKey, bucketName string, useSSL bo
 
 	if !exists {
 		log.Printf("Creating bucket: %s", bucketName)
-		err = client.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{})
+		err = client.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{ObjectLocking: opts.ObjectLocking})
 		if err != nil {
 			return nil, fmt.Errorf("failed to create bucket: %w", err)
 		}
 		log.Printf("Bucket %s created successfully", bucketName)
+	} else if opts.ObjectLocking {
+		if _, _, _, _, err := client.GetObjectLockConfig(ctx, bucketName); err != nil {
+			return nil, fmt.Errorf("object locking requested but bucket %s does not support it: %w", bucketName, err)
+		}
+	}
+
+	if opts.WriteCheck {
+		if err := mc.checkWritable(ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	return mc, nil
 }
 
-// UploadChunk uploads a chunk to MinIO with tracing
-func (mc *MinioClient) UploadChunk(ctx context.Context, objectKey string, data []byte) error {
+// checkWritable uploads and removes a tiny canary object
+func (mc *MinioClient) checkWritable(ctx context.Context) error {
+	key := fmt.Sprintf("_write_check/%s", uuid.New().String())
+	data := []byte("labdropbox write check")
+
+	_, err := mc.client.PutObject(ctx, mc.bucketName, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("write check failed: cannot upload to bucket %s: %w", mc.bucketName, err)
+	}
+
+	if err := mc.client.RemoveObject(ctx, mc.bucketName, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("write check failed: cannot delete from bucket %s (canary %s left behind): %w", mc.bucketName, key, err)
+	}
+
+	log.Printf("Bucket %s is writable", mc.bucketName)
+	return nil
+}
+
+// Ping checks that MinIO is reachable and the bucket exists
+func (mc *MinioClient) Ping(ctx context.Context) error {
+	exists, err := mc.client.BucketExists(ctx, mc.bucketName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", mc.bucketName)
+	}
+	return nil
+}
+
+// BreakerState returns the circuit breaker state ("closed", "open",
+// "half-open"), or "disabled" if there is no breaker
+func (mc *MinioClient) BreakerState() string {
+	if mc.breaker == nil {
+		return "disabled"
+	}
+	return mc.breaker.State().String()
+}
+
+// execute runs op through the circuit breaker, if enabled. While the breaker
+// is open it fails fast with ErrStorageUnavailable instead of calling MinIO.
+func (mc *MinioClient) execute(span trace.Span, op func() error) error {
+	if mc.breaker == nil {
+		return op()
+	}
+
+	_, err := mc.breaker.Execute(func() (interface{}, error) {
+		return nil, op()
+	})
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		span.SetAttributes(attribute.String("circuit_breaker", mc.breaker.State().String()))
+		return fmt.Errorf("%w: %v", ErrStorageUnavailable, err)
+	}
+	return err
+}
+
+// opContext bounds one MinIO call by the configured timeout, so a slow call
+// fails with context.DeadlineExceeded instead of holding the request
+func (mc *MinioClient) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if mc.opTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, mc.opTimeout)
+}
+
+// retry runs op until it succeeds, fails with an error that is not
+// transient, or has been retried maxRetries times. Each attempt gets its own
+// opContext. The number of retries is recorded on span as retry_count.
+// Backoff waits end early when ctx is done.
+func (mc *MinioClient) retry(ctx context.Context, span trace.Span, op func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := mc.opContext(ctx)
+		err := op(attemptCtx)
+		timedOut := attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+		if timedOut {
+			span.AddEvent("minio_op_timeout", trace.WithAttributes(
+				attribute.Int("attempt", attempt),
+				attribute.Int64("timeout_ms", mc.opTimeout.Milliseconds()),
+			))
+		}
+		if err == nil || attempt >= mc.maxRetries || !(timedOut || isTransient(err)) || ctx.Err() != nil {
+			span.SetAttributes(attribute.Int("retry_count", attempt))
+			return err
+		}
+
+		// Full delay doubles per attempt; sleep a random half to all of it
+		delay := mc.retryBaseDelay << attempt
+		if delay <= 0 || delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+		delay = delay/2 + rand.N(delay/2+1)
+		span.AddEvent("minio_retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt+1),
+			attribute.Int64("delay_ms", delay.Milliseconds()),
+			attribute.String("error", err.Error()),
+		))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			span.SetAttributes(attribute.Int("retry_count", attempt))
+			return err
+		}
+	}
+}
+
+// isTransient reports whether a failed MinIO call may succeed if retried:
+// network errors and server-side (5xx) errors, but not cancellations or
+// client errors such as NoSuchBucket, NoSuchKey or AccessDenied
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var errResp minio.ErrorResponse
+	if errors.As(err, &errResp) {
+		switch errResp.Code {
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+			return true
+		}
+		return errResp.StatusCode >= 500
+	}
+	return true
+}
+
+// ChunkKey returns the object key for a file's chunk. The key is
+// chunks/{fileID}/{index}, or an opaque HMAC of the same when a key secret is
+// configured. A non-empty suffix distinguishes objects written for the same
+// index (e.g. by appends). Keys are stored in chunk metadata, so changing the
+// secret only affects new uploads.
+func (mc *MinioClient) ChunkKey(fileID string, index int, suffix string) string {
+	key := fmt.Sprintf("%s/%d", fileID, index)
+	if suffix != "" {
+		key = fmt.Sprintf("%s-%s", key, suffix)
+	}
+	if mc.keySecret == nil {
+		return "chunks/" + key
+	}
+
+	mac := hmac.New(sha256.New, mc.keySecret)
+	mac.Write([]byte(key))
+	return "chunks/" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ContentKey returns the content-addressed object key for a chunk with the
+// given SHA256 hash, chunks/{hash[:2]}/{hash}, so identical chunks from any
+// file share one object. With a key secret the hash is replaced by its HMAC.
+// A non-empty suffix keeps differently stored copies of the same content
+// (e.g. encrypted ones) apart.
+func (mc *MinioClient) ContentKey(hash, suffix string) string {
+	key := hash
+	if mc.keySecret != nil {
+		mac := hmac.New(sha256.New, mc.keySecret)
+		mac.Write([]byte(hash))
+		key = hex.EncodeToString(mac.Sum(nil))
+	}
+	if len(key) >= 2 {
+		key = key[:2] + "/" + key
+	}
+	if suffix != "" {
+		key = fmt.Sprintf("%s-%s", key, suffix)
+	}
+	return "chunks/" + key
+}
+
+// ObjectLockingEnabled reports whether the bucket supports retention settings
+func (mc *MinioClient) ObjectLockingEnabled() bool {
+	return mc.objectLocking
+}
+
+// UploadChunk uploads a chunk to MinIO with tracing. A non-nil retention
+// locks the object until the given date.
+func (mc *MinioClient) UploadChunk(ctx context.Context, objectKey string, data []byte, retention *Retention) error {
 	ctx, span := tracer.Start(ctx, "minio.upload_chunk",
 		trace.WithAttributes(
 			attribute.String("object_key", objectKey),
@@ -66,13 +351,33 @@ func (mc *MinioClient) UploadChunk(ctx context.Context, objectKey string, data [
 	)
 	defer span.End()
 
-	reader := bytes.NewReader(data)
-	_, err := mc.client.PutObject(ctx, mc.bucketName, objectKey, reader, int64(len(data)), minio.PutObjectOptions{
+	opts := minio.PutObjectOptions{
 		ContentType: "application/octet-stream",
+	}
+	if retention != nil {
+		opts.Mode = minio.RetentionMode(retention.Mode)
+		opts.RetainUntilDate = retention.RetainUntil
+		span.SetAttributes(
+			attribute.String("retention_mode", retention.Mode),
+			attribute.String("retain_until", retention.RetainUntil.Format(time.RFC3339)),
+		)
+	}
+
+	start := time.Now()
+	err := mc.execute(span, func() error {
+		return mc.retry(ctx, span, func(ctx context.Context) error {
+			reader := bytes.NewReader(data)
+			_, err := mc.client.PutObject(ctx, mc.bucketName, objectKey, reader, int64(len(data)), opts)
+			return err
+		})
 	})
+	metrics.RecordChunkUploadDuration(ctx, time.Since(start), err)
 
 	if err != nil {
 		span.RecordError(err)
+		if len(data) >= multipartThreshold {
+			mc.abortIncompleteUpload(ctx, objectKey)
+		}
 		return fmt.Errorf("failed to upload chunk: %w", err)
 	}
 
@@ -80,6 +385,49 @@ func (mc *MinioClient) UploadChunk(ctx context.Context, objectKey string, data [
 	return nil
 }
 
+// abortIncompleteUpload discards the parts of a failed multipart upload.
+// minio-go aborts on error itself, but with the request context, which is
+// already done when the upload failed on a timeout or cancellation.
+func (mc *MinioClient) abortIncompleteUpload(ctx context.Context, objectKey string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+
+	if err := mc.client.RemoveIncompleteUpload(ctx, mc.bucketName, objectKey); err != nil {
+		log.Printf("Warning: failed to abort incomplete upload of %s: %v", objectKey, err)
+	}
+}
+
+// AbortStaleUploads aborts incomplete multipart uploads of chunk objects
+// started more than olderThan ago, e.g. by a crashed server, and returns how
+// many were removed. Their parts otherwise use storage until aborted.
+func (mc *MinioClient) AbortStaleUploads(ctx context.Context, olderThan time.Duration) (int, error) {
+	ctx, span := tracer.Start(ctx, "minio.abort_stale_uploads",
+		trace.WithAttributes(
+			attribute.Int64("older_than_seconds", int64(olderThan.Seconds())),
+		),
+	)
+	defer span.End()
+
+	aborted := 0
+	for upload := range mc.client.ListIncompleteUploads(ctx, mc.bucketName, "chunks/", true) {
+		if upload.Err != nil {
+			span.RecordError(upload.Err)
+			return aborted, fmt.Errorf("failed to list incomplete uploads: %w", upload.Err)
+		}
+		if time.Since(upload.Initiated) < olderThan {
+			continue
+		}
+		if err := mc.client.RemoveIncompleteUpload(ctx, mc.bucketName, upload.Key); err != nil {
+			span.RecordError(err)
+			return aborted, fmt.Errorf("failed to abort incomplete upload of %s: %w", upload.Key, err)
+		}
+		aborted++
+	}
+
+	span.SetAttributes(attribute.Int("aborted", aborted))
+	return aborted, nil
+}
+
 // DownloadChunk downloads a chunk from MinIO with tracing
 func (mc *MinioClient) DownloadChunk(ctx context.Context, objectKey string) ([]byte, error) {
 	ctx, span := tracer.Start(ctx, "minio.download_chunk",
@@ -89,17 +437,31 @@ func (mc *MinioClient) DownloadChunk(ctx context.Context, objectKey string) ([]b
 	)
 	defer span.End()
 
-	object, err := mc.client.GetObject(ctx, mc.bucketName, objectKey, minio.GetObjectOptions{})
-	if err != nil {
-		span.RecordError(err)
-		return nil, fmt.Errorf("failed to get object: %w", err)
-	}
-	defer object.Close()
+	var data []byte
+	start := time.Now()
+	err := mc.execute(span, func() error {
+		return mc.retry(ctx, span, func(ctx context.Context) error {
+			object, err := mc.client.GetObject(ctx, mc.bucketName, objectKey, minio.GetObjectOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to get object: %w", err)
+			}
+			defer object.Close()
 
-	data, err := io.ReadAll(object)
-	if err != nil {
+			// A connection reset mid-body fails here, so the read is retried too
+			data, err = io.ReadAll(object)
+			if err != nil {
+				return fmt.Errorf("failed to read object data: %w", err)
+			}
+			return nil
+		})
+	})
+	metrics.RecordChunkDownloadDuration(ctx, time.Since(start), err)
+	if IsNotFound(err) {
+		span.SetAttributes(attribute.Bool("found", false))
+		return nil, fmt.Errorf("%w: %s: %w", ErrChunkNotFound, objectKey, err)
+	} else if err != nil {
 		span.RecordError(err)
-		return nil, fmt.Errorf("failed to read object data: %w", err)
+		return nil, err
 	}
 
 	span.SetAttributes(
@@ -109,7 +471,69 @@ func (mc *MinioClient) DownloadChunk(ctx context.Context, objectKey string) ([]b
 	return data, nil
 }
 
-// DeleteChunk deletes a chunk from MinIO
+// ChunkExists reports whether an object with the given key is stored
+func (mc *MinioClient) ChunkExists(ctx context.Context, objectKey string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "minio.chunk_exists",
+		trace.WithAttributes(
+			attribute.String("object_key", objectKey),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := mc.opContext(ctx)
+	defer cancel()
+
+	exists := true
+	err := mc.execute(span, func() error {
+		_, err := mc.client.StatObject(ctx, mc.bucketName, objectKey, minio.StatObjectOptions{})
+		if IsNotFound(err) {
+			// A missing object is an answer, not a failure for the breaker
+			exists = false
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		span.RecordError(err)
+		return false, fmt.Errorf("failed to stat chunk: %w", err)
+	}
+
+	span.SetAttributes(attribute.Bool("exists", exists))
+	return exists, nil
+}
+
+// CopyChunk copies a chunk object to a new key server-side, without
+// transferring the data through this service
+func (mc *MinioClient) CopyChunk(ctx context.Context, srcKey, dstKey string) error {
+	ctx, span := tracer.Start(ctx, "minio.copy_chunk",
+		trace.WithAttributes(
+			attribute.String("src_object_key", srcKey),
+			attribute.String("dst_object_key", dstKey),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := mc.opContext(ctx)
+	defer cancel()
+
+	err := mc.execute(span, func() error {
+		_, err := mc.client.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: mc.bucketName, Object: dstKey},
+			minio.CopySrcOptions{Bucket: mc.bucketName, Object: srcKey},
+		)
+		return err
+	})
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to copy chunk: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteChunk deletes a chunk from MinIO. Object locking turns on bucket
+// versioning, where a plain delete only writes a delete marker, so the
+// current version is removed explicitly and retention can refuse it.
 func (mc *MinioClient) DeleteChunk(ctx context.Context, objectKey string) error {
 	ctx, span := tracer.Start(ctx, "minio.delete_chunk",
 		trace.WithAttributes(
@@ -118,11 +542,38 @@ func (mc *MinioClient) DeleteChunk(ctx context.Context, objectKey string) error
 	)
 	defer span.End()
 
-	err := mc.client.RemoveObject(ctx, mc.bucketName, objectKey, minio.RemoveObjectOptions{})
+	ctx, cancel := mc.opContext(ctx)
+	defer cancel()
+
+	err := mc.execute(span, func() error {
+		var opts minio.RemoveObjectOptions
+		if mc.objectLocking {
+			info, err := mc.client.StatObject(ctx, mc.bucketName, objectKey, minio.StatObjectOptions{})
+			if IsNotFound(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			opts.VersionID = info.VersionID
+		}
+		return mc.client.RemoveObject(ctx, mc.bucketName, objectKey, opts)
+	})
 	if err != nil {
 		span.RecordError(err)
+		if mc.objectLocking && minio.ToErrorResponse(err).Code == "AccessDenied" {
+			return fmt.Errorf("failed to delete chunk %s: %w", objectKey, ErrObjectLocked)
+		}
 		return fmt.Errorf("failed to delete chunk: %w", err)
 	}
 
 	return nil
 }
+
+// IsNotFound reports whether err is a MinIO "NoSuchKey" error
+func IsNotFound(err error) bool {
+	var errResp minio.ErrorResponse
+	if errors.As(err, &errResp) {
+		return errResp.Code == "NoSuchKey"
+	}
+	return false
+}
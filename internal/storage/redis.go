@@ -13,30 +13,84 @@ import (
 )
 
 const (
-	// CacheTTL is the time-to-live for cached file metadata (5 minutes)
-	CacheTTL = 5 * time.Minute
+	// DefaultCacheTTL is the default time-to-live for cached file metadata
+	// and chunk lists (5 minutes)
+	DefaultCacheTTL = 5 * time.Minute
 )
 
 // RedisClient wraps Redis operations with tracing
 type RedisClient struct {
-	client *redis.Client
+	client   *redis.Client
+	cacheTTL time.Duration
 }
 
-// NewRedisClient initializes a new Redis client
-func NewRedisClient(addr, password string, db int) (*RedisClient, error) {
+// NewRedisClient initializes a new Redis client. cacheTTL is how long file
+// metadata and chunk lists stay cached; 0 caches them without expiry.
+// opTimeout bounds each command or pipeline (0 leaves them to the caller's
+// context).
+func NewRedisClient(addr, password string, db int, cacheTTL, opTimeout time.Duration) (*RedisClient, error) {
 	client := redis.NewClient(&redis.Options{
 		Addr:     addr,
 		Password: password,
 		DB:       db,
+
+		// Socket deadlines follow the context, so opTimeout applies
+		ContextTimeoutEnabled: opTimeout > 0,
 	})
+	if opTimeout > 0 {
+		client.AddHook(opTimeoutHook{timeout: opTimeout})
+	}
 
 	// Test the connection
 	ctx := context.Background()
 	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
 		return nil, fmt.Errorf("failed to ping Redis: %w", err)
 	}
 
-	return &RedisClient{client: client}, nil
+	return &RedisClient{client: client, cacheTTL: cacheTTL}, nil
+}
+
+// opTimeoutHook runs every Redis command and pipeline under a timeout. A
+// command that runs out of time fails with an error wrapping
+// context.DeadlineExceeded, whatever the network layer reported.
+type opTimeoutHook struct {
+	timeout time.Duration
+}
+
+func (h opTimeoutHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h opTimeoutHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, cancel := context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+		return h.classify(ctx, next(ctx, cmd), cmd)
+	}
+}
+
+func (h opTimeoutHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, cancel := context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+		return h.classify(ctx, next(ctx, cmds), cmds...)
+	}
+}
+
+// classify rewrites err, and the errors of cmds, as deadline errors if the
+// operation's timeout expired
+func (h opTimeoutHook) classify(ctx context.Context, err error, cmds ...redis.Cmder) error {
+	if err == nil || err == redis.Nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	err = fmt.Errorf("%w: redis operation exceeded %s: %v", context.DeadlineExceeded, h.timeout, err)
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && cmd.Err() != redis.Nil {
+			cmd.SetErr(err)
+		}
+	}
+	return err
 }
 
 // Close closes the Redis connection
@@ -44,6 +98,11 @@ func (rc *RedisClient) Close() error {
 	return rc.client.Close()
 }
 
+// Ping checks that Redis is reachable
+func (rc *RedisClient) Ping(ctx context.Context) error {
+	return rc.client.Ping(ctx).Err()
+}
+
 // GetFileMetadata retrieves file metadata from cache with tracing
 func (rc *RedisClient) GetFileMetadata(ctx context.Context, fileID string) (*models.File, error) {
 	ctx, span := tracer.Start(ctx, "redis.get_file_metadata",
@@ -80,6 +139,49 @@ func (rc *RedisClient) GetFileMetadata(ctx context.Context, fileID string) (*mod
 	return &file, nil
 }
 
+// GetFilesMetadata retrieves cached metadata for several files in one round
+// trip. Misses are absent from the returned map.
+func (rc *RedisClient) GetFilesMetadata(ctx context.Context, fileIDs []string) (map[string]*models.File, error) {
+	ctx, span := tracer.Start(ctx, "redis.get_files_metadata",
+		trace.WithAttributes(
+			attribute.Int("file_count", len(fileIDs)),
+		),
+	)
+	defer span.End()
+
+	files := make(map[string]*models.File, len(fileIDs))
+	if len(fileIDs) == 0 {
+		return files, nil
+	}
+
+	keys := make([]string, len(fileIDs))
+	for i, id := range fileIDs {
+		keys[i] = fmt.Sprintf("file:%s", id)
+	}
+
+	values, err := rc.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to get from cache: %w", err)
+	}
+
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue // nil for a miss
+		}
+		var file models.File
+		if err := json.Unmarshal([]byte(data), &file); err != nil {
+			span.RecordError(err)
+			continue
+		}
+		files[fileIDs[i]] = &file
+	}
+
+	span.SetAttributes(attribute.Int("cache_hits", len(files)))
+	return files, nil
+}
+
 // SetFileMetadata stores file metadata in cache with tracing
 func (rc *RedisClient) SetFileMetadata(ctx context.Context, fileID string, file *models.File) error {
 	ctx, span := tracer.Start(ctx, "redis.set_file_metadata",
@@ -97,7 +199,7 @@ func (rc *RedisClient) SetFileMetadata(ctx context.Context, fileID string, file
 		return fmt.Errorf("failed to marshal file: %w", err)
 	}
 
-	err = rc.client.Set(ctx, key, data, CacheTTL).Err()
+	err = rc.client.Set(ctx, key, data, rc.cacheTTL).Err()
 	if err != nil {
 		span.RecordError(err)
 		return fmt.Errorf("failed to set cache: %w", err)
@@ -105,7 +207,7 @@ func (rc *RedisClient) SetFileMetadata(ctx context.Context, fileID string, file
 
 	span.SetAttributes(
 		attribute.Bool("cache_set_success", true),
-		attribute.Int64("ttl_seconds", int64(CacheTTL.Seconds())),
+		attribute.Int64("ttl_seconds", int64(rc.cacheTTL.Seconds())),
 	)
 	return nil
 }
@@ -129,3 +231,176 @@ func (rc *RedisClient) InvalidateFileMetadata(ctx context.Context, fileID string
 	span.SetAttributes(attribute.Bool("cache_invalidate_success", true))
 	return nil
 }
+
+// GetChunks retrieves a file's cached chunk list. A nil slice with a nil
+// error means a cache miss.
+func (rc *RedisClient) GetChunks(ctx context.Context, fileID string) ([]*models.Chunk, error) {
+	ctx, span := tracer.Start(ctx, "redis.get_chunks",
+		trace.WithAttributes(
+			attribute.String("file_id", fileID),
+		),
+	)
+	defer span.End()
+
+	key := fmt.Sprintf("chunks:%s", fileID)
+	data, err := rc.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		span.SetAttributes(attribute.Bool("cache_hit", false))
+		return nil, nil
+	} else if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to get from cache: %w", err)
+	}
+
+	var chunks []*models.Chunk
+	if err := json.Unmarshal([]byte(data), &chunks); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to unmarshal cached chunks: %w", err)
+	}
+
+	span.SetAttributes(
+		attribute.Bool("cache_hit", true),
+		attribute.Int("chunk_count", len(chunks)),
+	)
+	return chunks, nil
+}
+
+// SetChunks caches a file's ordered chunk list
+func (rc *RedisClient) SetChunks(ctx context.Context, fileID string, chunks []*models.Chunk) error {
+	ctx, span := tracer.Start(ctx, "redis.set_chunks",
+		trace.WithAttributes(
+			attribute.String("file_id", fileID),
+			attribute.Int("chunk_count", len(chunks)),
+		),
+	)
+	defer span.End()
+
+	key := fmt.Sprintf("chunks:%s", fileID)
+	data, err := json.Marshal(chunks)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to marshal chunks: %w", err)
+	}
+
+	if err := rc.client.Set(ctx, key, data, rc.cacheTTL).Err(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to set cache: %w", err)
+	}
+	return nil
+}
+
+// InvalidateChunks removes a file's cached chunk list
+func (rc *RedisClient) InvalidateChunks(ctx context.Context, fileID string) error {
+	ctx, span := tracer.Start(ctx, "redis.invalidate_chunks",
+		trace.WithAttributes(
+			attribute.String("file_id", fileID),
+		),
+	)
+	defer span.End()
+
+	key := fmt.Sprintf("chunks:%s", fileID)
+	if err := rc.client.Del(ctx, key).Err(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to invalidate cache: %w", err)
+	}
+	return nil
+}
+
+// GetChunkData retrieves a chunk's cached bytes by hash. A nil slice with a
+// nil error means a cache miss.
+func (rc *RedisClient) GetChunkData(ctx context.Context, hash string) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "redis.get_chunk_data",
+		trace.WithAttributes(
+			attribute.String("chunk_hash", hash),
+		),
+	)
+	defer span.End()
+
+	data, err := rc.client.Get(ctx, fmt.Sprintf("chunk:%s", hash)).Bytes()
+	if err == redis.Nil {
+		span.SetAttributes(attribute.Bool("cache_hit", false))
+		return nil, nil
+	} else if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to get from cache: %w", err)
+	}
+
+	span.SetAttributes(
+		attribute.Bool("cache_hit", true),
+		attribute.Int("size_bytes", len(data)),
+	)
+	return data, nil
+}
+
+// SetChunkData caches a chunk's bytes under its hash
+func (rc *RedisClient) SetChunkData(ctx context.Context, hash string, data []byte, ttl time.Duration) error {
+	ctx, span := tracer.Start(ctx, "redis.set_chunk_data",
+		trace.WithAttributes(
+			attribute.String("chunk_hash", hash),
+			attribute.Int("size_bytes", len(data)),
+		),
+	)
+	defer span.End()
+
+	if err := rc.client.Set(ctx, fmt.Sprintf("chunk:%s", hash), data, ttl).Err(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to set cache: %w", err)
+	}
+	return nil
+}
+
+// GetRecentFiles retrieves a cached "recent files" list for the given limit.
+// A nil slice with a nil error means a cache miss.
+func (rc *RedisClient) GetRecentFiles(ctx context.Context, limit int) ([]*models.File, error) {
+	ctx, span := tracer.Start(ctx, "redis.get_recent_files",
+		trace.WithAttributes(
+			attribute.Int("limit", limit),
+		),
+	)
+	defer span.End()
+
+	key := fmt.Sprintf("files:recent:%d", limit)
+	data, err := rc.client.Get(ctx, key).Result()
+
+	if err == redis.Nil {
+		span.SetAttributes(attribute.String("cache_status", "miss"))
+		return nil, nil
+	} else if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to get from cache: %w", err)
+	}
+
+	files := []*models.File{}
+	if err := json.Unmarshal([]byte(data), &files); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to unmarshal cached data: %w", err)
+	}
+
+	span.SetAttributes(attribute.String("cache_status", "hit"))
+	return files, nil
+}
+
+// SetRecentFiles caches a "recent files" list for the given limit
+func (rc *RedisClient) SetRecentFiles(ctx context.Context, limit int, files []*models.File, ttl time.Duration) error {
+	ctx, span := tracer.Start(ctx, "redis.set_recent_files",
+		trace.WithAttributes(
+			attribute.Int("limit", limit),
+			attribute.Int("file_count", len(files)),
+		),
+	)
+	defer span.End()
+
+	key := fmt.Sprintf("files:recent:%d", limit)
+	data, err := json.Marshal(files)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to marshal files: %w", err)
+	}
+
+	if err := rc.client.Set(ctx, key, data, ttl).Err(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to set cache: %w", err)
+	}
+
+	return nil
+}
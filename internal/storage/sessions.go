@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maneesh/labdropbox/internal/models"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrSessionNotFound is returned for an upload session that doesn't exist or
+// has expired
+var ErrSessionNotFound = errors.New("upload session not found")
+
+// ErrTooManySessions is returned when a client already has the maximum number
+// of open upload sessions
+var ErrTooManySessions = errors.New("too many open upload sessions")
+
+const (
+	// activeSessionsKey is a sorted set of session IDs scored by the Unix
+	// time of their last activity, scanned for idle sessions
+	activeSessionsKey = "upload_sessions"
+
+	sessionField      = "session"
+	sessionChunkField = "chunk:"
+)
+
+// addSessionChunkScript records a chunk under its index unless one was
+// already recorded, returning "" on success, the existing chunk's JSON if
+// the index is taken, or nil if the session is gone
+var addSessionChunkScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+	return ''
+end
+return redis.call('HGET', KEYS[1], ARGV[1])
+`)
+
+func sessionKey(id string) string {
+	return fmt.Sprintf("upload_session:%s", id)
+}
+
+func clientSessionsKey(client string) string {
+	return fmt.Sprintf("upload_sessions:client:%s", client)
+}
+
+// sessionKeyTTL is how long session keys outlive their last activity. It is
+// twice the idle timeout, so the cleaner still finds an idle session's chunk
+// list; Redis only drops it first if the cleaner isn't running.
+func sessionKeyTTL(idleTimeout time.Duration) time.Duration {
+	return 2 * idleTimeout
+}
+
+// CreateUploadSession stores a new upload session. With maxPerClient > 0 it
+// fails with ErrTooManySessions if the session's client already has that
+// many sessions active within idleTimeout.
+func (rc *RedisClient) CreateUploadSession(ctx context.Context, session *models.UploadSession, idleTimeout time.Duration, maxPerClient int) error {
+	ctx, span := tracer.Start(ctx, "redis.create_upload_session",
+		trace.WithAttributes(
+			attribute.String("upload_id", session.ID),
+			attribute.String("client", session.Client),
+			attribute.Int("chunk_count", session.ChunkCount),
+		),
+	)
+	defer span.End()
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to marshal upload session: %w", err)
+	}
+
+	// Claim a slot first, so concurrent creates can't both slip under the cap
+	now := time.Now()
+	member := redis.Z{Score: float64(now.Unix()), Member: session.ID}
+	clientKey := clientSessionsKey(session.Client)
+	var open *redis.IntCmd
+	_, err = rc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, clientKey, "-inf", strconv.FormatInt(now.Add(-idleTimeout).Unix(), 10))
+		pipe.ZAdd(ctx, clientKey, member)
+		pipe.Expire(ctx, clientKey, sessionKeyTTL(idleTimeout))
+		open = pipe.ZCard(ctx, clientKey)
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to register upload session: %w", err)
+	}
+	if maxPerClient > 0 && open.Val() > int64(maxPerClient) {
+		rc.client.ZRem(ctx, clientKey, session.ID)
+		span.RecordError(ErrTooManySessions)
+		return fmt.Errorf("%w: limit is %d", ErrTooManySessions, maxPerClient)
+	}
+
+	_, err = rc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, sessionKey(session.ID), sessionField, data)
+		pipe.Expire(ctx, sessionKey(session.ID), sessionKeyTTL(idleTimeout))
+		pipe.ZAdd(ctx, activeSessionsKey, member)
+		return nil
+	})
+	if err != nil {
+		rc.client.ZRem(ctx, clientKey, session.ID)
+		span.RecordError(err)
+		return fmt.Errorf("failed to store upload session: %w", err)
+	}
+	return nil
+}
+
+// GetUploadSession returns an upload session with the chunks received so far
+func (rc *RedisClient) GetUploadSession(ctx context.Context, id string) (*models.UploadSession, error) {
+	ctx, span := tracer.Start(ctx, "redis.get_upload_session",
+		trace.WithAttributes(
+			attribute.String("upload_id", id),
+		),
+	)
+	defer span.End()
+
+	fields, err := rc.client.HGetAll(ctx, sessionKey(id)).Result()
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to get upload session: %w", err)
+	}
+	data, ok := fields[sessionField]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+
+	var session models.UploadSession
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to unmarshal upload session: %w", err)
+	}
+
+	session.Chunks = make(map[int]*models.Chunk)
+	for field, value := range fields {
+		if !strings.HasPrefix(field, sessionChunkField) {
+			continue
+		}
+		var chunk models.Chunk
+		if err := json.Unmarshal([]byte(value), &chunk); err != nil {
+			span.RecordError(err)
+			return nil, fmt.Errorf("failed to unmarshal session chunk %s: %w", field, err)
+		}
+		session.Chunks[chunk.OrderIndex] = &chunk
+	}
+
+	span.SetAttributes(attribute.Int("chunks_received", len(session.Chunks)))
+	return &session, nil
+}
+
+// AddSessionChunk records a stored chunk in the session and marks the session
+// active. If its index was already recorded, nothing changes and the
+// existing chunk is returned instead.
+func (rc *RedisClient) AddSessionChunk(ctx context.Context, session *models.UploadSession, chunk *models.Chunk, idleTimeout time.Duration) (*models.Chunk, error) {
+	ctx, span := tracer.Start(ctx, "redis.add_session_chunk",
+		trace.WithAttributes(
+			attribute.String("upload_id", session.ID),
+			attribute.Int("chunk_index", chunk.OrderIndex),
+		),
+	)
+	defer span.End()
+
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to marshal chunk: %w", err)
+	}
+
+	field := sessionChunkField + strconv.Itoa(chunk.OrderIndex)
+	existing, err := addSessionChunkScript.Run(ctx, rc.client,
+		[]string{sessionKey(session.ID)},
+		field, data, sessionKeyTTL(idleTimeout).Milliseconds(),
+	).Text()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, session.ID)
+	} else if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to record session chunk: %w", err)
+	}
+
+	if err := rc.TouchUploadSession(ctx, session, idleTimeout); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	if existing == "" {
+		return nil, nil
+	}
+	var recorded models.Chunk
+	if err := json.Unmarshal([]byte(existing), &recorded); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to unmarshal session chunk %s: %w", field, err)
+	}
+	span.SetAttributes(attribute.Bool("already_recorded", true))
+	return &recorded, nil
+}
+
+// TouchUploadSession marks a session active now, postponing its expiry
+func (rc *RedisClient) TouchUploadSession(ctx context.Context, session *models.UploadSession, idleTimeout time.Duration) error {
+	member := redis.Z{Score: float64(time.Now().Unix()), Member: session.ID}
+	_, err := rc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, activeSessionsKey, member)
+		pipe.ZAdd(ctx, clientSessionsKey(session.Client), member)
+		pipe.Expire(ctx, sessionKey(session.ID), sessionKeyTTL(idleTimeout))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to touch upload session: %w", err)
+	}
+	return nil
+}
+
+// DeleteUploadSession removes a session and its chunk list. client may be
+// empty if unknown; the client's set then drops the ID once it goes idle.
+func (rc *RedisClient) DeleteUploadSession(ctx context.Context, id, client string) error {
+	ctx, span := tracer.Start(ctx, "redis.delete_upload_session",
+		trace.WithAttributes(
+			attribute.String("upload_id", id),
+		),
+	)
+	defer span.End()
+
+	_, err := rc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(id))
+		pipe.ZRem(ctx, activeSessionsKey, id)
+		if client != "" {
+			pipe.ZRem(ctx, clientSessionsKey(client), id)
+		}
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to delete upload session: %w", err)
+	}
+	return nil
+}
+
+// IdleUploadSessions returns the IDs of sessions with no activity for at
+// least idleTimeout
+func (rc *RedisClient) IdleUploadSessions(ctx context.Context, idleTimeout time.Duration) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "redis.idle_upload_sessions")
+	defer span.End()
+
+	ids, err := rc.client.ZRangeByScore(ctx, activeSessionsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Add(-idleTimeout).Unix(), 10),
+	}).Result()
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to list idle upload sessions: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("session_count", len(ids)))
+	return ids, nil
+}
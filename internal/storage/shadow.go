@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/maneesh/labdropbox/internal/chunker"
+	"github.com/maneesh/labdropbox/internal/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// shadowReadTimeout bounds each secondary read so a slow backend can't pile
+// up goroutines
+const shadowReadTimeout = 30 * time.Second
+
+// ChunkReader reads chunk objects from a blob store
+type ChunkReader interface {
+	DownloadChunk(ctx context.Context, objectKey string) ([]byte, error)
+}
+
+// ShadowReader re-reads chunks from a secondary store in the background and
+// compares them with the hash recorded in TiDB. It is used to validate a new
+// backend during a migration without affecting the response to the client.
+type ShadowReader struct {
+	secondary ChunkReader
+	// sem bounds in-flight comparisons; reads are dropped when it is full
+	sem chan struct{}
+}
+
+// NewShadowReader creates a shadow reader over the secondary store with at
+// most maxInFlight comparisons running at once
+func NewShadowReader(secondary ChunkReader, maxInFlight int) *ShadowReader {
+	return &ShadowReader{
+		secondary: secondary,
+		sem:       make(chan struct{}, max(1, maxInFlight)),
+	}
+}
+
+// Compare asynchronously reads objectKey from the secondary store and checks
+// it against expectedHash, after passing it through decode if that is set
+// (e.g. to decrypt it). It never blocks the caller; a nil ShadowReader is a
+// no-op.
+func (sr *ShadowReader) Compare(ctx context.Context, objectKey, expectedHash string, decode func([]byte) ([]byte, error)) {
+	if sr == nil {
+		return
+	}
+
+	select {
+	case sr.sem <- struct{}{}:
+	default:
+		metrics.ShadowSkipped()
+		return
+	}
+
+	// Detach from the request so the comparison outlives it, but link the
+	// span back to the read that triggered it
+	link := trace.LinkFromContext(ctx)
+	ctx = context.WithoutCancel(ctx)
+
+	go func() {
+		defer func() { <-sr.sem }()
+
+		ctx, cancel := context.WithTimeout(ctx, shadowReadTimeout)
+		defer cancel()
+
+		ctx, span := tracer.Start(ctx, "shadow.compare_chunk",
+			trace.WithNewRoot(),
+			trace.WithLinks(link),
+			trace.WithAttributes(
+				attribute.String("object_key", objectKey),
+			),
+		)
+		defer span.End()
+
+		data, err := sr.secondary.DownloadChunk(ctx, objectKey)
+		if err != nil {
+			span.RecordError(err)
+			metrics.ShadowError()
+			log.Printf("Shadow read failed for %s: %v", objectKey, err)
+			return
+		}
+		if decode != nil {
+			if data, err = decode(data); err != nil {
+				span.RecordError(err)
+				metrics.ShadowError()
+				log.Printf("Shadow read of %s could not be decoded: %v", objectKey, err)
+				return
+			}
+		}
+
+		if !chunker.VerifyChunkHash(data, expectedHash) {
+			err := fmt.Errorf("hash mismatch for %s: expected %s, got %s", objectKey, expectedHash, chunker.ComputeHash(data))
+			span.RecordError(err)
+			span.SetAttributes(attribute.Bool("shadow_match", false))
+			metrics.ShadowMismatch()
+			log.Printf("Shadow read discrepancy: %v", err)
+			return
+		}
+
+		span.SetAttributes(attribute.Bool("shadow_match", true))
+		metrics.ShadowMatch()
+	}()
+}
@@ -3,21 +3,141 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/maneesh/labdropbox/internal/models"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
+// ErrFileNotFound is returned when no file row exists for an ID
+var ErrFileNotFound = errors.New("file not found")
+
+// ErrFileExists is returned when creating a file whose ID is already in use
+var ErrFileExists = errors.New("file already exists")
+
+// ErrFileIncomplete is returned for operations on a file whose upload hasn't
+// finished yet
+var ErrFileIncomplete = errors.New("file upload is not complete")
+
+// ErrAliasNotFound is returned for an alias that doesn't exist or has expired
+var ErrAliasNotFound = errors.New("alias not found")
+
+// ErrAliasExists is returned when creating an alias that is already taken
+var ErrAliasExists = errors.New("alias already exists")
+
+// ErrAppendConflict is returned by AppendChunks when the file changed since
+// the caller read it (e.g. a concurrent append won the race)
+var ErrAppendConflict = errors.New("file was modified concurrently")
+
+// fileColumns is the files column list read by scanFile, in order
+const fileColumns = `id, name, size, chunk_count, created_at, status, retention_mode, retain_until, chunking_strategy, target_chunk_size, metadata, checksum, content_type`
+
+// insertChunksQuery starts a multi-row chunk INSERT; see chunkHashArgs for
+// the hash columns
+const insertChunksQuery = `INSERT INTO chunks (id, file_id, order_index, hash, hash_bin, minio_object_key, size,
+			  compression, stored_size) VALUES `
+
+// chunkRowPlaceholders matches the columns of insertChunksQuery
+const chunkRowPlaceholders = `(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// addChunkRefsQuery starts a multi-row INSERT counting more chunk rows
+// referencing each object; it is completed by addChunkRefsSuffix
+const addChunkRefsQuery = `INSERT INTO chunk_objects (minio_object_key, refcount) VALUES `
+
+const addChunkRefsSuffix = ` ON DUPLICATE KEY UPDATE refcount = refcount + VALUES(refcount)`
+
+// maxChunksPerInsert caps the rows per multi-row chunk INSERT, keeping each
+// statement far below the placeholder limit
+const maxChunksPerInsert = 500
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// isDuplicateKey reports whether err is a MySQL duplicate key error (1062)
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanFile scans a row selected with fileColumns
+func scanFile(row rowScanner) (*models.File, error) {
+	var file models.File
+	var retainUntil sql.NullTime
+	var metadata []byte
+	err := row.Scan(
+		&file.ID,
+		&file.Name,
+		&file.Size,
+		&file.ChunkCount,
+		&file.CreatedAt,
+		&file.Status,
+		&file.RetentionMode,
+		&retainUntil,
+		&file.ChunkingStrategy,
+		&file.TargetChunkSize,
+		&metadata,
+		&file.Checksum,
+		&file.ContentType,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if retainUntil.Valid {
+		file.RetainUntil = &retainUntil.Time
+	}
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &file.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata of file %s: %w", file.ID, err)
+		}
+	}
+	return &file, nil
+}
+
 // TiDBClient wraps TiDB operations with tracing
 type TiDBClient struct {
-	db *sql.DB
+	db           *sql.DB
+	binaryHashes bool
+	opTimeout    time.Duration
+}
+
+// TiDBOptions configures a TiDBClient
+type TiDBOptions struct {
+	// BinaryHashes stores new chunk hashes in the BINARY(32) hash_bin column
+	// instead of as hex in hash. Reads handle rows in either form, and
+	// models.Chunk.Hash is always hex.
+	BinaryHashes bool
+
+	// Connection pool limits passed to database/sql: open connections (0 is
+	// unlimited), idle connections kept, and how long a connection may be
+	// reused (0 is forever)
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// OpTimeout bounds each client method, including all of its statements
+	// (0 leaves them to the caller's context). Transactions from BeginTx
+	// live as long as the caller's context; their statements are bounded
+	// one by one.
+	OpTimeout time.Duration
 }
 
 // NewTiDBClient initializes a new TiDB client
-func NewTiDBClient(dsn string) (*TiDBClient, error) {
+func NewTiDBClient(dsn string, opts TiDBOptions) (*TiDBClient, error) {
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
@@ -25,14 +145,83 @@ func NewTiDBClient(dsn string) (*TiDBClient, error) {
 
 	// Test the connection
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
 	// Set connection pool settings
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	db.SetMaxIdleConns(opts.MaxIdleConns)
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+
+	return &TiDBClient{db: db, binaryHashes: opts.BinaryHashes, opTimeout: opts.OpTimeout}, nil
+}
+
+// opContext bounds one client operation by the configured timeout, so a
+// slow query fails with context.DeadlineExceeded instead of holding the
+// request
+func (tc *TiDBClient) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if tc.opTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, tc.opTimeout)
+}
+
+// chunkHashArgs returns the values for the hash and hash_bin columns: the hex
+// hash alone by default, or only the raw bytes in binary mode
+func (tc *TiDBClient) chunkHashArgs(chunk *models.Chunk) (string, []byte, error) {
+	if !tc.binaryHashes {
+		return chunk.Hash, nil, nil
+	}
+
+	raw, err := hex.DecodeString(chunk.Hash)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid hash for chunk %s: %w", chunk.ID, err)
+	}
+	return "", raw, nil
+}
 
-	return &TiDBClient{db: db}, nil
+// insertChunks inserts chunk rows and counts their references to objects,
+// with one multi-row statement for each per maxChunksPerInsert chunks. It
+// must run inside a transaction so the two stay in step.
+func (tc *TiDBClient) insertChunks(ctx context.Context, tx execer, chunks []*models.Chunk) error {
+	for start := 0; start < len(chunks); start += maxChunksPerInsert {
+		batch := chunks[start:min(start+maxChunksPerInsert, len(chunks))]
+
+		rows := make([]string, 0, len(batch))
+		args := make([]interface{}, 0, 9*len(batch))
+		refs := make(map[string]int, len(batch))
+		var keys []string
+		for _, chunk := range batch {
+			hash, hashBin, err := tc.chunkHashArgs(chunk)
+			if err != nil {
+				return err
+			}
+			rows = append(rows, chunkRowPlaceholders)
+			args = append(args, chunk.ID, chunk.FileID, chunk.OrderIndex, hash, hashBin, chunk.MinioObjectKey, chunk.Size,
+				chunk.Compression, chunk.StoredSize)
+
+			if refs[chunk.MinioObjectKey] == 0 {
+				keys = append(keys, chunk.MinioObjectKey)
+			}
+			refs[chunk.MinioObjectKey]++
+		}
+
+		if _, err := tx.ExecContext(ctx, insertChunksQuery+strings.Join(rows, ", "), args...); err != nil {
+			return fmt.Errorf("failed to insert chunks: %w", err)
+		}
+
+		refRows := make([]string, 0, len(keys))
+		refArgs := make([]interface{}, 0, 2*len(keys))
+		for _, key := range keys {
+			refRows = append(refRows, "(?, ?)")
+			refArgs = append(refArgs, key, refs[key])
+		}
+		if _, err := tx.ExecContext(ctx, addChunkRefsQuery+strings.Join(refRows, ", ")+addChunkRefsSuffix, refArgs...); err != nil {
+			return fmt.Errorf("failed to count chunk references: %w", err)
+		}
+	}
+	return nil
 }
 
 // Close closes the database connection
@@ -40,8 +229,22 @@ func (tc *TiDBClient) Close() error {
 	return tc.db.Close()
 }
 
+// Ping checks that the database is reachable
+func (tc *TiDBClient) Ping(ctx context.Context) error {
+	return tc.db.PingContext(ctx)
+}
+
 // CreateFile inserts file metadata with tracing
 func (tc *TiDBClient) CreateFile(ctx context.Context, file *models.File) error {
+	return tc.createFile(ctx, tc.db, file)
+}
+
+// CreateFileTx inserts file metadata as part of tx
+func (tc *TiDBClient) CreateFileTx(ctx context.Context, tx *sql.Tx, file *models.File) error {
+	return tc.createFile(ctx, tx, file)
+}
+
+func (tc *TiDBClient) createFile(ctx context.Context, ex execer, file *models.File) error {
 	ctx, span := tracer.Start(ctx, "tidb.create_file",
 		trace.WithAttributes(
 			attribute.String("file_id", file.ID),
@@ -51,11 +254,34 @@ func (tc *TiDBClient) CreateFile(ctx context.Context, file *models.File) error {
 	)
 	defer span.End()
 
-	query := `INSERT INTO files (id, name, size, chunk_count, created_at)
-			  VALUES (?, ?, ?, ?, ?)`
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
 
-	_, err := tc.db.ExecContext(ctx, query, file.ID, file.Name, file.Size, file.ChunkCount, file.CreatedAt)
-	if err != nil {
+	status := file.Status
+	if status == "" {
+		status = models.FileStatusComplete
+	}
+
+	// Empty metadata is stored as NULL rather than {}
+	var metadata []byte
+	if len(file.Metadata) > 0 {
+		var err error
+		if metadata, err = json.Marshal(file.Metadata); err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("failed to encode metadata: %w", err)
+		}
+	}
+
+	query := `INSERT INTO files (id, name, size, chunk_count, created_at, status, retention_mode, retain_until,
+			  chunking_strategy, target_chunk_size, metadata, checksum, content_type)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := ex.ExecContext(ctx, query, file.ID, file.Name, file.Size, file.ChunkCount, file.CreatedAt, status,
+		file.RetentionMode, file.RetainUntil, file.ChunkingStrategy, file.TargetChunkSize, metadata, file.Checksum, file.ContentType)
+	if isDuplicateKey(err) {
+		span.RecordError(err)
+		return fmt.Errorf("%w: %s", ErrFileExists, file.ID)
+	} else if err != nil {
 		span.RecordError(err)
 		return fmt.Errorf("failed to insert file: %w", err)
 	}
@@ -64,6 +290,34 @@ func (tc *TiDBClient) CreateFile(ctx context.Context, file *models.File) error {
 	return nil
 }
 
+// MarkFileComplete flips a pending file to complete once all of its chunk
+// rows are saved
+func (tc *TiDBClient) MarkFileComplete(ctx context.Context, fileID string) error {
+	ctx, span := tracer.Start(ctx, "tidb.mark_file_complete",
+		trace.WithAttributes(
+			attribute.String("file_id", fileID),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	result, err := tc.db.ExecContext(ctx,
+		`UPDATE files SET status = ? WHERE id = ? AND status = ?`,
+		models.FileStatusComplete, fileID, models.FileStatusPending,
+	)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to mark file complete: %w", err)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: %s is not pending", ErrFileNotFound, fileID)
+	}
+	return nil
+}
+
 // CreateChunk inserts chunk metadata with tracing
 func (tc *TiDBClient) CreateChunk(ctx context.Context, chunk *models.Chunk) error {
 	ctx, span := tracer.Start(ctx, "tidb.create_chunk",
@@ -75,19 +329,82 @@ func (tc *TiDBClient) CreateChunk(ctx context.Context, chunk *models.Chunk) erro
 	)
 	defer span.End()
 
-	query := `INSERT INTO chunks (id, file_id, order_index, hash, minio_object_key, size)
-			  VALUES (?, ?, ?, ?, ?, ?)`
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
 
-	_, err := tc.db.ExecContext(ctx, query, chunk.ID, chunk.FileID, chunk.OrderIndex, chunk.Hash, chunk.MinioObjectKey, chunk.Size)
+	tx, err := tc.db.BeginTx(ctx, nil)
 	if err != nil {
 		span.RecordError(err)
-		return fmt.Errorf("failed to insert chunk: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := tc.insertChunks(ctx, tx, []*models.Chunk{chunk}); err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to commit chunk: %w", err)
 	}
 
 	span.SetAttributes(attribute.Bool("insert_success", true))
 	return nil
 }
 
+// CreateChunks inserts a batch of chunk rows in a single transaction, with
+// multi-row statements rather than a round trip per chunk
+func (tc *TiDBClient) CreateChunks(ctx context.Context, chunks []*models.Chunk) error {
+	ctx, span := tracer.Start(ctx, "tidb.create_chunks",
+		trace.WithAttributes(
+			attribute.Int("chunk_count", len(chunks)),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	tx, err := tc.db.BeginTx(ctx, nil)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := tc.insertChunks(ctx, tx, chunks); err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to commit chunk batch: %w", err)
+	}
+	return nil
+}
+
+// CreateChunksTx inserts a batch of chunk rows as part of tx, so they commit
+// or roll back together with the caller's other writes
+func (tc *TiDBClient) CreateChunksTx(ctx context.Context, tx *sql.Tx, chunks []*models.Chunk) error {
+	ctx, span := tracer.Start(ctx, "tidb.create_chunks",
+		trace.WithAttributes(
+			attribute.Int("chunk_count", len(chunks)),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	if err := tc.insertChunks(ctx, tx, chunks); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
 // GetFile retrieves file metadata by ID with tracing
 func (tc *TiDBClient) GetFile(ctx context.Context, fileID string) (*models.File, error) {
 	ctx, span := tracer.Start(ctx, "tidb.get_file",
@@ -97,27 +414,107 @@ func (tc *TiDBClient) GetFile(ctx context.Context, fileID string) (*models.File,
 	)
 	defer span.End()
 
-	query := `SELECT id, name, size, chunk_count, created_at FROM files WHERE id = ?`
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
 
-	var file models.File
-	err := tc.db.QueryRowContext(ctx, query, fileID).Scan(
-		&file.ID,
-		&file.Name,
-		&file.Size,
-		&file.ChunkCount,
-		&file.CreatedAt,
-	)
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id = ?`
+
+	file, err := scanFile(tc.db.QueryRowContext(ctx, query, fileID))
 
 	if err == sql.ErrNoRows {
 		span.SetAttributes(attribute.Bool("found", false))
-		return nil, fmt.Errorf("file not found: %s", fileID)
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, fileID)
 	} else if err != nil {
 		span.RecordError(err)
 		return nil, fmt.Errorf("failed to query file: %w", err)
 	}
 
 	span.SetAttributes(attribute.Bool("found", true))
-	return &file, nil
+	return file, nil
+}
+
+// GetFileByChecksum returns the most recent complete file whose whole-file
+// checksum is checksum, or ErrFileNotFound if there is none
+func (tc *TiDBClient) GetFileByChecksum(ctx context.Context, checksum string) (*models.File, error) {
+	ctx, span := tracer.Start(ctx, "tidb.get_file_by_checksum",
+		trace.WithAttributes(
+			attribute.String("checksum", checksum),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + fileColumns + ` FROM files
+		WHERE checksum = ? AND status = ?
+		ORDER BY created_at DESC LIMIT 1`
+
+	file, err := scanFile(tc.db.QueryRowContext(ctx, query, checksum, models.FileStatusComplete))
+
+	if err == sql.ErrNoRows {
+		span.SetAttributes(attribute.Bool("found", false))
+		return nil, fmt.Errorf("%w: checksum %s", ErrFileNotFound, checksum)
+	} else if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to query file by checksum: %w", err)
+	}
+
+	span.SetAttributes(
+		attribute.Bool("found", true),
+		attribute.String("file_id", file.ID),
+	)
+	return file, nil
+}
+
+// GetFiles retrieves metadata for several files in one query. Files that
+// don't exist are absent from the returned map.
+func (tc *TiDBClient) GetFiles(ctx context.Context, fileIDs []string) (map[string]*models.File, error) {
+	ctx, span := tracer.Start(ctx, "tidb.get_files",
+		trace.WithAttributes(
+			attribute.Int("file_count", len(fileIDs)),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	files := make(map[string]*models.File, len(fileIDs))
+	if len(fileIDs) == 0 {
+		return files, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(fileIDs)), ", ")
+	args := make([]interface{}, len(fileIDs))
+	for i, id := range fileIDs {
+		args[i] = id
+	}
+
+	query := `SELECT ` + fileColumns + ` FROM files WHERE id IN (` + placeholders + `)`
+	rows, err := tc.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to query files: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			span.RecordError(err)
+			return nil, fmt.Errorf("failed to scan file: %w", err)
+		}
+		files[file.ID] = file
+	}
+
+	if err := rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("error iterating files: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("found_count", len(files)))
+	return files, nil
 }
 
 // GetChunks retrieves all chunks for a file ordered by order_index with tracing
@@ -129,7 +526,10 @@ func (tc *TiDBClient) GetChunks(ctx context.Context, fileID string) ([]*models.C
 	)
 	defer span.End()
 
-	query := `SELECT id, file_id, order_index, hash, minio_object_key, size
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	query := `SELECT id, file_id, order_index, hash, hash_bin, minio_object_key, size, compression, stored_size
 			  FROM chunks
 			  WHERE file_id = ?
 			  ORDER BY order_index ASC`
@@ -144,18 +544,25 @@ func (tc *TiDBClient) GetChunks(ctx context.Context, fileID string) ([]*models.C
 	var chunks []*models.Chunk
 	for rows.Next() {
 		var chunk models.Chunk
+		var hashBin []byte
 		err := rows.Scan(
 			&chunk.ID,
 			&chunk.FileID,
 			&chunk.OrderIndex,
 			&chunk.Hash,
+			&hashBin,
 			&chunk.MinioObjectKey,
 			&chunk.Size,
+			&chunk.Compression,
+			&chunk.StoredSize,
 		)
 		if err != nil {
 			span.RecordError(err)
 			return nil, fmt.Errorf("failed to scan chunk: %w", err)
 		}
+		if hashBin != nil {
+			chunk.Hash = hex.EncodeToString(hashBin)
+		}
 		chunks = append(chunks, &chunk)
 	}
 
@@ -171,7 +578,685 @@ func (tc *TiDBClient) GetChunks(ctx context.Context, fileID string) ([]*models.C
 	return chunks, nil
 }
 
+// FileFilter restricts file listings to a creation time range. Zero values
+// leave that side of the range open.
+type FileFilter struct {
+	CreatedFrom time.Time // inclusive
+	CreatedTo   time.Time // exclusive
+}
+
+// ListFilesAfter returns up to limit complete files matching filter, ordered by
+// (created_at, id) and starting strictly after the given cursor. Pass a nil
+// cursor for the first page. Keyset pagination keeps each batch cheap no
+// matter how deep into the table the caller is.
+func (tc *TiDBClient) ListFilesAfter(ctx context.Context, filter FileFilter, after *models.File, limit int) ([]*models.File, error) {
+	ctx, span := tracer.Start(ctx, "tidb.list_files_after",
+		trace.WithAttributes(
+			attribute.Int("limit", limit),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	conditions := []string{"status = ?"}
+	args := []interface{}{models.FileStatusComplete}
+	if !filter.CreatedFrom.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.CreatedFrom)
+	}
+	if !filter.CreatedTo.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.CreatedTo)
+	}
+	if after != nil {
+		conditions = append(conditions, "(created_at, id) > (?, ?)")
+		args = append(args, after.CreatedAt, after.ID)
+	}
+
+	query := `SELECT ` + fileColumns + ` FROM files WHERE ` + strings.Join(conditions, " AND ")
+	query += " ORDER BY created_at ASC, id ASC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := tc.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to query files: %w", err)
+	}
+	defer rows.Close()
+
+	var files []*models.File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			span.RecordError(err)
+			return nil, fmt.Errorf("failed to scan file: %w", err)
+		}
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("error iterating files: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("file_count", len(files)))
+	return files, nil
+}
+
+// ListFilesWithoutChecksum returns up to limit complete files with no
+// whole-file checksum and an ID after afterID, ordered by ID. Pass "" for
+// the first page.
+func (tc *TiDBClient) ListFilesWithoutChecksum(ctx context.Context, afterID string, limit int) ([]*models.File, error) {
+	ctx, span := tracer.Start(ctx, "tidb.list_files_without_checksum",
+		trace.WithAttributes(
+			attribute.Int("limit", limit),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + fileColumns + ` FROM files
+		WHERE checksum = '' AND status = ? AND id > ?
+		ORDER BY id LIMIT ?`
+
+	rows, err := tc.db.QueryContext(ctx, query, models.FileStatusComplete, afterID, limit)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to query files: %w", err)
+	}
+	defer rows.Close()
+
+	var files []*models.File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			span.RecordError(err)
+			return nil, fmt.Errorf("failed to scan file: %w", err)
+		}
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("error iterating files: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("file_count", len(files)))
+	return files, nil
+}
+
+// SetFileChecksum records a checksum computed for a file that had none. It
+// only applies while the file still has chunkCount chunks and no checksum,
+// so a concurrent append or overwrite isn't given a stale one, and reports
+// whether it did.
+func (tc *TiDBClient) SetFileChecksum(ctx context.Context, fileID string, chunkCount int, checksum string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "tidb.set_file_checksum",
+		trace.WithAttributes(
+			attribute.String("file_id", fileID),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	result, err := tc.db.ExecContext(ctx,
+		`UPDATE files SET checksum = ? WHERE id = ? AND chunk_count = ? AND checksum = ''`,
+		checksum, fileID, chunkCount,
+	)
+	if err != nil {
+		span.RecordError(err)
+		return false, fmt.Errorf("failed to set file checksum: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		span.RecordError(err)
+		return false, fmt.Errorf("failed to set file checksum: %w", err)
+	}
+
+	span.SetAttributes(attribute.Bool("updated", updated > 0))
+	return updated > 0, nil
+}
+
+// TotalFileBytes returns the combined size of all stored files
+func (tc *TiDBClient) TotalFileBytes(ctx context.Context) (int64, error) {
+	ctx, span := tracer.Start(ctx, "tidb.total_file_bytes")
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	var total int64
+	if err := tc.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(size), 0) FROM files`).Scan(&total); err != nil {
+		span.RecordError(err)
+		return 0, fmt.Errorf("failed to sum file sizes: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int64("total_bytes", total))
+	return total, nil
+}
+
+// ListFiles returns one page of complete files, newest first, skipping the
+// first offset, along with the total number of complete files
+func (tc *TiDBClient) ListFiles(ctx context.Context, limit, offset int) ([]*models.File, int, error) {
+	ctx, span := tracer.Start(ctx, "tidb.list_files",
+		trace.WithAttributes(
+			attribute.Int("limit", limit),
+			attribute.Int("offset", offset),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	var total int
+	err := tc.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE status = ?`, models.FileStatusComplete).Scan(&total)
+	if err != nil {
+		span.RecordError(err)
+		return nil, 0, fmt.Errorf("failed to count files: %w", err)
+	}
+
+	query := `SELECT ` + fileColumns + `
+			  FROM files
+			  WHERE status = ?
+			  ORDER BY created_at DESC, id DESC
+			  LIMIT ? OFFSET ?`
+
+	rows, err := tc.db.QueryContext(ctx, query, models.FileStatusComplete, limit, offset)
+	if err != nil {
+		span.RecordError(err)
+		return nil, 0, fmt.Errorf("failed to query files: %w", err)
+	}
+	defer rows.Close()
+
+	var files []*models.File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			span.RecordError(err)
+			return nil, 0, fmt.Errorf("failed to scan file: %w", err)
+		}
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, 0, fmt.Errorf("error iterating files: %w", err)
+	}
+
+	span.SetAttributes(
+		attribute.Int("file_count", len(files)),
+		attribute.Int("total", total),
+	)
+	return files, total, nil
+}
+
+// ListRecentFiles returns the limit most recently created complete files,
+// newest first
+func (tc *TiDBClient) ListRecentFiles(ctx context.Context, limit int) ([]*models.File, error) {
+	ctx, span := tracer.Start(ctx, "tidb.list_recent_files",
+		trace.WithAttributes(
+			attribute.Int("limit", limit),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + fileColumns + `
+			  FROM files
+			  WHERE status = ?
+			  ORDER BY created_at DESC, id DESC
+			  LIMIT ?`
+
+	rows, err := tc.db.QueryContext(ctx, query, models.FileStatusComplete, limit)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to query recent files: %w", err)
+	}
+	defer rows.Close()
+
+	var files []*models.File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			span.RecordError(err)
+			return nil, fmt.Errorf("failed to scan file: %w", err)
+		}
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("error iterating files: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("file_count", len(files)))
+	return files, nil
+}
+
+// AppendChunks atomically adds chunk rows to an existing file and grows its
+// size and chunk_count. expectedChunkCount is the chunk count the caller saw;
+// the new chunks must continue the order_index sequence from it. If another
+// writer appended first, ErrAppendConflict is returned and nothing changes.
+func (tc *TiDBClient) AppendChunks(ctx context.Context, fileID string, expectedChunkCount int, chunks []*models.Chunk) (*models.File, error) {
+	ctx, span := tracer.Start(ctx, "tidb.append_chunks",
+		trace.WithAttributes(
+			attribute.String("file_id", fileID),
+			attribute.Int("expected_chunk_count", expectedChunkCount),
+			attribute.Int("appended_chunks", len(chunks)),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	var addedSize int64
+	for i, chunk := range chunks {
+		if chunk.OrderIndex != expectedChunkCount+i {
+			err := fmt.Errorf("appended chunk %d has order_index %d, want %d", i, chunk.OrderIndex, expectedChunkCount+i)
+			span.RecordError(err)
+			return nil, err
+		}
+		addedSize += chunk.Size
+	}
+
+	tx, err := tc.db.BeginTx(ctx, nil)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	file, err := scanFile(tx.QueryRowContext(ctx,
+		`SELECT `+fileColumns+` FROM files WHERE id = ? FOR UPDATE`,
+		fileID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, fileID)
+	} else if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to lock file: %w", err)
+	}
+
+	if file.Status == models.FileStatusPending {
+		span.RecordError(ErrFileIncomplete)
+		return nil, fmt.Errorf("%w: %s", ErrFileIncomplete, fileID)
+	}
+
+	if file.ChunkCount != expectedChunkCount {
+		span.RecordError(ErrAppendConflict)
+		return nil, ErrAppendConflict
+	}
+
+	if err := tc.insertChunks(ctx, tx, chunks); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	// The whole-file checksum no longer matches and can't be extended without
+	// rereading the file, so appended files are no longer verified on read
+	_, err = tx.ExecContext(ctx,
+		`UPDATE files SET size = size + ?, chunk_count = chunk_count + ?, checksum = '' WHERE id = ?`,
+		addedSize, len(chunks), fileID,
+	)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to update file: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to commit append: %w", err)
+	}
+
+	file.Size += addedSize
+	file.ChunkCount += len(chunks)
+	file.Checksum = ""
+	span.SetAttributes(attribute.Bool("append_success", true))
+	return file, nil
+}
+
+// DeleteFile deletes a file with its chunk rows and aliases in one
+// transaction. It returns the object keys whose last reference it dropped,
+// which the caller should remove with DeleteChunkObject.
+func (tc *TiDBClient) DeleteFile(ctx context.Context, fileID string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "tidb.delete_file",
+		trace.WithAttributes(
+			attribute.String("file_id", fileID),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	tx, err := tc.db.BeginTx(ctx, nil)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	unreferenced, err := deleteFileRows(ctx, tx, fileID, true)
+	if errors.Is(err, ErrFileNotFound) {
+		return nil, err
+	} else if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to commit file deletion: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("unreferenced_objects", len(unreferenced)))
+	return unreferenced, nil
+}
+
+// DeleteFileTx deletes a file row and its chunk rows as part of tx, keeping
+// its aliases, so a file can be replaced under the same ID. It returns the
+// object keys whose last reference it dropped, as DeleteFile does.
+func (tc *TiDBClient) DeleteFileTx(ctx context.Context, tx *sql.Tx, fileID string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "tidb.delete_file",
+		trace.WithAttributes(
+			attribute.String("file_id", fileID),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	unreferenced, err := deleteFileRows(ctx, tx, fileID, false)
+	if errors.Is(err, ErrFileNotFound) {
+		return nil, err
+	} else if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("unreferenced_objects", len(unreferenced)))
+	return unreferenced, nil
+}
+
+// deleteFileRows deletes a file's row and chunk rows, and its aliases if
+// asked, dropping the chunks' object references
+func deleteFileRows(ctx context.Context, tx *sql.Tx, fileID string, aliases bool) ([]string, error) {
+	// Lock the file row so a concurrent append can't add chunks mid-delete
+	var id string
+	err := tx.QueryRowContext(ctx, `SELECT id FROM files WHERE id = ? FOR UPDATE`, fileID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, fileID)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to lock file: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT minio_object_key FROM chunks WHERE file_id = ?`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chunks: %w", err)
+	}
+	var objectKeys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan chunk: %w", err)
+		}
+		objectKeys = append(objectKeys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read chunks: %w", err)
+	}
+
+	queries := []string{`DELETE FROM chunks WHERE file_id = ?`}
+	if aliases {
+		queries = append(queries, `DELETE FROM file_aliases WHERE file_id = ?`)
+	}
+	queries = append(queries, `DELETE FROM files WHERE id = ?`)
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, fileID); err != nil {
+			return nil, fmt.Errorf("failed to delete file: %w", err)
+		}
+	}
+
+	var unreferenced []string
+	for _, key := range objectKeys {
+		last, err := releaseChunkObject(ctx, tx, key)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			unreferenced = append(unreferenced, key)
+		}
+	}
+
+	return unreferenced, nil
+}
+
+// releaseChunkObject drops one reference to an object and reports whether it
+// was the last, in which case the object should be deleted. Objects without
+// a refcount row are treated as unreferenced. A row that reaches zero is kept
+// for DeleteChunkObject to lock and remove.
+func releaseChunkObject(ctx context.Context, tx *sql.Tx, objectKey string) (bool, error) {
+	var refcount int
+	err := tx.QueryRowContext(ctx,
+		`SELECT refcount FROM chunk_objects WHERE minio_object_key = ? FOR UPDATE`,
+		objectKey,
+	).Scan(&refcount)
+	if err == sql.ErrNoRows {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to lock chunk object: %w", err)
+	}
+
+	if refcount > 0 {
+		_, err = tx.ExecContext(ctx, `UPDATE chunk_objects SET refcount = refcount - 1 WHERE minio_object_key = ?`, objectKey)
+		if err != nil {
+			return false, fmt.Errorf("failed to release chunk object: %w", err)
+		}
+	}
+	return refcount <= 1, nil
+}
+
+// ClaimChunkObject takes a reference to a shared object for a write that is
+// about to reuse or upload it, before its chunk row exists. Taking it before
+// checking that the object exists keeps a concurrent delete from removing the
+// object in between. The write gives it back with ReleaseChunkObjects once
+// its chunk rows hold references of their own, or it has failed.
+func (tc *TiDBClient) ClaimChunkObject(ctx context.Context, objectKey string) error {
+	ctx, span := tracer.Start(ctx, "tidb.claim_chunk_object",
+		trace.WithAttributes(
+			attribute.String("object_key", objectKey),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	_, err := tc.db.ExecContext(ctx, addChunkRefsQuery+"(?, 1)"+addChunkRefsSuffix, objectKey)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to claim chunk object: %w", err)
+	}
+	return nil
+}
+
+// ReleaseChunkObjects drops references taken with ClaimChunkObject, one per
+// key given, and returns the keys left unreferenced, which the caller should
+// remove with DeleteChunkObject
+func (tc *TiDBClient) ReleaseChunkObjects(ctx context.Context, objectKeys []string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "tidb.release_chunk_objects",
+		trace.WithAttributes(
+			attribute.Int("object_count", len(objectKeys)),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	tx, err := tc.db.BeginTx(ctx, nil)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock rows in key order, so concurrent releases can't deadlock
+	keys := append([]string(nil), objectKeys...)
+	sort.Strings(keys)
+
+	var unreferenced []string
+	for _, key := range keys {
+		last, err := releaseChunkObject(ctx, tx, key)
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+		if last && (len(unreferenced) == 0 || unreferenced[len(unreferenced)-1] != key) {
+			unreferenced = append(unreferenced, key)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to commit chunk object release: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("unreferenced_objects", len(unreferenced)))
+	return unreferenced, nil
+}
+
+// DeleteChunkObject deletes an object through deleteObject if nothing
+// references it any more, and reports whether it did. The object's refcount
+// row stays locked until deleteObject returns, so a write reusing the object
+// at the same moment either takes its reference first, and the object is
+// kept, or waits and then finds the object gone.
+func (tc *TiDBClient) DeleteChunkObject(ctx context.Context, objectKey string, deleteObject func(ctx context.Context) error) (bool, error) {
+	ctx, span := tracer.Start(ctx, "tidb.delete_chunk_object",
+		trace.WithAttributes(
+			attribute.String("object_key", objectKey),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	tx, err := tc.db.BeginTx(ctx, nil)
+	if err != nil {
+		span.RecordError(err)
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var refcount int
+	err = tx.QueryRowContext(ctx,
+		`SELECT refcount FROM chunk_objects WHERE minio_object_key = ? FOR UPDATE`,
+		objectKey,
+	).Scan(&refcount)
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		return false, fmt.Errorf("failed to lock chunk object: %w", err)
+	}
+	if refcount > 0 {
+		span.SetAttributes(attribute.Int("refcount", refcount))
+		return false, nil
+	}
+
+	if err := deleteObject(ctx); err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM chunk_objects WHERE minio_object_key = ?`, objectKey); err != nil {
+		span.RecordError(err)
+		return false, fmt.Errorf("failed to delete chunk object: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		span.RecordError(err)
+		return false, fmt.Errorf("failed to commit chunk object deletion: %w", err)
+	}
+	return true, nil
+}
+
 // BeginTx starts a new transaction
 func (tc *TiDBClient) BeginTx(ctx context.Context) (*sql.Tx, error) {
 	return tc.db.BeginTx(ctx, nil)
 }
+
+// CreateAlias inserts a file alias. It fails with ErrAliasExists if the
+// alias is taken, including by an expired alias that hasn't been removed.
+func (tc *TiDBClient) CreateAlias(ctx context.Context, alias *models.Alias) error {
+	ctx, span := tracer.Start(ctx, "tidb.create_alias",
+		trace.WithAttributes(
+			attribute.String("alias", alias.Alias),
+			attribute.String("file_id", alias.FileID),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	_, err := tc.db.ExecContext(ctx,
+		`INSERT INTO file_aliases (alias, file_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		alias.Alias, alias.FileID, alias.CreatedAt, alias.ExpiresAt,
+	)
+	if isDuplicateKey(err) {
+		span.RecordError(err)
+		return fmt.Errorf("%w: %s", ErrAliasExists, alias.Alias)
+	} else if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to insert alias: %w", err)
+	}
+
+	return nil
+}
+
+// GetAlias resolves an alias, returning ErrAliasNotFound if it doesn't
+// exist or has expired
+func (tc *TiDBClient) GetAlias(ctx context.Context, name string) (*models.Alias, error) {
+	ctx, span := tracer.Start(ctx, "tidb.get_alias",
+		trace.WithAttributes(
+			attribute.String("alias", name),
+		),
+	)
+	defer span.End()
+
+	ctx, cancel := tc.opContext(ctx)
+	defer cancel()
+
+	var alias models.Alias
+	var expiresAt sql.NullTime
+	err := tc.db.QueryRowContext(ctx,
+		`SELECT alias, file_id, created_at, expires_at FROM file_aliases
+		 WHERE alias = ? AND (expires_at IS NULL OR expires_at > ?)`,
+		name, time.Now(),
+	).Scan(&alias.Alias, &alias.FileID, &alias.CreatedAt, &expiresAt)
+
+	if err == sql.ErrNoRows {
+		span.SetAttributes(attribute.Bool("found", false))
+		return nil, fmt.Errorf("%w: %s", ErrAliasNotFound, name)
+	} else if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to query alias: %w", err)
+	}
+
+	if expiresAt.Valid {
+		alias.ExpiresAt = &expiresAt.Time
+	}
+	span.SetAttributes(attribute.Bool("found", true))
+	return &alias, nil
+}
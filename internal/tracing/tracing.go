@@ -4,17 +4,34 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 
+	"go.opentelemetry.io/contrib/propagators/b3"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 )
 
-// InitTracer initializes OpenTelemetry with Jaeger exporter
-func InitTracer(serviceName, jaegerEndpoint string) (func(context.Context) error, error) {
+// InitTracer initializes OpenTelemetry with Jaeger exporter. propagators is
+// a comma-separated list of context propagation formats (see NewPropagator),
+// and sampler and sampleRatio choose which traces are recorded (see
+// NewSampler).
+func InitTracer(serviceName, jaegerEndpoint, propagators, sampler string, sampleRatio float64) (func(context.Context) error, error) {
+	propagator, err := NewPropagator(propagators)
+	if err != nil {
+		return nil, err
+	}
+	traceSampler, err := NewSampler(sampler, sampleRatio)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create OTLP HTTP exporter
 	exporter, err := otlptracehttp.New(
 		context.Background(),
@@ -26,39 +43,131 @@ func InitTracer(serviceName, jaegerEndpoint string) (func(context.Context) error
 	}
 
 	// Create resource with service information
-	res, err := resource.New(
-		context.Background(),
-		resource.WithAttributes(
-			semconv.ServiceName(serviceName),
-			semconv.ServiceVersion("1.0.0"),
-		),
-		resource.WithHost(),
-		resource.WithProcess(),
-	)
+	res, err := newResource(serviceName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create resource: %w", err)
+		return nil, err
 	}
 
 	// Create trace provider
 	tp := sdktrace.NewTracerProvider(
 		sdktrace.WithBatcher(exporter),
 		sdktrace.WithResource(res),
-		sdktrace.WithSampler(sdktrace.AlwaysSample()), // Sample all traces for demo
+		sdktrace.WithSampler(traceSampler),
 	)
 
 	// Set global trace provider
 	otel.SetTracerProvider(tp)
 
 	// Set global propagator for context propagation
-	otel.SetTextMapPropagator(
-		propagation.NewCompositeTextMapPropagator(
-			propagation.TraceContext{},
-			propagation.Baggage{},
-		),
-	)
+	otel.SetTextMapPropagator(propagator)
 
-	log.Printf("OpenTelemetry tracer initialized with Jaeger endpoint: %s", jaegerEndpoint)
+	log.Printf("OpenTelemetry tracer initialized with Jaeger endpoint: %s (propagators: %s, sampler: %s)", jaegerEndpoint, propagators, traceSampler.Description())
 
 	// Return shutdown function
 	return tp.Shutdown, nil
 }
+
+// InitMeter initializes the OpenTelemetry metrics pipeline, with the same
+// resource as traces. With otlp, metrics are exported over OTLP to endpoint;
+// with prometheus, a Prometheus exporter is registered on the default
+// Prometheus registry, to be scraped from promhttp.Handler(). Both readers
+// share one meter provider.
+func InitMeter(serviceName, endpoint string, otlp, prometheus bool) (func(context.Context) error, error) {
+	res, err := newResource(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	opts := []sdkmetric.Option{sdkmetric.WithResource(res)}
+
+	var exporters []string
+	if otlp {
+		exporter, err := otlpmetrichttp.New(
+			context.Background(),
+			otlpmetrichttp.WithEndpoint(endpoint),
+			otlpmetrichttp.WithInsecure(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP metric exporter: %w", err)
+		}
+		opts = append(opts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)))
+		exporters = append(exporters, "OTLP endpoint "+endpoint)
+	}
+	if prometheus {
+		exporter, err := otelprom.New()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Prometheus metric exporter: %w", err)
+		}
+		opts = append(opts, sdkmetric.WithReader(exporter))
+		exporters = append(exporters, "Prometheus exporter")
+	}
+
+	mp := sdkmetric.NewMeterProvider(opts...)
+	otel.SetMeterProvider(mp)
+
+	log.Printf("OpenTelemetry metrics initialized with %s", strings.Join(exporters, " and "))
+
+	return mp.Shutdown, nil
+}
+
+// newResource describes this service for both traces and metrics
+func newResource(serviceName string) (*resource.Resource, error) {
+	res, err := resource.New(
+		context.Background(),
+		resource.WithAttributes(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion("1.0.0"),
+		),
+		resource.WithHost(),
+		resource.WithProcess(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %w", err)
+	}
+	return res, nil
+}
+
+// NewPropagator builds a composite propagator from a comma-separated list of
+// formats: "tracecontext" (W3C), "baggage", "b3" (single header) and
+// "b3multi" (X-B3-* headers). Incoming context is extracted from whichever
+// format is present; outgoing requests carry all of them.
+func NewPropagator(names string) (propagation.TextMapPropagator, error) {
+	var propagators []propagation.TextMapPropagator
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "tracecontext":
+			propagators = append(propagators, propagation.TraceContext{})
+		case "baggage":
+			propagators = append(propagators, propagation.Baggage{})
+		case "b3":
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3SingleHeader)))
+		case "b3multi":
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown trace propagator %q", name)
+		}
+	}
+	if len(propagators) == 0 {
+		return nil, fmt.Errorf("no trace propagators configured")
+	}
+	return propagation.NewCompositeTextMapPropagator(propagators...), nil
+}
+
+// NewSampler builds a sampler by name: "always_on", "always_off" or
+// "traceidratio" (sampling ratio of traces by trace ID). Spans with a parent
+// follow the parent's sampling decision, so a trace is recorded either
+// everywhere or nowhere.
+func NewSampler(name string, ratio float64) (sdktrace.Sampler, error) {
+	var root sdktrace.Sampler
+	switch name {
+	case "always_on":
+		root = sdktrace.AlwaysSample()
+	case "always_off":
+		root = sdktrace.NeverSample()
+	case "traceidratio":
+		root = sdktrace.TraceIDRatioBased(ratio)
+	default:
+		return nil, fmt.Errorf("unknown trace sampler %q", name)
+	}
+	return sdktrace.ParentBased(root), nil
+}
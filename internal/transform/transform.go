@@ -0,0 +1,169 @@
+package transform
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// AnyContentType registers a transformer for every content type
+const AnyContentType = "*"
+
+// Transformer derives a view of a file on read without storing it. It wraps
+// the response stream, so data flows through it chunk by chunk rather than
+// being buffered in full.
+type Transformer interface {
+	// Wrap returns a writer that transforms everything written to it into w.
+	// Close must be called to flush any trailing output.
+	Wrap(w io.Writer) (io.WriteCloser, error)
+	// ContentType returns the response content type for a source type
+	ContentType(sourceType string) string
+	// FileName returns the download file name for a source name
+	FileName(sourceName string) string
+}
+
+// Registry maps transform names to transformers and the content types they
+// accept
+type Registry struct {
+	mu           sync.RWMutex
+	transformers map[string]registration
+}
+
+type registration struct {
+	transformer  Transformer
+	contentTypes []string
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		transformers: make(map[string]registration),
+	}
+}
+
+// DefaultRegistry creates a registry with the built-in transformers:
+// "identity" (no-op) and "gzip", both accepting any content type
+func DefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register("identity", Identity{}, AnyContentType)
+	r.Register("gzip", Gzip{}, AnyContentType)
+	return r
+}
+
+// Register adds a transformer under name for the given content types.
+// Registering an existing name replaces it.
+func (r *Registry) Register(name string, t Transformer, contentTypes ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.transformers[name] = registration{transformer: t, contentTypes: contentTypes}
+}
+
+// Lookup returns the transformer registered under name if it accepts
+// contentType
+func (r *Registry) Lookup(name, contentType string) (Transformer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reg, ok := r.transformers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transform %q", name)
+	}
+
+	// Ignore parameters such as "; charset=utf-8"
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	for _, ct := range reg.contentTypes {
+		if ct == AnyContentType || strings.EqualFold(ct, mediaType) {
+			return reg.transformer, nil
+		}
+	}
+	return nil, fmt.Errorf("transform %q does not apply to content type %q", name, mediaType)
+}
+
+// Identity passes data through unchanged
+type Identity struct{}
+
+// Wrap implements Transformer
+func (Identity) Wrap(w io.Writer) (io.WriteCloser, error) {
+	return nopCloser{w}, nil
+}
+
+// ContentType implements Transformer
+func (Identity) ContentType(sourceType string) string { return sourceType }
+
+// FileName implements Transformer
+func (Identity) FileName(sourceName string) string { return sourceName }
+
+// Gzip compresses data into a .gz download
+type Gzip struct{}
+
+// Wrap implements Transformer
+func (Gzip) Wrap(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+// ContentType implements Transformer
+func (Gzip) ContentType(string) string { return "application/gzip" }
+
+// FileName implements Transformer
+func (Gzip) FileName(sourceName string) string { return sourceName + ".gz" }
+
+// Gunzipped returns a transformer that decompresses gzip data before passing
+// it to t, for applying t to files stored gzip-compressed
+func Gunzipped(t Transformer) Transformer {
+	return gunzipped{t}
+}
+
+type gunzipped struct {
+	Transformer
+}
+
+// Wrap implements Transformer. The gzip reader pulls from a pipe fed by the
+// returned writer, so decompression runs alongside the writes.
+func (g gunzipped) Wrap(w io.Writer) (io.WriteCloser, error) {
+	inner, err := g.Transformer.Wrap(w)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		zr, err := gzip.NewReader(pr)
+		if err == nil {
+			_, err = io.Copy(inner, zr)
+		}
+		if err == nil {
+			err = inner.Close()
+		}
+		// Unblock the writer if decompression stopped early
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	return &gunzipWriter{pw: pw, done: done}, nil
+}
+
+type gunzipWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (gw *gunzipWriter) Write(p []byte) (int, error) {
+	return gw.pw.Write(p)
+}
+
+func (gw *gunzipWriter) Close() error {
+	gw.pw.Close()
+	if err := <-gw.done; err != nil {
+		return fmt.Errorf("failed to decompress: %w", err)
+	}
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
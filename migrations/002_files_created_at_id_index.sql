@@ -0,0 +1,5 @@
+USE labdropbox;
+
+-- Composite index backing "most recent files" queries and keyset pagination
+-- over (created_at, id)
+CREATE INDEX IF NOT EXISTS idx_created_at_id ON files (created_at, id);
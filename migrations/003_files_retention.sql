@@ -0,0 +1,5 @@
+USE labdropbox;
+
+-- Object-lock (WORM) retention applied to a file's chunk objects
+ALTER TABLE files ADD COLUMN IF NOT EXISTS retention_mode VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS retain_until TIMESTAMP NULL DEFAULT NULL;
@@ -0,0 +1,6 @@
+USE labdropbox;
+
+-- Raw SHA256 chunk hashes (TIDB_BINARY_HASHES=true). Rows written in binary
+-- mode leave hash empty; older rows keep their hex hash and hash_bin NULL.
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS hash_bin BINARY(32) NULL DEFAULT NULL;
+CREATE INDEX IF NOT EXISTS idx_hash_bin ON chunks (hash_bin);
@@ -0,0 +1,5 @@
+USE labdropbox;
+
+-- Chunking strategy and target chunk size a file was written with
+ALTER TABLE files ADD COLUMN IF NOT EXISTS chunking_strategy VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS target_chunk_size BIGINT NOT NULL DEFAULT 0;
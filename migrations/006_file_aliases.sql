@@ -0,0 +1,12 @@
+USE labdropbox;
+
+-- Short shareable names for files, each with an optional expiry. Aliases
+-- are case-sensitive (base62).
+CREATE TABLE IF NOT EXISTS file_aliases (
+    alias VARCHAR(64) CHARACTER SET ascii COLLATE ascii_bin PRIMARY KEY,
+    file_id VARCHAR(36) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NULL DEFAULT NULL,
+    FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+    INDEX idx_file_id (file_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
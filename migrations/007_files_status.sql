@@ -0,0 +1,5 @@
+USE labdropbox;
+
+-- Upload lifecycle: rows are inserted pending and flipped to complete once
+-- all chunk rows are saved. Existing files are complete.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'complete';
@@ -0,0 +1,4 @@
+USE labdropbox;
+
+-- Free-form, non-indexed file attributes; indexed fields stay real columns
+ALTER TABLE files ADD COLUMN IF NOT EXISTS metadata JSON NULL;
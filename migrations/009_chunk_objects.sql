@@ -0,0 +1,15 @@
+USE labdropbox;
+
+-- Number of chunk rows referencing each MinIO object. Content-addressed
+-- objects are shared by every file containing the same chunk, so an object
+-- may only be deleted once its refcount drops to zero.
+CREATE TABLE IF NOT EXISTS chunk_objects (
+    minio_object_key VARCHAR(512) PRIMARY KEY,
+    refcount INT NOT NULL DEFAULT 0
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Count references held by chunks written before this table existed. Keys
+-- already counted are left alone, so replaying this migration never resets
+-- live refcounts or upload claims.
+INSERT IGNORE INTO chunk_objects (minio_object_key, refcount)
+SELECT minio_object_key, COUNT(*) FROM chunks GROUP BY minio_object_key;
@@ -0,0 +1,5 @@
+USE labdropbox;
+
+-- Hex SHA256 of the whole file as stored; empty for files written before it
+-- was recorded or appended to since, whose reads skip the check
+ALTER TABLE files ADD COLUMN IF NOT EXISTS checksum VARCHAR(64) NOT NULL DEFAULT '';
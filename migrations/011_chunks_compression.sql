@@ -0,0 +1,6 @@
+USE labdropbox;
+
+-- How each chunk object is compressed and its size in MinIO. Existing rows
+-- keep an empty compression, meaning stored uncompressed.
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS compression VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS stored_size BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+USE labdropbox;
+
+-- Index backing idempotent uploads, which look up an existing file by the
+-- client-supplied content hash
+CREATE INDEX IF NOT EXISTS idx_checksum ON files (checksum);
@@ -0,0 +1,6 @@
+USE labdropbox;
+
+-- MIME type served on read, from the upload's Content-Type or sniffed from
+-- its first bytes; empty for files written before it was recorded, which
+-- are served as application/octet-stream
+ALTER TABLE files ADD COLUMN IF NOT EXISTS content_type VARCHAR(255) NOT NULL DEFAULT '';